@@ -3,7 +3,9 @@ package main
 import (
 	"embed"
 	"log"
+	"os"
 
+	"github.com/warjiang/page-spy-api/command"
 	"github.com/warjiang/page-spy-api/config"
 	"github.com/warjiang/page-spy-api/container"
 	"github.com/warjiang/page-spy-api/serve"
@@ -25,5 +27,14 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// 带参数时执行维护命令，比如 page-spy-api reencrypt
+	if len(os.Args) > 1 {
+		err = command.Run(os.Args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	serve.Run()
 }
@@ -0,0 +1,28 @@
+package command
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// 命令行模式下执行的维护命令，执行完成后退出，不启动服务
+var commands = map[string]func(args []string) error{
+	"reencrypt":       Reencrypt,
+	"migrate-storage": MigrateStorage,
+}
+
+// Run args 为去掉程序名之后的命令行参数
+func Run(args []string) error {
+	command, ok := commands[args[0]]
+	if !ok {
+		names := []string{}
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %s, available commands: %s", args[0], strings.Join(names, ", "))
+	}
+
+	return command(args[1:])
+}
@@ -0,0 +1,5 @@
+package command
+
+import "github.com/warjiang/page-spy-api/logger"
+
+var log = logger.Log().WithField("module", "command")
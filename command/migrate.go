@@ -0,0 +1,399 @@
+package command
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/warjiang/page-spy-api/config"
+	"github.com/warjiang/page-spy-api/container"
+	"github.com/warjiang/page-spy-api/data"
+	"github.com/warjiang/page-spy-api/rpc"
+	"github.com/warjiang/page-spy-api/storage"
+	"github.com/warjiang/page-spy-api/task"
+)
+
+// 两次进度输出的最小间隔
+const migrateProgressInterval = 5 * time.Second
+
+// MigrateStorage 把当前配置存储中的所有日志文件复制到目标配置的存储，比如从本地磁盘迁移到 S3
+// 每个文件复制后从目标存储读回校验 MD5，校验通过的文件记录在状态文件中，中断后重新执行会跳过这些文件
+// 文件按目标配置重新压缩和加密，文件 ID 不变，校验通过后把数据库中 blob 的压缩编码更新为目标存储中的编码
+// 更新后当前存储按记录的编码读取会失败，应该停止服务后再执行
+func MigrateStorage(args []string) error {
+	flags := flag.NewFlagSet("migrate-storage", flag.ContinueOnError)
+	targetPath := flags.String("target", "", "config file of the target storage")
+	statePath := flags.String("state", "migrate-storage.state", "file recording migrated files, used to resume")
+	concurrency := flags.Int("concurrency", 4, "files copied in parallel")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *targetPath == "" {
+		return fmt.Errorf("-target is required")
+	}
+
+	targetConfig, err := config.LoadConfigFile(*targetPath)
+	if err != nil {
+		return err
+	}
+
+	// 注册任务时就会开始计时，分层存储的迁移任务注册到单独的任务管理器后立即关闭，命令执行期间不会运行
+	taskManager := task.NewTaskManager()
+	target, err := storage.NewStorage(targetConfig, taskManager)
+	taskManager.Close()
+	if err != nil {
+		return fmt.Errorf("init target storage error %w", err)
+	}
+
+	var runErr error
+	err = container.Container().Invoke(func(sourceConfig *config.Config, dataApi data.DataApi, source storage.StorageApi, addressManager *rpc.AddressManager) {
+		state, err := openMigrateState(*statePath)
+		if err != nil {
+			runErr = err
+			return
+		}
+		defer state.Close()
+
+		migrator := &storageMigrator{
+			source: source,
+			target: target,
+			data:   dataApi,
+			state:  state,
+		}
+
+		runErr = migrator.run(max(*concurrency, 1))
+		if runErr != nil {
+			return
+		}
+
+		runErr = migrateMetadata(sourceConfig, targetConfig, target, addressManager.GetSelfMachineID())
+	})
+	if err != nil {
+		return err
+	}
+
+	// 校验失败重新复制前删除的文件在后台删除，退出前等待完成
+	return errors.Join(runErr, storage.Close(target))
+}
+
+// migrateMetadata sqlite 数据文件在使用 S3 的节点启动时从存储下载，目标是 S3 时需要上传
+func migrateMetadata(sourceConfig *config.Config, targetConfig *config.Config, target storage.StorageApi, machineId string) error {
+	if sourceConfig.DBConfig != nil && sourceConfig.DBConfig.DriverName != "sqlite" {
+		log.Infof("metadata is saved in %s, no need to migrate", sourceConfig.DBConfig.DriverName)
+		return nil
+	}
+
+	if !targetConfig.IsRemoteStorage() || targetConfig.IsSharedMetadata() {
+		log.Infof("metadata is saved in local sqlite file, no need to migrate")
+		return nil
+	}
+
+	// 服务仍在运行时数据文件可能正在写入，应该停止服务后再执行
+	err := data.SaveDataFile(targetConfig, target, machineId)
+	if err != nil {
+		return fmt.Errorf("migrate metadata error %w", err)
+	}
+
+	log.Infof("migrate metadata to target storage finished")
+	return nil
+}
+
+type migrateBlob struct {
+	blobId string
+	size   int64
+}
+
+type storageMigrator struct {
+	source storage.StorageApi
+	target storage.StorageApi
+	data   data.DataApi
+	state  *migrateState
+
+	total      int64
+	totalSize  int64
+	done       atomic.Int64
+	doneSize   atomic.Int64
+	skipped    atomic.Int64
+	failed     atomic.Int64
+	lastReport atomic.Int64
+	startedAt  time.Time
+}
+
+// collectBlobs 内容相同的日志共用一个 blob，只需要复制一次，没有上传完成的记录没有文件
+func collectBlobs(dataApi data.DataApi) ([]*migrateBlob, error) {
+	blobs := []*migrateBlob{}
+	seen := map[string]bool{}
+	lastId := uint(0)
+	for {
+		logs, err := dataApi.FindLogsAfter(lastId, 1000)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(logs) == 0 {
+			return blobs, nil
+		}
+
+		for _, l := range logs {
+			lastId = l.ID
+			blobId := l.GetBlobId()
+			if l.Status != data.Saved || seen[blobId] {
+				continue
+			}
+
+			seen[blobId] = true
+			blobs = append(blobs, &migrateBlob{blobId: blobId, size: l.Size})
+		}
+	}
+}
+
+func (m *storageMigrator) run(concurrency int) error {
+	blobs, err := collectBlobs(m.data)
+	if err != nil {
+		return err
+	}
+
+	m.startedAt = time.Now()
+	m.total = int64(len(blobs))
+	for _, blob := range blobs {
+		m.totalSize += blob.size
+	}
+
+	log.Infof("migrate %d files %dmb to target storage, %d files already migrated", m.total, m.totalSize/(1024*1024), m.state.Len())
+
+	queue := make(chan *migrateBlob)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blob := range queue {
+				m.migrate(blob)
+			}
+		}()
+	}
+
+	for _, blob := range blobs {
+		queue <- blob
+	}
+	close(queue)
+	wg.Wait()
+
+	m.report(true)
+	if failed := m.failed.Load(); failed > 0 {
+		return fmt.Errorf("migrate %d files failed, run the command again to retry", failed)
+	}
+
+	return nil
+}
+
+func (m *storageMigrator) migrate(blob *migrateBlob) {
+	defer m.report(false)
+	defer m.doneSize.Add(blob.size)
+	defer m.done.Add(1)
+
+	if m.state.Has(blob.blobId) {
+		m.skipped.Add(1)
+		return
+	}
+
+	checksum, encoding, err := m.copy(blob.blobId)
+	if err == nil {
+		// 读取时不再探测编码，必须记录目标存储中实际保存的编码
+		err = m.data.UpdateBlobEncoding(blob.blobId, encoding)
+	}
+
+	if err == nil {
+		err = m.state.Add(blob.blobId, checksum)
+	}
+
+	if err != nil {
+		m.failed.Add(1)
+		log.Errorf("migrate file %s error %s", blob.blobId, err.Error())
+	}
+}
+
+// copy 复制文件并校验，返回 MD5 和目标存储中文件的压缩编码
+// 目标存储中已有内容不一致或者无法读取的文件时删除后重新复制一次
+func (m *storageMigrator) copy(blobId string) (string, string, error) {
+	for retry := 0; ; retry++ {
+		checksum, err := m.save(blobId)
+		if err != nil {
+			return "", "", err
+		}
+
+		targetChecksum, encoding, err := readChecksum(m.target, blobId)
+		if err == nil && targetChecksum == checksum {
+			return checksum, encoding, nil
+		}
+
+		if retry > 0 {
+			if err != nil {
+				return "", "", fmt.Errorf("read target file error %w", err)
+			}
+			return "", "", fmt.Errorf("checksum mismatch, source %s target %s", checksum, targetChecksum)
+		}
+
+		log.Warnf("file %s in target storage is different from source, copy again", blobId)
+		err = m.target.RemoveLog(blobId)
+		if err != nil {
+			return "", "", err
+		}
+	}
+}
+
+// save 解压和解密后写入目标存储，返回原始内容的 MD5
+func (m *storageMigrator) save(blobId string) (string, error) {
+	logFile, err := m.source.GetLog(blobId)
+	if err != nil {
+		return "", fmt.Errorf("read source file error %w", err)
+	}
+	defer logFile.FileSteam.Close()
+
+	err = logFile.Decode()
+	if err != nil {
+		return "", err
+	}
+
+	hash := md5.New()
+	reader := io.TeeReader(logFile.FileSteam, hash)
+	err = m.target.SaveLog(&storage.LogFile{
+		Name:      logFile.Name,
+		FileId:    blobId,
+		FileSteam: io.NopCloser(reader),
+	})
+	if err != nil {
+		return "", fmt.Errorf("save target file error %w", err)
+	}
+
+	// 目标存储已有该文件时不会读取内容，读完剩余内容得到完整的 MD5
+	_, err = io.Copy(io.Discard, reader)
+	if err != nil {
+		return "", fmt.Errorf("read source file error %w", err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// readChecksum 返回原始内容的 MD5 和文件保存的压缩编码，已有的文件可能不是按目标配置的编码保存的
+func readChecksum(st storage.StorageApi, blobId string) (string, string, error) {
+	logFile, err := st.GetLog(blobId)
+	if err != nil {
+		return "", "", err
+	}
+	defer logFile.FileSteam.Close()
+
+	encoding := logFile.Encoding
+	err = logFile.Decode()
+	if err != nil {
+		return "", "", err
+	}
+
+	hash := md5.New()
+	_, err = io.Copy(hash, logFile.FileSteam)
+	if err != nil {
+		return "", "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), encoding, nil
+}
+
+// report 每隔一段时间输出一次进度，final 时总是输出
+func (m *storageMigrator) report(final bool) {
+	now := time.Now().UnixNano()
+	last := m.lastReport.Load()
+	if !final && (now-last < int64(migrateProgressInterval) || !m.lastReport.CompareAndSwap(last, now)) {
+		return
+	}
+
+	done, doneSize := m.done.Load(), m.doneSize.Load()
+	percent := 100.0
+	if m.totalSize > 0 {
+		percent = float64(doneSize) * 100 / float64(m.totalSize)
+	}
+
+	elapsed := time.Since(m.startedAt)
+	speed := float64(doneSize) / (1024 * 1024) / max(elapsed.Seconds(), 1)
+	log.Infof("migrate progress %d/%d files, %dmb/%dmb %.1f%%, %.1fmb/s, skipped %d, failed %d, elapsed %s",
+		done, m.total, doneSize/(1024*1024), m.totalSize/(1024*1024), percent, speed,
+		m.skipped.Load(), m.failed.Load(), elapsed.Round(time.Second))
+}
+
+// migrateState 记录已经迁移并校验通过的文件，每行为 blob ID 和 MD5
+type migrateState struct {
+	lock     sync.Mutex
+	file     *os.File
+	migrated map[string]string
+}
+
+func openMigrateState(path string) (*migrateState, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open migrate state file error %w", err)
+	}
+
+	state := &migrateState{
+		file:     file,
+		migrated: map[string]string{},
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 中断时写了一半的行没有 MD5，对应的文件会重新迁移
+		blobId, checksum, found := strings.Cut(scanner.Text(), " ")
+		if found && len(checksum) == md5.Size*2 {
+			state.migrated[blobId] = checksum
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read migrate state file error %w", err)
+	}
+
+	return state, nil
+}
+
+func (s *migrateState) Has(blobId string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.migrated[blobId]
+	return ok
+}
+
+func (s *migrateState) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.migrated)
+}
+
+func (s *migrateState) Add(blobId string, checksum string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// 以换行开头，上次中断时写了一半的行不会和这一行连在一起
+	_, err := fmt.Fprintf(s.file, "\n%s %s", blobId, checksum)
+	if err != nil {
+		return fmt.Errorf("write migrate state file error %w", err)
+	}
+
+	s.migrated[blobId] = checksum
+	return nil
+}
+
+func (s *migrateState) Close() error {
+	return errors.Join(s.file.Sync(), s.file.Close())
+}
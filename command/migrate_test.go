@@ -0,0 +1,114 @@
+package command
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/warjiang/page-spy-api/config"
+	"github.com/warjiang/page-spy-api/data"
+	"github.com/warjiang/page-spy-api/storage"
+	"github.com/warjiang/page-spy-api/task"
+)
+
+// migrateTestData 只实现迁移用到的方法
+type migrateTestData struct {
+	data.DataApi
+	logs      []*data.LogData
+	encodings map[string]string
+}
+
+func (d *migrateTestData) FindLogsAfter(id uint, size int) ([]*data.LogData, error) {
+	logs := []*data.LogData{}
+	for _, l := range d.logs {
+		if l.ID > id && len(logs) < size {
+			logs = append(logs, l)
+		}
+	}
+
+	return logs, nil
+}
+
+func (d *migrateTestData) UpdateBlobEncoding(blobId string, encoding string) error {
+	d.encodings[blobId] = encoding
+	return nil
+}
+
+func newMigrateTestStorage(t *testing.T, compression string) storage.StorageApi {
+	t.Helper()
+
+	taskManager := task.NewTaskManager()
+	defer taskManager.Close()
+
+	st, err := storage.NewStorage(&config.Config{
+		Compression:        compression,
+		LocalStorageConfig: &config.LocalStorageConfig{RootDir: t.TempDir()},
+	}, taskManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return st
+}
+
+func TestMigrateStorageWithDifferentCompression(t *testing.T) {
+	source := newMigrateTestStorage(t, storage.EncodingGzip)
+	target := newMigrateTestStorage(t, storage.EncodingZstd)
+
+	content := bytes.Repeat([]byte("page spy log "), 100)
+	blobId := "local.0123456789abcdef0123456789abcdef"
+	err := source.SaveLog(&storage.LogFile{FileId: blobId, FileSteam: io.NopCloser(bytes.NewReader(content))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataApi := &migrateTestData{
+		logs: []*data.LogData{{
+			Model:  data.Model{ID: 1},
+			FileId: blobId,
+			BlobId: blobId,
+			Status: data.Saved,
+			Size:   int64(len(content)),
+		}},
+		encodings: map[string]string{blobId: storage.EncodingGzip},
+	}
+
+	state, err := openMigrateState(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	migrator := &storageMigrator{source: source, target: target, data: dataApi, state: state}
+	err = migrator.run(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoding := dataApi.encodings[blobId]
+	if encoding != storage.EncodingZstd {
+		t.Fatalf("expect blob encoding to be updated to %s, got %q", storage.EncodingZstd, encoding)
+	}
+
+	// 按记录的编码读取，与正常服务时一样不探测编码
+	logFile, err := storage.WithEncoding(target, &encoding).GetLog(blobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.FileSteam.Close()
+
+	err = logFile.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := io.ReadAll(logFile.FileSteam)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(migrated, content) {
+		t.Fatal("expect migrated content to be the same as source")
+	}
+}
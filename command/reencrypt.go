@@ -0,0 +1,75 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/warjiang/page-spy-api/container"
+	"github.com/warjiang/page-spy-api/data"
+	"github.com/warjiang/page-spy-api/storage"
+)
+
+// Reencrypt 使用当前主密钥重新加密所有日志文件，用于轮换主密钥或加密历史文件
+// 轮换时需要同时保留新旧主密钥，命令完成后才能从配置中删除旧密钥
+func Reencrypt(_ []string) error {
+	var runErr error
+	err := container.Container().Invoke(func(dataApi data.DataApi, storageApi storage.StorageApi) {
+		reencrypter, ok := storageApi.(storage.Reencrypter)
+		if !ok {
+			runErr = fmt.Errorf("storage does not support encryption")
+			return
+		}
+
+		runErr = reencryptAll(dataApi, reencrypter)
+	})
+	if err != nil {
+		return err
+	}
+
+	return runErr
+}
+
+func reencryptAll(dataApi data.DataApi, reencrypter storage.Reencrypter) error {
+	query := &data.FileListQuery{PageQuery: data.PageQuery{Size: 100, Page: 1}}
+	done, changed, failed := 0, 0, 0
+	// 内容相同的日志共用一个 blob，只需要处理一次
+	seen := map[string]bool{}
+	for {
+		page, err := dataApi.FindLogs(query)
+		if err != nil {
+			return err
+		}
+
+		for _, l := range page.Data {
+			done++
+			blobId := l.GetBlobId()
+			if seen[blobId] {
+				continue
+			}
+			seen[blobId] = true
+
+			ok, err := reencrypter.ReencryptLog(blobId)
+			if err != nil {
+				failed++
+				log.Errorf("reencrypt file %s error %s", blobId, err.Error())
+				continue
+			}
+
+			if ok {
+				changed++
+			}
+		}
+
+		log.Infof("reencrypt progress %d/%d, reencrypted %d, failed %d", done, page.Total, changed, failed)
+		if len(page.Data) < query.Size {
+			break
+		}
+
+		query.Page++
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("reencrypt %d files failed", failed)
+	}
+
+	return nil
+}
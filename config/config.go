@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"io/fs"
 	"os"
+	"strings"
+	"time"
 )
 
 type CorsConfig struct {
@@ -22,6 +24,48 @@ type StorageConfig struct {
 	Endpoint         string `json:"endpoint"`
 	Bucket           string `json:"bucket"`
 	S3ForcePathStyle bool   `json:"s3ForcePathStyle"`
+	// part size of multipart upload, default 5MB, which is also the minimum
+	UploadPartSizeOfMB int64 `json:"uploadPartSizeOfMB"`
+	// parts uploaded in parallel of one file, default 3
+	UploadConcurrency int `json:"uploadConcurrency"`
+	// redirect downloads to presigned urls of s3 instead of streaming through the node
+	PresignedDownload bool `json:"presignedDownload"`
+	// allow clients to upload log files to s3 directly with presigned urls
+	PresignedUpload bool `json:"presignedUpload"`
+	// lifetime of presigned urls, default 5 minutes
+	PresignExpireOfMinute int64 `json:"presignExpireOfMinute"`
+}
+
+func (s *StorageConfig) IsPresignedDownload() bool {
+	return s != nil && s.PresignedDownload
+}
+
+func (s *StorageConfig) IsPresignedUpload() bool {
+	return s != nil && s.PresignedUpload
+}
+
+func (s *StorageConfig) GetPresignExpire() time.Duration {
+	if s == nil || s.PresignExpireOfMinute <= 0 {
+		return 5 * time.Minute
+	}
+
+	return time.Duration(s.PresignExpireOfMinute) * time.Minute
+}
+
+func (s *StorageConfig) GetUploadPartSizeOfMB() int64 {
+	if s.UploadPartSizeOfMB < 5 {
+		return 5
+	}
+
+	return s.UploadPartSizeOfMB
+}
+
+func (s *StorageConfig) GetUploadConcurrency() int {
+	if s.UploadConcurrency <= 0 {
+		return 3
+	}
+
+	return s.UploadConcurrency
 }
 
 func (s *StorageConfig) GetLogDir() string {
@@ -47,6 +91,37 @@ type Config struct {
 	MaxLogLifeTimeOfHour int64       `json:"maxLogLifeTimeOfHour"`
 	AuthConfig           *AuthConfig `json:"authConfig"`
 	DBConfig             *DBConfig   `json:"dbConfig"`
+	RpcConfig            *RpcConfig  `json:"rpcConfig"`
+	// room placement strategy of cluster, valid value is local/leastRooms/leastConnections/groupHash
+	RoomPlacement string `json:"roomPlacement"`
+	// max room number of the whole cluster, 0 means no limit
+	MaxClusterRoomNumber int `json:"maxClusterRoomNumber"`
+	// all nodes share the same mysql database and s3 storage, metadata queries skip rpc fan-out
+	SharedMetadata bool `json:"sharedMetadata"`
+	// leader lease of cluster maintenance tasks, default 15 seconds
+	LeaderLeaseOfSecond int          `json:"leaderLeaseOfSecond"`
+	TraceConfig         *TraceConfig `json:"traceConfig"`
+	// max size of a single uploaded log file, default 200MB
+	MaxUploadSizeOfMB int64 `json:"maxUploadSizeOfMB"`
+	// max size of /jsonLog/upload body, default same as maxUploadSizeOfMB
+	MaxJsonUploadSizeOfMB int64 `json:"maxJsonUploadSizeOfMB"`
+	// unfinished resumable upload sessions are removed after this, default 24 hours
+	UploadSessionExpireOfHour int64 `json:"uploadSessionExpireOfHour"`
+	// local dir of unfinished resumable upload sessions, default ./upload
+	UploadSessionDir string `json:"uploadSessionDir"`
+	// compression of stored log files, valid value is gzip/zstd, empty means no compression
+	Compression string `json:"compression"`
+	// root dir and layout of log files when storageConfig is empty
+	LocalStorageConfig *LocalStorageConfig `json:"localStorageConfig"`
+	// keep new log files on local disk and move them to s3 later, requires storageConfig
+	TieredStorageConfig *TieredStorageConfig `json:"tieredStorageConfig"`
+	// envelope encryption of stored files, disabled when no master key
+	EncryptionConfig *EncryptionConfig `json:"encryptionConfig"`
+	// periodic consistency check between log records and stored files
+	ScrubConfig *ScrubConfig `json:"scrubConfig"`
+	// retention policies matched by log tags or log group, logs matching no rule use maxLogLifeTimeOfHour
+	// logs on s3 are only cleaned by the server when rules are set, otherwise use the bucket lifecycle
+	RetentionRules []*RetentionRule `json:"retentionRules"`
 }
 
 func (c *Config) GetLogDir() string {
@@ -79,6 +154,15 @@ func (c *Config) IsRemoteStorage() bool {
 	return c.StorageConfig != nil
 }
 
+// IsTieredStorage 本地磁盘和 S3 分层存储，本地磁盘只保存最近的日志
+func (c *Config) IsTieredStorage() bool {
+	return c.IsRemoteStorage() && c.TieredStorageConfig != nil
+}
+
+func (c *Config) IsSharedMetadata() bool {
+	return c.SharedMetadata
+}
+
 func (c *Config) GetMaxLogLifeTimeOfHour() int64 {
 	if c.MaxLogLifeTimeOfHour <= 0 {
 		return 30 * 24 // default log life 30 day
@@ -95,6 +179,42 @@ func (c *Config) GetMaxLogFileSizeOfMB() int64 {
 	return c.MaxLogFileSizeOfMB
 }
 
+func (c *Config) GetMaxUploadSizeOfMB() int64 {
+	if c.MaxUploadSizeOfMB <= 0 {
+		return 200
+	}
+
+	return c.MaxUploadSizeOfMB
+}
+
+func (c *Config) GetMaxJsonUploadSizeOfMB() int64 {
+	if c.MaxJsonUploadSizeOfMB <= 0 {
+		return c.GetMaxUploadSizeOfMB()
+	}
+
+	return c.MaxJsonUploadSizeOfMB
+}
+
+func (c *Config) GetCompression() string {
+	return strings.ToLower(strings.TrimSpace(c.Compression))
+}
+
+func (c *Config) GetUploadSessionExpire() time.Duration {
+	if c.UploadSessionExpireOfHour <= 0 {
+		return 24 * time.Hour
+	}
+
+	return time.Duration(c.UploadSessionExpireOfHour) * time.Hour
+}
+
+func (c *Config) GetUploadSessionDir() string {
+	if c.UploadSessionDir == "" {
+		return "./upload"
+	}
+
+	return c.UploadSessionDir
+}
+
 func (c *Config) GetMaxRoomNumber() int {
 	if c.MaxRoomNumber <= 0 {
 		return 500
@@ -103,6 +223,199 @@ func (c *Config) GetMaxRoomNumber() int {
 	return c.MaxRoomNumber
 }
 
+// RpcConfig 节点间 RPC 调用配置
+type RpcConfig struct {
+	// timeout of each rpc attempt, unit is millisecond
+	TimeoutOfMs int64 `json:"timeoutOfMs"`
+	// max retry times of read-only rpc methods
+	MaxRetry int `json:"maxRetry"`
+	// base backoff between retries, unit is millisecond
+	RetryBackoffOfMs int64 `json:"retryBackoffOfMs"`
+	// continuous failures before the breaker of a peer opens
+	BreakerFailureThreshold int `json:"breakerFailureThreshold"`
+	// time the breaker stays open before a probe request, unit is second
+	BreakerCooldownOfSecond int64 `json:"breakerCooldownOfSecond"`
+	MaxIdleConnsPerHost     int   `json:"maxIdleConnsPerHost"`
+	// unit is second
+	IdleConnTimeoutOfSecond int64 `json:"idleConnTimeoutOfSecond"`
+	// shared cluster secret, rpc requests are signed with HMAC-SHA256 and unsigned requests are rejected
+	Secret string `json:"secret"`
+	// mutual TLS between nodes
+	TLS *RpcTLSConfig `json:"tls"`
+	// bind host of rpc server, default is all interfaces in cluster mode and 127.0.0.1 in single-node mode
+	ListenHost string `json:"listenHost"`
+	// rpc port in single-node mode, default is a random available port
+	ListenPort string `json:"listenPort"`
+	// serve rpc over unix domain socket in single-node mode
+	UnixSocket string `json:"unixSocket"`
+	// do not open any rpc listener in single-node mode, calls are served in process
+	DisableListener bool `json:"disableListener"`
+}
+
+// RpcTLSConfig 节点间双向 TLS 配置，所有节点使用同一个 CA 签发的证书
+type RpcTLSConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	CAFile   string `json:"caFile"`
+	// server name to verify, default is the ip of the peer
+	ServerName string `json:"serverName"`
+}
+
+func (r *RpcConfig) GetSecret() string {
+	if r == nil {
+		return ""
+	}
+
+	return r.Secret
+}
+
+func (r *RpcConfig) IsTLS() bool {
+	return r != nil && r.TLS != nil
+}
+
+func (r *RpcConfig) GetListenHost() string {
+	if r == nil {
+		return ""
+	}
+
+	return r.ListenHost
+}
+
+func (r *RpcConfig) GetListenPort() string {
+	if r == nil {
+		return ""
+	}
+
+	return r.ListenPort
+}
+
+func (r *RpcConfig) GetUnixSocket() string {
+	if r == nil {
+		return ""
+	}
+
+	return r.UnixSocket
+}
+
+func (r *RpcConfig) IsListenerDisabled() bool {
+	return r != nil && r.DisableListener
+}
+
+func (r *RpcConfig) GetTimeout() time.Duration {
+	if r == nil || r.TimeoutOfMs <= 0 {
+		return 4 * time.Second
+	}
+
+	return time.Duration(r.TimeoutOfMs) * time.Millisecond
+}
+
+func (r *RpcConfig) GetMaxRetry() int {
+	if r == nil || r.MaxRetry < 0 {
+		return 0
+	}
+
+	if r.MaxRetry == 0 {
+		return 2
+	}
+
+	return r.MaxRetry
+}
+
+func (r *RpcConfig) GetRetryBackoff() time.Duration {
+	if r == nil || r.RetryBackoffOfMs <= 0 {
+		return 100 * time.Millisecond
+	}
+
+	return time.Duration(r.RetryBackoffOfMs) * time.Millisecond
+}
+
+func (r *RpcConfig) GetBreakerFailureThreshold() int {
+	if r == nil || r.BreakerFailureThreshold <= 0 {
+		return 5
+	}
+
+	return r.BreakerFailureThreshold
+}
+
+func (r *RpcConfig) GetBreakerCooldown() time.Duration {
+	if r == nil || r.BreakerCooldownOfSecond <= 0 {
+		return 10 * time.Second
+	}
+
+	return time.Duration(r.BreakerCooldownOfSecond) * time.Second
+}
+
+func (r *RpcConfig) GetMaxIdleConnsPerHost() int {
+	if r == nil || r.MaxIdleConnsPerHost <= 0 {
+		return 32
+	}
+
+	return r.MaxIdleConnsPerHost
+}
+
+func (r *RpcConfig) GetIdleConnTimeout() time.Duration {
+	if r == nil || r.IdleConnTimeoutOfSecond <= 0 {
+		return 90 * time.Second
+	}
+
+	return time.Duration(r.IdleConnTimeoutOfSecond) * time.Second
+}
+
+func (c *Config) GetRoomPlacement() string {
+	if c.RoomPlacement == "" {
+		return "local"
+	}
+
+	return c.RoomPlacement
+}
+
+func (c *Config) GetMaxClusterRoomNumber() int {
+	if c.MaxClusterRoomNumber <= 0 {
+		return 0
+	}
+
+	return c.MaxClusterRoomNumber
+}
+
+func (c *Config) GetLeaderLease() time.Duration {
+	if c.LeaderLeaseOfSecond <= 0 {
+		return 15 * time.Second
+	}
+
+	return time.Duration(c.LeaderLeaseOfSecond) * time.Second
+}
+
+type TraceConfig struct {
+	// span exporter, empty to disable, support stdout and file
+	Exporter    string `json:"exporter"`
+	FilePath    string `json:"filePath"`
+	ServiceName string `json:"serviceName"`
+}
+
+func (c *TraceConfig) GetExporter() string {
+	if c == nil {
+		return ""
+	}
+
+	return c.Exporter
+}
+
+func (c *TraceConfig) GetFilePath() string {
+	if c == nil || c.FilePath == "" {
+		return "trace.log"
+	}
+
+	return c.FilePath
+}
+
+func (c *TraceConfig) GetServiceName() string {
+	if c == nil || c.ServiceName == "" {
+		return "page-spy-api"
+	}
+
+	return c.ServiceName
+}
+
 type Address struct {
 	Ip   string `json:"ip"`
 	Port string `json:"port"`
@@ -115,6 +428,22 @@ type StaticConfig struct {
 	Version string
 }
 
+func (s *StaticConfig) GetGitHash() string {
+	if s == nil || s.GitHash == "" {
+		return "local"
+	}
+
+	return s.GitHash
+}
+
+func (s *StaticConfig) GetVersion() string {
+	if s == nil || s.Version == "" {
+		return "local"
+	}
+
+	return s.Version
+}
+
 type DBConfig struct {
 	DisableMigrate bool   `json:"disableMigrate"`
 	DriverName     string `json:"driverName"`
@@ -125,3 +454,137 @@ type DBConfig struct {
 	Password       string `json:"password"`
 	DBName         string `json:"dbName"`
 }
+
+// IsMigrate 没有配置数据库时使用默认的 sqlite，同样需要迁移
+func (c *DBConfig) IsMigrate() bool {
+	return c == nil || !c.DisableMigrate
+}
+
+type EncryptionConfig struct {
+	// master keys used to wrap the data key of each file, key id -> base64 encoded 32 bytes key
+	MasterKeys map[string]string `json:"masterKeys"`
+	// id of the master key used for new files, other keys are only used to decrypt old files
+	ActiveKeyId string `json:"activeKeyId"`
+}
+
+func (c *EncryptionConfig) IsEnabled() bool {
+	return c != nil && len(c.MasterKeys) > 0
+}
+
+// GetActiveKeyId 只有一个主密钥时可以不指定
+func (c *EncryptionConfig) GetActiveKeyId() string {
+	if c == nil {
+		return ""
+	}
+
+	if c.ActiveKeyId == "" && len(c.MasterKeys) == 1 {
+		for id := range c.MasterKeys {
+			return id
+		}
+	}
+
+	return c.ActiveKeyId
+}
+
+type LocalStorageConfig struct {
+	// root dir of log files, default ./log
+	RootDir string `json:"rootDir"`
+	// levels of sub directories named by the hash prefix of file name, default 2, max 4
+	ShardLevels int `json:"shardLevels"`
+}
+
+func (c *LocalStorageConfig) GetRootDir() string {
+	if c == nil || c.RootDir == "" {
+		return "./log"
+	}
+
+	return c.RootDir
+}
+
+func (c *LocalStorageConfig) GetShardLevels() int {
+	if c == nil || c.ShardLevels <= 0 {
+		return 2
+	}
+
+	return min(c.ShardLevels, 4)
+}
+
+type TieredStorageConfig struct {
+	// move local log files to s3 after this, default 7 days
+	MigrateAfterOfHour int64 `json:"migrateAfterOfHour"`
+	// move the oldest local log files to s3 when local files exceed this, 0 means no limit
+	MaxLocalSizeOfMB int64 `json:"maxLocalSizeOfMB"`
+}
+
+func (c *TieredStorageConfig) GetMigrateAfter() time.Duration {
+	if c == nil || c.MigrateAfterOfHour <= 0 {
+		return 7 * 24 * time.Hour
+	}
+
+	return time.Duration(c.MigrateAfterOfHour) * time.Hour
+}
+
+func (c *TieredStorageConfig) GetMaxLocalSizeOfMB() int64 {
+	if c == nil || c.MaxLocalSizeOfMB <= 0 {
+		return 0
+	}
+
+	return c.MaxLocalSizeOfMB
+}
+
+type ScrubConfig struct {
+	// interval of the scrub task, default 24 hours
+	IntervalOfHour int64 `json:"intervalOfHour"`
+	// fix the problems found by the scrub task, default only report them
+	Repair bool `json:"repair"`
+	// read compressed and encrypted files to check their size
+	Deep bool `json:"deep"`
+}
+
+func (c *ScrubConfig) GetInterval() time.Duration {
+	if c == nil || c.IntervalOfHour <= 0 {
+		return 24 * time.Hour
+	}
+
+	return time.Duration(c.IntervalOfHour) * time.Hour
+}
+
+func (c *ScrubConfig) IsRepair() bool {
+	return c != nil && c.Repair
+}
+
+func (c *ScrubConfig) IsDeep() bool {
+	return c != nil && c.Deep
+}
+
+// RetentionRule 匹配的日志按单独的时间和大小清理，多条规则匹配时使用第一条
+type RetentionRule struct {
+	// name of the rule in the cleanup report
+	Name string `json:"name"`
+	// logs having all these tags, empty value matches any value of the tag
+	Tags map[string]string `json:"tags"`
+	// true matches logs uploaded in a log group, false matches logs not in a group
+	InGroup *bool `json:"inGroup"`
+	// logs in a log group having all these tags
+	GroupTags map[string]string `json:"groupTags"`
+	// max life of matched logs, default same as maxLogLifeTimeOfHour
+	MaxLogLifeTimeOfHour int64 `json:"maxLogLifeTimeOfHour"`
+	// max total size of matched logs, 0 means no limit except maxLogFileSizeOfMB
+	MaxLogFileSizeOfMB int64 `json:"maxLogFileSizeOfMB"`
+}
+
+func (r *RetentionRule) GetMaxLogLifeTimeOfHour(defaultHour int64) int64 {
+	if r.MaxLogLifeTimeOfHour <= 0 {
+		return defaultHour
+	}
+
+	return r.MaxLogLifeTimeOfHour
+}
+
+func (r *RetentionRule) GetMaxLogFileSizeOfMB() int64 {
+	if r.MaxLogFileSizeOfMB <= 0 {
+		return 0
+	}
+
+	return r.MaxLogFileSizeOfMB
+}
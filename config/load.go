@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"encoding/base64"
@@ -33,9 +34,126 @@ func LoadConfig() (*Config, error) {
 
 	// 从环境变量加载认证配置
 	loadAuthConfigFromEnv(config)
+	loadRpcConfigFromEnv(config)
+	loadEncryptionConfigFromEnv(config)
+
+	err = checkSharedMetadata(config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkTieredStorage(config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkRetentionRules(config)
+	if err != nil {
+		return nil, err
+	}
+
 	return config, nil
 }
 
+// 共享元数据模式要求所有节点使用同一个 mysql 和 s3，否则各节点看到的数据不一致
+func checkSharedMetadata(config *Config) error {
+	if !config.IsSharedMetadata() {
+		return nil
+	}
+
+	if config.DBConfig == nil || config.DBConfig.DriverName != "mysql" {
+		return fmt.Errorf("sharedMetadata requires dbConfig with mysql driver")
+	}
+
+	if !config.IsRemoteStorage() {
+		return fmt.Errorf("sharedMetadata requires storageConfig of s3")
+	}
+
+	return nil
+}
+
+// 分层存储的本地文件只在当前节点，共享元数据模式下其它节点无法读取
+func checkTieredStorage(config *Config) error {
+	if config.TieredStorageConfig == nil {
+		return nil
+	}
+
+	if !config.IsRemoteStorage() {
+		return fmt.Errorf("tieredStorageConfig requires storageConfig of s3")
+	}
+
+	if config.IsSharedMetadata() {
+		return fmt.Errorf("tieredStorageConfig can not be used with sharedMetadata")
+	}
+
+	return nil
+}
+
+// 清理报告按规则名称区分，规则名称不能为空或重复
+func checkRetentionRules(config *Config) error {
+	names := map[string]bool{}
+	for i, rule := range config.RetentionRules {
+		if rule == nil || rule.Name == "" {
+			return fmt.Errorf("retentionRules[%d] requires name", i)
+		}
+
+		if names[rule.Name] {
+			return fmt.Errorf("retentionRules name %s is duplicated", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if len(rule.GroupTags) > 0 && rule.InGroup != nil && !*rule.InGroup {
+			return fmt.Errorf("retentionRules %s can not use groupTags with inGroup false", rule.Name)
+		}
+	}
+
+	return nil
+}
+
+// 从环境变量加载集群 RPC 密钥，避免密钥写入配置文件
+func loadRpcConfigFromEnv(config *Config) {
+	secret := os.Getenv("RPC_SECRET")
+	if secret == "" {
+		return
+	}
+
+	if config.RpcConfig == nil {
+		config.RpcConfig = &RpcConfig{}
+	}
+
+	config.RpcConfig.Secret = secret
+}
+
+// 从环境变量加载加密主密钥，格式为 id:base64key，多个密钥用逗号分隔
+func loadEncryptionConfigFromEnv(config *Config) {
+	keys := os.Getenv("ENCRYPTION_MASTER_KEYS")
+	activeKeyId := os.Getenv("ENCRYPTION_ACTIVE_KEY_ID")
+	if keys == "" && activeKeyId == "" {
+		return
+	}
+
+	if config.EncryptionConfig == nil {
+		config.EncryptionConfig = &EncryptionConfig{}
+	}
+
+	if config.EncryptionConfig.MasterKeys == nil {
+		config.EncryptionConfig.MasterKeys = map[string]string{}
+	}
+
+	for _, item := range strings.Split(keys, ",") {
+		id, key, found := strings.Cut(strings.TrimSpace(item), ":")
+		if !found {
+			continue
+		}
+
+		config.EncryptionConfig.MasterKeys[id] = key
+	}
+
+	if activeKeyId != "" {
+		config.EncryptionConfig.ActiveKeyId = activeKeyId
+	}
+}
+
 // 从环境变量加载认证配置
 func loadAuthConfigFromEnv(config *Config) {
 	// 如果存在环境变量认证配置，才初始化 AuthConfig
@@ -109,16 +227,45 @@ func checkLocalConfigFile() error {
 }
 
 func loadLocalConfigFile() (*Config, error) {
+	return decodeConfigFile(ConfigFileName)
+}
+
+// LoadConfigFile 读取指定的配置文件，不创建默认配置也不读取环境变量，用于迁移存储等命令
+func LoadConfigFile(path string) (*Config, error) {
+	config, err := decodeConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkSharedMetadata(config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkTieredStorage(config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkRetentionRules(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func decodeConfigFile(path string) (*Config, error) {
 	config := &Config{}
-	f, err := os.Open(ConfigFileName)
+	f, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("read config.json error %w", err)
+		return nil, fmt.Errorf("read %s error %w", path, err)
 	}
 	defer f.Close()
 	encoder := json.NewDecoder(f)
 	err = encoder.Decode(config)
 	if err != nil {
-		return nil, fmt.Errorf("decode config.json error %w", err)
+		return nil, fmt.Errorf("decode %s error %w", path, err)
 	}
 
 	config = resolveRpcAddress(config)
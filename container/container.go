@@ -6,12 +6,13 @@ import (
 
 	"github.com/warjiang/page-spy-api/config"
 	"github.com/warjiang/page-spy-api/data"
-	"github.com/warjiang/page-spy-api/proxy"
+	"github.com/warjiang/page-spy-api/election"
 	"github.com/warjiang/page-spy-api/rpc"
 	"github.com/warjiang/page-spy-api/serve/route"
 	"github.com/warjiang/page-spy-api/serve/socket"
 	"github.com/warjiang/page-spy-api/storage"
 	"github.com/warjiang/page-spy-api/task"
+	"github.com/warjiang/page-spy-api/trace"
 	"go.uber.org/dig"
 )
 
@@ -21,6 +22,10 @@ func InitContainer() (*dig.Container, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = container.Provide(trace.NewExporter)
+	if err != nil {
+		return nil, err
+	}
 	err = container.Provide(rpc.NewAddressManager)
 	if err != nil {
 		return nil, err
@@ -55,13 +60,17 @@ func InitContainer() (*dig.Container, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = container.Provide(proxy.NewProxy)
-
+	err = container.Provide(election.NewElector)
 	if err != nil {
 		return nil, err
 	}
 	err = container.Provide(route.NewCore)
 
+	if err != nil {
+		return nil, err
+	}
+	err = container.Provide(route.NewClusterApi)
+
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,10 @@
 package data
 
-import "time"
+import (
+	"time"
+
+	"github.com/warjiang/page-spy-api/config"
+)
 
 type DataApi interface {
 	CreateLogGroup(logGroup *LogGroup) error
@@ -13,9 +17,28 @@ type DataApi interface {
 	CreateLog(log *LogData) error
 	FindLogs(query *FileListQuery) (*Page[*LogData], error)
 	UpdateLogStatus(fileId string, status Status) error
-	DeleteLogByFileId(fileId string) error
+	DeleteLog(log *LogData) (*Blob, error)
 	FindLogByFileId(fileId string) (*LogData, error)
+	FindLogsByFileId(fileId string) ([]*LogData, error)
 	FindTimeoutLogs(before time.Time, size int) ([]*LogData, error)
 	FindOldestLogs(size int) ([]*LogData, error)
+	FindShouldDeleteLogs(before time.Time, size int) ([]*LogData, error)
 	CountLogsSize() (int64, error)
+	CountLogs() (int64, error)
+
+	AcquireBlob(blob *Blob) (bool, error)
+	FindBlob(blobId string) (*Blob, error)
+	ReleaseBlob(blobId string) (*Blob, error)
+	UpdateBlobEncoding(blobId string, encoding string) error
+
+	FindLogsAfter(id uint, size int) ([]*LogData, error)
+	FindLogGroupsAfter(id uint, size int) ([]*LogGroup, error)
+	UpdateLogSize(log *LogData, size int64) error
+	UpdateLogGroupSize(logGroup *LogGroup, size int64) error
+	RemoveOrphanBlob(blobId string, before time.Time) (bool, error)
+
+	CountRetentionLogs(rules []*config.RetentionRule, index int) (*RetentionStat, error)
+	FindRetentionLogsAfter(rules []*config.RetentionRule, index int, after *LogData, size int) ([]*LogData, error)
+
+	AcquireLease(name string, holder string, ttl time.Duration) (string, error)
 }
@@ -0,0 +1,231 @@
+package data
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrBlobDeleting blob 的引用已经归零，文件可能正在从存储删除，不能再被引用
+var ErrBlobDeleting = errors.New("blob is being deleted")
+
+// 引用归零后保留删除标记的时间，之后文件一定已经从存储删除，可以重新创建同一个 blob
+const blobTombstoneExpire = time.Hour
+
+// Blob 存储中实际保存的文件，内容相同的日志共用一个 blob，引用计数归零时才从存储删除
+type Blob struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	BlobId    string    `gorm:"uniqueIndex;size:191" json:"blobId"`
+	Size      int64     `json:"size"`
+	RefCount  int64     `json:"refCount"`
+	// 文件保存时的压缩编码，为空表示记录编码之前保存的文件，读取时需要探测
+	Encoding *string `gorm:"size:16" json:"encoding,omitempty"`
+	// 引用归零的时间，不为空时文件正在从存储删除，其它节点不能再引用
+	DeletingAt *time.Time `gorm:"index" json:"deletingAt,omitempty"`
+}
+
+// GetBlobId 历史数据没有 BlobId，文件 ID 就是 blob ID
+func (l *LogData) GetBlobId() string {
+	if l.BlobId == "" {
+		return l.FileId
+	}
+
+	return l.BlobId
+}
+
+// lockBlobRow 在事务中锁定 blob 记录，共享元数据时其它节点的引用和删除会等待事务结束，sqlite 不支持行锁，写事务本身是串行的
+func lockBlobRow(tx *gorm.DB, blobId string) (*Blob, error) {
+	blob := &Blob{}
+	result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("blob_id = ?", blobId).Limit(1).Find(blob)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+
+	return blob, nil
+}
+
+// AcquireBlob 增加 blob 的引用，blob 不存在时按传入的记录创建，已存在时读取已有的记录，返回 blob 之前是否已经存在
+// 返回 false 时调用方必须重新上传文件，存储中同名的文件可能是正在删除的旧文件
+func (d *Data) AcquireBlob(blob *Blob) (bool, error) {
+	existed := false
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		current, err := lockBlobRow(tx, blob.BlobId)
+		if err != nil {
+			return err
+		}
+
+		if current == nil {
+			blob.RefCount = 1
+			return tx.Create(blob).Error
+		}
+
+		if current.DeletingAt != nil {
+			if current.DeletingAt.After(time.Now().Add(-blobTombstoneExpire)) {
+				return ErrBlobDeleting
+			}
+
+			// 删除早已完成，按新的 blob 重新使用这条记录
+			blob.ID = current.ID
+			blob.CreatedAt = current.CreatedAt
+			blob.RefCount = 1
+			blob.DeletingAt = nil
+			return tx.Select("*").Save(blob).Error
+		}
+
+		existed = true
+		*blob = *current
+		blob.RefCount++
+		return tx.Model(&Blob{}).Where("id = ?", current.ID).Update("ref_count", gorm.Expr("ref_count + 1")).Error
+	})
+
+	return existed, err
+}
+
+// FindBlob 没有 blob 记录的历史数据返回 nil
+func (d *Data) FindBlob(blobId string) (*Blob, error) {
+	blob := &Blob{}
+	result := d.db.Where("blob_id = ?", blobId).First(blob)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+
+	return blob, result.Error
+}
+
+// UpdateBlobEncoding 文件按其它压缩编码重新保存后更新记录的编码
+func (d *Data) UpdateBlobEncoding(blobId string, encoding string) error {
+	return d.db.Model(&Blob{}).Where("blob_id = ?", blobId).Update("encoding", encoding).Error
+}
+
+// ReleaseBlob 减少 blob 的引用，引用归零时返回该 blob，调用方需要从存储删除文件
+func (d *Data) ReleaseBlob(blobId string) (*Blob, error) {
+	var released *Blob
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		released, err = releaseBlob(tx, blobId)
+		return err
+	})
+
+	return released, err
+}
+
+// releaseBlob 引用归零时不删除记录，而是标记为正在删除，避免其它节点在文件删除前重新引用
+func releaseBlob(tx *gorm.DB, blobId string) (*Blob, error) {
+	blob, err := lockBlobRow(tx, blobId)
+	if err != nil {
+		return nil, err
+	}
+
+	if blob == nil {
+		// 没有 blob 记录的历史数据，没有其它日志使用时才能删除
+		var count int64
+		err := tx.Model(&LogData{}).Where("blob_id = ? OR (blob_id = '' AND file_id = ?)", blobId, blobId).Count(&count).Error
+		if err != nil || count > 0 {
+			return nil, err
+		}
+
+		return &Blob{BlobId: blobId}, nil
+	}
+
+	if blob.DeletingAt != nil {
+		return nil, nil
+	}
+
+	if blob.RefCount > 1 {
+		return nil, tx.Model(&Blob{}).Where("id = ?", blob.ID).Update("ref_count", gorm.Expr("ref_count - 1")).Error
+	}
+
+	now := time.Now()
+	blob.RefCount = 0
+	blob.DeletingAt = &now
+	err = tx.Model(&Blob{}).Where("id = ?", blob.ID).Updates(map[string]interface{}{
+		"ref_count":   0,
+		"deleting_at": now,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// 顺便清理过期的删除标记
+	return blob, tx.Where("deleting_at < ?", now.Add(-blobTombstoneExpire)).Delete(&Blob{}).Error
+}
+
+// DeleteLog 删除日志记录并释放 blob 的引用，引用归零时返回被删除的 blob
+func (d *Data) DeleteLog(log *LogData) (*Blob, error) {
+	var released *Blob
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(&LogData{}, log.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		// 已经被删除的记录不能重复释放引用
+		if result.RowsAffected == 0 {
+			return nil
+		}
+
+		var err error
+		released, err = releaseBlob(tx, log.GetBlobId())
+		return err
+	})
+
+	return released, err
+}
+
+func (d *Data) FindLogsByFileId(fileId string) ([]*LogData, error) {
+	var logs []*LogData
+	result := d.db.Where("file_id = ?", fileId).Preload("Tags").Find(&logs)
+	return logs, result.Error
+}
+
+// migrateBlobs 为历史日志创建 blob 记录，历史日志的文件 ID 就是 blob ID，同一个文件 ID 可能有多条记录
+func migrateBlobs(db *gorm.DB) error {
+	type legacyBlob struct {
+		FileId string
+		Size   int64
+		Count  int64
+	}
+
+	var legacy []*legacyBlob
+	result := db.Model(&LogData{}).
+		Select("file_id, max(size) as size, count(*) as count").
+		Where("blob_id = '' OR blob_id IS NULL").
+		Group("file_id").Scan(&legacy)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	for _, l := range legacy {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Model(&Blob{}).Where("blob_id = ?", l.FileId).
+				Update("ref_count", gorm.Expr("ref_count + ?", l.Count))
+			if result.Error != nil {
+				return result.Error
+			}
+
+			if result.RowsAffected == 0 {
+				err := tx.Create(&Blob{BlobId: l.FileId, Size: l.Size, RefCount: l.Count}).Error
+				if err != nil {
+					return err
+				}
+			}
+
+			return tx.Model(&LogData{}).
+				Where("file_id = ? AND (blob_id = '' OR blob_id IS NULL)", l.FileId).
+				Update("blob_id", l.FileId).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(legacy) > 0 {
+		logger.Infof("migrate %d legacy log files to blobs", len(legacy))
+	}
+
+	return nil
+}
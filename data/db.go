@@ -1,7 +1,6 @@
 package data
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"gorm.io/driver/mysql"
@@ -14,6 +13,7 @@ import (
 	"github.com/glebarez/sqlite"
 	"github.com/warjiang/page-spy-api/config"
 	selfLogger "github.com/warjiang/page-spy-api/logger"
+	"github.com/warjiang/page-spy-api/rpc"
 	"github.com/warjiang/page-spy-api/storage"
 	"github.com/warjiang/page-spy-api/task"
 	"github.com/warjiang/page-spy-api/util"
@@ -83,28 +83,34 @@ func InitData(config *gorm.Config, dbConfig *config.DBConfig) (*Data, error) {
 			return nil, fmt.Errorf("unsupported driver %s", dbConfig.DriverName)
 		}
 	}
-	if dbConfig != nil && dbConfig.DisableMigrate == false {
+	if dbConfig.IsMigrate() {
 		logger.Infof("execute auto migration")
-		if err := db.AutoMigrate(&LogData{}, &LogGroup{}, &Tag{}); err != nil {
+		if err := db.AutoMigrate(&LogData{}, &LogGroup{}, &Tag{}, &LeaderLease{}, &Blob{}); err != nil {
 			return nil, fmt.Errorf("failed to auto migrate database")
 		}
+
+		if err := migrateBlobs(db); err != nil {
+			return nil, fmt.Errorf("failed to migrate blobs: %w", err)
+		}
 	}
 
 	return &Data{db: db}, nil
 }
 
-func NewData(config *config.Config, taskManager *task.TaskManager, st storage.StorageApi) (DataApi, error) {
-	_, isLocalStorage := st.(*storage.FileApi)
-	if !isLocalStorage {
+func NewData(config *config.Config, taskManager *task.TaskManager, st storage.StorageApi, addressManager *rpc.AddressManager) (DataApi, error) {
+	// 共享元数据模式下数据在 mysql 中，无需同步本地 sqlite 文件
+	if config.IsRemoteStorage() && !config.IsSharedMetadata() {
 		logger.Infof("init database with remote storage")
-		err := loadData(config, st)
+		machineId := addressManager.GetSelfMachineID()
+		err := loadData(config, st, machineId)
 		if err != nil {
 			logger.Infof("load remote data error %s", err.Error())
 			return nil, err
 		}
 		logger.Infof("load remote data success")
 
-		err = taskManager.AddTask(task.NewTask("sync_data_file", 5*time.Minute, syncData(config, st)))
+		// 每个节点的 sqlite 文件只记录自己的日志，分别上传到各自机器 ID 的目录
+		err = taskManager.AddTask(task.NewScopeTask("sync_data_file", 5*time.Minute, task.ScopeEveryNode, syncData(config, st, machineId)))
 		if err != nil {
 			logger.Errorf("add sync data file task error %s", err.Error())
 			return nil, err
@@ -116,10 +122,7 @@ func NewData(config *config.Config, taskManager *task.TaskManager, st storage.St
 		logLevel = gormLogger.Info
 	}
 
-	isMigrate := false
-	if config.DBConfig != nil && config.DBConfig.DisableMigrate == false {
-		isMigrate = true
-	}
+	isMigrate := config.DBConfig.IsMigrate()
 
 	c := &gorm.Config{
 		DisableForeignKeyConstraintWhenMigrating: isMigrate,
@@ -137,18 +140,33 @@ func NewData(config *config.Config, taskManager *task.TaskManager, st storage.St
 	return InitData(c, config.DBConfig)
 }
 
-func loadData(config *config.Config, remoteStorage storage.StorageApi) error {
+// remoteDataFilePath 远程存储中节点 sqlite 文件的路径
+func remoteDataFilePath(config *config.Config, machineId string) string {
+	return path.Join(config.GetLogDir(), "data", machineId, "data.db")
+}
+
+func loadData(config *config.Config, remoteStorage storage.StorageApi, machineId string) error {
 	filePath := getLocalDataFilePath()
 	if util.FileExists(filePath) {
 		logger.Infof("load data already exists")
 		return nil
 	}
 
-	remotePath := path.Join(config.GetLogDir(), filePath)
+	remotePath := remoteDataFilePath(config, machineId)
 	exist, err := remoteStorage.Exist(remotePath)
 	if err != nil {
 		return fmt.Errorf("failed to head remote data file %s", err.Error())
 	}
+
+	// 旧版本上传到不区分节点的路径，单机部署时仍从旧路径恢复，集群中无法确定属于哪个节点
+	if !exist && machineId == rpc.LOCAL_NAME {
+		remotePath = path.Join(config.GetLogDir(), filePath)
+		exist, err = remoteStorage.Exist(remotePath)
+		if err != nil {
+			return fmt.Errorf("failed to head remote data file %s", err.Error())
+		}
+	}
+
 	if !exist {
 		logger.Infof("load data remote data not exists")
 		return nil
@@ -183,21 +201,26 @@ func loadData(config *config.Config, remoteStorage storage.StorageApi) error {
 	return nil
 }
 
-func syncData(config *config.Config, s storage.StorageApi) func() error {
+// SaveDataFile 把本地 sqlite 数据文件上传到存储，用于迁移存储时复制元数据
+func SaveDataFile(config *config.Config, s storage.StorageApi, machineId string) error {
+	return syncData(config, s, machineId)()
+}
+
+func syncData(config *config.Config, s storage.StorageApi, machineId string) func() error {
 	return func() error {
 		filePath := getLocalDataFilePath()
 		if !util.FileExists(filePath) {
 			return nil
 		}
 
-		content, err := os.ReadFile(filePath)
+		file, err := os.Open(filePath)
 		if err != nil {
 			logger.Errorf("Failed to read file: %v", err)
 			return err
 		}
+		defer file.Close()
 
-		remotePath := path.Join(config.GetLogDir(), filePath)
-		err = s.Save(remotePath, bytes.NewReader(content))
+		err = s.Save(remoteDataFilePath(config, machineId), file)
 		if err != nil {
 			return err
 		}
@@ -365,6 +388,9 @@ func (query *FileListQuery) getLogDB(db *gorm.DB) *gorm.DB {
 		q = q.Where("log_data.created_at < ?", to)
 	}
 
+	// 直接上传到存储还没有完成的记录不出现在列表中
+	q = q.Where("log_data.status = ?", Saved)
+
 	return q.Preload("Tags").Order("log_data.created_at desc")
 }
 
@@ -421,11 +447,6 @@ func (d *Data) UpdateLogStatus(fileId string, status Status) error {
 	return result.Error
 }
 
-func (d *Data) DeleteLogByFileId(fileId string) error {
-	result := d.db.Where("file_id = ?", fileId).Delete(&LogData{})
-	return result.Error
-}
-
 func (d *Data) FindLogByFileId(FileId string) (*LogData, error) {
 	log := &LogData{}
 	result := d.db.Where("file_id = ?", FileId).Where("status = ?", Saved).First(log)
@@ -448,7 +469,8 @@ func (d *Data) FindOldestLogs(size int) ([]*LogData, error) {
 	return logs, result.Error
 }
 
-func (d *Data) FindShouldDeleteLogs(size int) ([]*LogData, error) {
+// FindShouldDeleteLogs 查询创建时间早于 before 且没有保存成功的记录
+func (d *Data) FindShouldDeleteLogs(before time.Time, size int) ([]*LogData, error) {
 	var logs []*LogData
 	status := []Status{
 		Error,
@@ -457,7 +479,7 @@ func (d *Data) FindShouldDeleteLogs(size int) ([]*LogData, error) {
 	}
 
 	result := d.db.Limit(size).
-		Where("created_at < ?", time.Now().Add(-time.Hour*1)).
+		Where("created_at < ?", before).
 		Where("status in ?", status).Find(&logs)
 	return logs, result.Error
 }
@@ -477,3 +499,11 @@ func (d *Data) CountLogsSize() (int64, error) {
 
 	return sum.Total, nil
 }
+
+func (d *Data) CountLogs() (int64, error) {
+	var total int64
+	result := d.db.Model(&LogData{}).
+		Where("status = ?", Saved).
+		Count(&total)
+	return total, result.Error
+}
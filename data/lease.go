@@ -0,0 +1,54 @@
+package data
+
+import (
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// LeaderLease 共享数据库上的选主租约，每个 Name 对应一把租约
+type LeaderLease struct {
+	Name      string    `gorm:"primarykey;size:64" json:"name"`
+	Holder    string    `gorm:"size:128" json:"holder"`
+	ExpiredAt time.Time `json:"expiredAt"`
+}
+
+// AcquireLease 租约空闲、已过期或已由 holder 持有时续约给 holder，返回当前的持有者
+func (d *Data) AcquireLease(name string, holder string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	lease := &LeaderLease{
+		Name:      name,
+		Holder:    holder,
+		ExpiredAt: now.Add(ttl),
+	}
+
+	result := d.db.Model(&LeaderLease{}).
+		Where("name = ? AND (holder = ? OR expired_at < ?)", name, holder, now).
+		Updates(map[string]interface{}{
+			"holder":     holder,
+			"expired_at": lease.ExpiredAt,
+		})
+	if result.Error != nil {
+		return "", result.Error
+	}
+
+	if result.RowsAffected <= 0 {
+		// 租约记录不存在时创建，多个节点并发创建只有一个会成功
+		err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(lease).Error
+		if err != nil {
+			return "", err
+		}
+	}
+
+	current := &LeaderLease{}
+	err := d.db.Where("name = ?", name).First(current).Error
+	if err != nil {
+		return "", err
+	}
+
+	if current.ExpiredAt.Before(now) {
+		return "", nil
+	}
+
+	return current.Holder, nil
+}
@@ -0,0 +1,110 @@
+package data
+
+import (
+	"context"
+	"fmt"
+)
+
+// 单个节点每次拉取的最大条数
+const maxMergeBatchSize = 500
+
+// PageFetcher 按 query 拉取单个节点的一页数据，数据需按 GetOrderValue 倒序
+type PageFetcher[T OrderData] func(ctx context.Context, query *FileListQuery) (*Page[T], error)
+
+// nodeCursor 记录单个节点已拉取到的位置
+type nodeCursor[T OrderData] struct {
+	fetch    PageFetcher[T]
+	nextPage int
+	buffer   []T
+	total    int64
+	drained  bool
+}
+
+func (c *nodeCursor[T]) fill(ctx context.Context, query *FileListQuery, batch int) error {
+	if len(c.buffer) > 0 || c.drained {
+		return nil
+	}
+
+	q := *query
+	q.Page = c.nextPage
+	q.Size = batch
+	page, err := c.fetch(ctx, &q)
+	if err != nil {
+		return err
+	}
+
+	c.nextPage = c.nextPage + 1
+	c.total = page.Total
+	c.buffer = page.Data
+	if len(page.Data) < batch {
+		c.drained = true
+	}
+
+	return nil
+}
+
+// MergePages 多路归并各节点的有序结果，返回全局第 query.Page 页，Total 为各节点总数之和
+func MergePages[T OrderData](ctx context.Context, query *FileListQuery, fetchers []PageFetcher[T]) (*Page[T], error) {
+	if query.Size <= 0 {
+		return nil, fmt.Errorf("size should be greater than 0")
+	}
+
+	if query.Page <= 0 {
+		return nil, fmt.Errorf("page should be greater than 0")
+	}
+
+	offset := query.GetOffset()
+	batch := offset + query.Size
+	if batch > maxMergeBatchSize {
+		batch = maxMergeBatchSize
+	}
+
+	if batch < query.Size {
+		batch = query.Size
+	}
+
+	cursors := make([]*nodeCursor[T], 0, len(fetchers))
+	for _, f := range fetchers {
+		cursors = append(cursors, &nodeCursor[T]{fetch: f, nextPage: 1})
+	}
+
+	res := &Page[T]{Data: make([]T, 0, query.Size)}
+	skipped := 0
+	for len(res.Data) < query.Size {
+		var head *nodeCursor[T]
+		for _, c := range cursors {
+			err := c.fill(ctx, query, batch)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(c.buffer) <= 0 {
+				continue
+			}
+
+			if head == nil || c.buffer[0].GetOrderValue() > head.buffer[0].GetOrderValue() {
+				head = c
+			}
+		}
+
+		if head == nil {
+			break
+		}
+
+		item := head.buffer[0]
+		head.buffer = head.buffer[1:]
+		if skipped < offset {
+			skipped = skipped + 1
+			continue
+		}
+
+		res.Data = append(res.Data, item)
+	}
+
+	// 第一轮归并时每个节点都已拉取过一次，total 均已就绪
+	for _, c := range cursors {
+		res.Total = res.Total + c.total
+	}
+
+	return res, nil
+}
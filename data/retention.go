@@ -0,0 +1,110 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/warjiang/page-spy-api/config"
+	"gorm.io/gorm"
+)
+
+// RetentionStat 保留策略匹配的日志数量和大小
+type RetentionStat struct {
+	Count int64
+	Size  int64
+}
+
+// tagCondition 日志或者日志组包含指定的标签，值为空时只检查标签名
+func tagCondition(joinTable string, joinColumn string, owner string, key string, value string) (string, []interface{}) {
+	cond := fmt.Sprintf("EXISTS (SELECT 1 FROM %s JOIN tags ON tags.id = %s.tag_id WHERE %s.%s = %s AND tags.key = ?", joinTable, joinTable, joinTable, joinColumn, owner)
+	args := []interface{}{key}
+	if value != "" {
+		cond += " AND tags.value = ?"
+		args = append(args, value)
+	}
+
+	return cond + ")", args
+}
+
+func sortedKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// retentionRuleCondition 规则的匹配条件，没有任何条件的规则匹配所有日志
+func retentionRuleCondition(rule *config.RetentionRule) (string, []interface{}) {
+	conds := []string{"1 = 1"}
+	args := []interface{}{}
+	if rule.InGroup != nil && *rule.InGroup {
+		conds = append(conds, "COALESCE(log_data.log_group_id, 0) <> 0")
+	} else if rule.InGroup != nil {
+		conds = append(conds, "COALESCE(log_data.log_group_id, 0) = 0")
+	}
+
+	for _, key := range sortedKeys(rule.GroupTags) {
+		cond, tagArgs := tagCondition("log_group_tags", "log_group_id", "log_data.log_group_id", key, rule.GroupTags[key])
+		conds = append(conds, cond)
+		args = append(args, tagArgs...)
+	}
+
+	for _, key := range sortedKeys(rule.Tags) {
+		cond, tagArgs := tagCondition("log_tags", "log_data_id", "log_data.id", key, rule.Tags[key])
+		conds = append(conds, cond)
+		args = append(args, tagArgs...)
+	}
+
+	return "(" + strings.Join(conds, " AND ") + ")", args
+}
+
+// retentionCondition 匹配第 index 条规则且不匹配之前任何规则的日志，index 为规则数量时是没有匹配任何规则的日志
+func retentionCondition(rules []*config.RetentionRule, index int) (string, []interface{}) {
+	conds := []string{"1 = 1"}
+	args := []interface{}{}
+	for i, rule := range rules {
+		if i > index {
+			break
+		}
+
+		cond, ruleArgs := retentionRuleCondition(rule)
+		if i < index {
+			cond = "NOT " + cond
+		}
+
+		conds = append(conds, cond)
+		args = append(args, ruleArgs...)
+	}
+
+	return strings.Join(conds, " AND "), args
+}
+
+func (d *Data) retentionQuery(rules []*config.RetentionRule, index int) *gorm.DB {
+	cond, args := retentionCondition(rules, index)
+	return d.db.Model(&LogData{}).Where("log_data.status = ?", Saved).Where(cond, args...)
+}
+
+// CountRetentionLogs 返回按顺序匹配时属于第 index 条规则的已保存日志的数量和大小
+func (d *Data) CountRetentionLogs(rules []*config.RetentionRule, index int) (*RetentionStat, error) {
+	stat := &RetentionStat{}
+	result := d.retentionQuery(rules, index).
+		Select("count(*) as count, coalesce(sum(log_data.size), 0) as size").
+		Scan(stat)
+	return stat, result.Error
+}
+
+// FindRetentionLogsAfter 按创建时间从早到晚返回属于第 index 条规则的已保存日志，after 为上一批的最后一条日志
+func (d *Data) FindRetentionLogsAfter(rules []*config.RetentionRule, index int, after *LogData, size int) ([]*LogData, error) {
+	var logs []*LogData
+	q := d.retentionQuery(rules, index)
+	if after != nil {
+		q = q.Where("(log_data.created_at > ? OR (log_data.created_at = ? AND log_data.id > ?))", after.CreatedAt, after.CreatedAt, after.ID)
+	}
+
+	result := q.Order("log_data.created_at asc, log_data.id asc").Limit(size).Find(&logs)
+	return logs, result.Error
+}
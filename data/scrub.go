@@ -0,0 +1,59 @@
+package data
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// FindLogsAfter 按 ID 顺序分批遍历所有日志记录，包括还没有上传完成的记录
+func (d *Data) FindLogsAfter(id uint, size int) ([]*LogData, error) {
+	var logs []*LogData
+	result := d.db.Where("id > ?", id).Order("id asc").Limit(size).Find(&logs)
+	return logs, result.Error
+}
+
+func (d *Data) FindLogGroupsAfter(id uint, size int) ([]*LogGroup, error) {
+	var logGroups []*LogGroup
+	result := d.db.Where("id > ?", id).Order("id asc").Limit(size).Preload("Logs").Find(&logGroups)
+	return logGroups, result.Error
+}
+
+// UpdateLogSize 同时更新 blob 记录的大小，同一个 blob 的内容相同
+func (d *Data) UpdateLogSize(log *LogData, size int64) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&LogData{}).Where("id = ?", log.ID).Update("size", size).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&Blob{}).Where("blob_id = ?", log.GetBlobId()).Update("size", size).Error
+	})
+}
+
+func (d *Data) UpdateLogGroupSize(logGroup *LogGroup, size int64) error {
+	return d.db.Model(&LogGroup{}).Where("id = ?", logGroup.ID).Update("size", size).Error
+}
+
+// RemoveOrphanBlob 没有日志引用 blob 时删除 blob 记录，返回 blob 是否确实没有被引用
+// before 之后更新过的 blob 记录可能正在上传，还没有创建日志记录，不会被删除
+func (d *Data) RemoveOrphanBlob(blobId string, before time.Time) (bool, error) {
+	orphan := false
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&LogData{}).Where("blob_id = ? OR (blob_id = '' AND file_id = ?)", blobId, blobId).Count(&count).Error
+		if err != nil || count > 0 {
+			return err
+		}
+
+		err = tx.Model(&Blob{}).Where("blob_id = ? AND updated_at >= ?", blobId, before).Count(&count).Error
+		if err != nil || count > 0 {
+			return err
+		}
+
+		orphan = true
+		return tx.Where("blob_id = ?", blobId).Delete(&Blob{}).Error
+	})
+
+	return orphan, err
+}
@@ -0,0 +1,340 @@
+package election
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/warjiang/page-spy-api/config"
+	"github.com/warjiang/page-spy-api/data"
+	"github.com/warjiang/page-spy-api/metric"
+	"github.com/warjiang/page-spy-api/rpc"
+	"github.com/warjiang/page-spy-api/task"
+)
+
+// 维护任务共用的一把租约
+const leaseName = "maintenance"
+
+const (
+	ModeSingle   = "single"
+	ModeRpc      = "rpc"
+	ModeDatabase = "database"
+)
+
+type grant struct {
+	holder    string
+	expiredAt time.Time
+}
+
+// Elector 基于租约的选主，集群模式下需要获得多数节点的授权，共享数据库模式下通过数据库租约记录竞争
+// 多数节点指超过一半，偶数个节点的集群同样只能容忍少于一半的节点故障，两个节点的集群任一节点故障时没有主节点
+type Elector struct {
+	mode      string
+	id        string
+	machineId string
+	ttl       time.Duration
+	transport leaseTransport
+	data      data.DataApi
+	startOnce sync.Once
+
+	lock        sync.RWMutex
+	leader      string
+	leaderUntil time.Time
+	// grant 当前节点授予出去的租约，仅 RPC 模式使用
+	grant grant
+}
+
+type LeaseRequest struct {
+	Candidate string
+	TtlOfMs   int64
+}
+
+type LeaseResponse struct {
+	Granted bool
+	Holder  string
+}
+
+type RpcElector struct {
+	elector *Elector
+}
+
+// leaseTransport 向集群中的节点请求和释放租约
+type leaseTransport interface {
+	Machines() []string
+	Call(ctx context.Context, machineID string, method string, req *LeaseRequest, res *LeaseResponse) error
+}
+
+type rpcTransport struct {
+	addressManager *rpc.AddressManager
+	rpcManager     *rpc.RpcManager
+}
+
+func (t *rpcTransport) Machines() []string {
+	machines := []string{}
+	for machineID := range t.addressManager.GetMachineIpInfo() {
+		machines = append(machines, machineID)
+	}
+
+	return machines
+}
+
+func (t *rpcTransport) Call(ctx context.Context, machineID string, method string, req *LeaseRequest, res *LeaseResponse) error {
+	client := t.rpcManager.GetRpcByMachineID(machineID)
+	if client == nil {
+		return fmt.Errorf("rpc client of machine %s not found", machineID)
+	}
+
+	return client.Call(ctx, method, req, res)
+}
+
+func NewElector(config *config.Config, addressManager *rpc.AddressManager, rpcManager *rpc.RpcManager, data data.DataApi, taskManager *task.TaskManager) (*Elector, error) {
+	e := &Elector{
+		mode:      ModeRpc,
+		id:        addressManager.GetSelfMachineID(),
+		machineId: addressManager.GetSelfMachineID(),
+		ttl:       config.GetLeaderLease(),
+		transport: &rpcTransport{addressManager: addressManager, rpcManager: rpcManager},
+		data:      data,
+	}
+
+	if config.IsSharedMetadata() {
+		// 共享数据库模式下节点可能都是 local，加上随机后缀区分
+		e.mode = ModeDatabase
+		e.id = e.id + "-" + uuid.New().String()[:8]
+	} else if addressManager.IsSingleNode() {
+		e.mode = ModeSingle
+	}
+
+	err := rpcManager.Regist("Election", &RpcElector{elector: e})
+	if err != nil {
+		return nil, err
+	}
+
+	if e.mode == ModeSingle {
+		e.setLeader(e.id, time.Time{})
+	}
+
+	taskManager.SetLeaderChecker(e)
+	return e, nil
+}
+
+// StartElection 注册了只在主节点执行的任务时才开始竞选，重复调用只启动一次
+func (e *Elector) StartElection() {
+	if e.mode == ModeSingle {
+		return
+	}
+
+	e.startOnce.Do(func() {
+		log.Infof("leader election start with %s mode, lease %s", e.mode, e.ttl)
+		if n := len(e.transport.Machines()); e.mode == ModeRpc && n%2 == 0 {
+			log.Warnf("leader election of %d nodes needs %d nodes online, an odd number of nodes or sharedMetadata tolerates more failures", n, n/2+1)
+		}
+
+		go e.run()
+	})
+}
+
+func (e *Elector) IsLeader() bool {
+	if e.mode == ModeSingle {
+		return true
+	}
+
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.leader == e.id && time.Now().Before(e.leaderUntil)
+}
+
+// Leader 最近一次观察到的主节点，未知时为空
+func (e *Elector) Leader() string {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.leader
+}
+
+func (e *Elector) GetMode() string {
+	return e.mode
+}
+
+func (e *Elector) setLeader(leader string, until time.Time) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.leader != leader {
+		log.Infof("leader changed from %q to %q", e.leader, leader)
+		metric.Count("page_spy_leader_change", map[string]string{
+			"leader": leader,
+		}, 1)
+	}
+
+	e.leader = leader
+	e.leaderUntil = until
+}
+
+// leaderDeadline 自身认为的租约到期时间比授予方提前，抵消网络延迟和时钟漂移
+func (e *Elector) leaderDeadline(start time.Time) time.Time {
+	return start.Add(e.ttl - e.ttl/5)
+}
+
+func (e *Elector) run() {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		e.campaign()
+		<-ticker.C
+	}
+}
+
+func (e *Elector) campaign() {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("leader election panic %s", err)
+		}
+	}()
+
+	if e.mode == ModeDatabase {
+		e.campaignByDatabase()
+		return
+	}
+
+	e.campaignByRpc()
+}
+
+func (e *Elector) campaignByDatabase() {
+	start := time.Now()
+	holder, err := e.data.AcquireLease(leaseName, e.id, e.ttl)
+	if err != nil {
+		log.Errorf("acquire leader lease error %s", err.Error())
+		e.setLeader("", time.Time{})
+		return
+	}
+
+	e.setLeader(holder, e.leaderDeadline(start))
+}
+
+// grantLease 租约空闲、已过期或已由 candidate 持有时授予 candidate
+func (e *Elector) grantLease(candidate string, ttl time.Duration) (bool, string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	now := time.Now()
+	if e.grant.holder != "" && e.grant.holder != candidate && now.Before(e.grant.expiredAt) {
+		return false, e.grant.holder
+	}
+
+	e.grant = grant{holder: candidate, expiredAt: now.Add(ttl)}
+	return true, candidate
+}
+
+func (e *Elector) releaseLease(candidate string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.grant.holder == candidate {
+		e.grant = grant{}
+	}
+}
+
+// grantedHolder 当前节点已授予且未过期的租约持有者
+func (e *Elector) grantedHolder() string {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if time.Now().Before(e.grant.expiredAt) {
+		return e.grant.holder
+	}
+
+	return ""
+}
+
+func (e *Elector) requestLease(ctx context.Context, machineID string) (bool, string) {
+	if machineID == e.machineId {
+		return e.grantLease(e.id, e.ttl)
+	}
+
+	res := &LeaseResponse{}
+	err := e.transport.Call(ctx, machineID, "Election.RequestLease", &LeaseRequest{
+		Candidate: e.id,
+		TtlOfMs:   e.ttl.Milliseconds(),
+	}, res)
+	if err != nil {
+		log.Debugf("request leader lease from %s error %s", machineID, err.Error())
+		return false, ""
+	}
+
+	return res.Granted, res.Holder
+}
+
+func (e *Elector) sendRelease(ctx context.Context, machineIDs []string) {
+	for _, machineID := range machineIDs {
+		if machineID == e.machineId {
+			e.releaseLease(e.id)
+			continue
+		}
+
+		err := e.transport.Call(ctx, machineID, "Election.ReleaseLease", &LeaseRequest{Candidate: e.id}, &LeaseResponse{})
+		if err != nil {
+			log.Debugf("release leader lease of %s error %s", machineID, err.Error())
+		}
+	}
+}
+
+func (e *Elector) campaignByRpc() {
+	// 已经授权给其它节点时不参与竞选，主节点会在租约到期前续约
+	holder := e.grantedHolder()
+	if holder != "" && holder != e.id {
+		e.setLeader(holder, time.Time{})
+		return
+	}
+
+	if !e.IsLeader() {
+		// 随机等待一段时间再竞选，避免多个节点同时竞选导致谁都拿不到多数
+		time.Sleep(time.Duration(rand.Int63n(int64(e.ttl / 6))))
+		holder = e.grantedHolder()
+		if holder != "" && holder != e.id {
+			e.setLeader(holder, time.Time{})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.ttl/3)
+	defer cancel()
+
+	start := time.Now()
+	machines := e.transport.Machines()
+	granted := make([]string, 0, len(machines))
+	holders := make(map[string]int)
+	for _, machineID := range machines {
+		ok, holder := e.requestLease(ctx, machineID)
+		if ok {
+			granted = append(granted, machineID)
+		} else if holder != "" {
+			holders[holder] = holders[holder] + 1
+		}
+	}
+
+	if len(granted) > len(machines)/2 {
+		e.setLeader(e.id, e.leaderDeadline(start))
+		return
+	}
+
+	// 没有拿到多数授权时释放已拿到的授权，让其它节点尽快竞选成功
+	e.sendRelease(ctx, granted)
+	leader := ""
+	for h, count := range holders {
+		if leader == "" || count > holders[leader] {
+			leader = h
+		}
+	}
+
+	e.setLeader(leader, time.Time{})
+}
+
+func (r *RpcElector) RequestLease(_ *http.Request, req *LeaseRequest, res *LeaseResponse) error {
+	res.Granted, res.Holder = r.elector.grantLease(req.Candidate, time.Duration(req.TtlOfMs)*time.Millisecond)
+	return nil
+}
+
+func (r *RpcElector) ReleaseLease(_ *http.Request, req *LeaseRequest, res *LeaseResponse) error {
+	r.elector.releaseLease(req.Candidate)
+	return nil
+}
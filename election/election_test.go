@@ -0,0 +1,173 @@
+package election
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/warjiang/page-spy-api/task"
+)
+
+const testLease = 300 * time.Millisecond
+
+// memoryCluster 在内存中转发租约请求，down 的节点不响应请求
+type memoryCluster struct {
+	lock     sync.Mutex
+	electors map[string]*Elector
+	down     map[string]bool
+}
+
+func newTestCluster(n int) *memoryCluster {
+	c := &memoryCluster{electors: map[string]*Elector{}, down: map[string]bool{}}
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("A%d", i)
+		c.electors[id] = &Elector{
+			mode:      ModeRpc,
+			id:        id,
+			machineId: id,
+			ttl:       testLease,
+			transport: c,
+		}
+	}
+
+	return c
+}
+
+func (c *memoryCluster) Machines() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	machines := []string{}
+	for id := range c.electors {
+		machines = append(machines, id)
+	}
+
+	sort.Strings(machines)
+	return machines
+}
+
+func (c *memoryCluster) Call(_ context.Context, machineID string, method string, req *LeaseRequest, res *LeaseResponse) error {
+	c.lock.Lock()
+	e, ok := c.electors[machineID]
+	down := c.down[machineID]
+	c.lock.Unlock()
+
+	if !ok || down {
+		return fmt.Errorf("machine %s is unreachable", machineID)
+	}
+
+	r := &RpcElector{elector: e}
+	switch method {
+	case "Election.RequestLease":
+		return r.RequestLease(nil, req, res)
+	case "Election.ReleaseLease":
+		return r.ReleaseLease(nil, req, res)
+	}
+
+	return fmt.Errorf("unknown method %s", method)
+}
+
+func (c *memoryCluster) setDown(machineID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.down[machineID] = true
+}
+
+func (c *memoryCluster) campaign(machineIDs ...string) {
+	for _, machineID := range machineIDs {
+		c.electors[machineID].campaign()
+	}
+}
+
+func (c *memoryCluster) leaders() []string {
+	leaders := []string{}
+	for _, machineID := range c.Machines() {
+		if c.electors[machineID].IsLeader() {
+			leaders = append(leaders, machineID)
+		}
+	}
+
+	return leaders
+}
+
+func TestElectionFailover(t *testing.T) {
+	c := newTestCluster(3)
+	c.campaign("A0", "A1", "A2")
+	if leaders := c.leaders(); len(leaders) != 1 || leaders[0] != "A0" {
+		t.Fatalf("expect A0 to be the only leader, got %v", leaders)
+	}
+
+	if leader := c.electors["A2"].Leader(); leader != "A0" {
+		t.Fatalf("expect A2 to observe leader A0, got %q", leader)
+	}
+
+	// 主节点故障后，其它节点授予的租约到期前不会选出新的主节点
+	c.setDown("A0")
+	c.campaign("A1", "A2")
+	if leaders := c.leaders(); len(leaders) != 1 || leaders[0] != "A0" {
+		t.Fatalf("expect no new leader before lease expires, got %v", leaders)
+	}
+
+	time.Sleep(testLease)
+	if c.electors["A0"].IsLeader() {
+		t.Fatal("expect lost leader to give up after its lease expires")
+	}
+
+	c.campaign("A1", "A2")
+	if leaders := c.leaders(); len(leaders) != 1 || leaders[0] != "A1" {
+		t.Fatalf("expect A1 to take over, got %v", leaders)
+	}
+
+	if leader := c.electors["A2"].Leader(); leader != "A1" {
+		t.Fatalf("expect A2 to observe leader A1, got %q", leader)
+	}
+
+	// 主节点续约后保持不变
+	c.campaign("A1", "A2")
+	if leaders := c.leaders(); len(leaders) != 1 || leaders[0] != "A1" {
+		t.Fatalf("expect A1 to renew its lease, got %v", leaders)
+	}
+}
+
+func TestElectionTwoNodesWithoutMajority(t *testing.T) {
+	c := newTestCluster(2)
+	c.setDown("A0")
+	c.campaign("A1")
+	if leaders := c.leaders(); len(leaders) != 0 {
+		t.Fatalf("expect no leader with one of two nodes down, got %v", leaders)
+	}
+}
+
+func TestElectionStartsWithLeaderTask(t *testing.T) {
+	c := newTestCluster(3)
+	e := c.electors["A0"]
+	taskManager := task.NewTaskManager()
+	defer taskManager.Close()
+	taskManager.SetLeaderChecker(e)
+
+	err := taskManager.AddTask(task.NewTask("every_node", time.Hour, func() error { return nil }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(testLease / 2)
+	if e.Leader() != "" {
+		t.Fatal("expect no election without leader only tasks")
+	}
+
+	err = taskManager.AddTask(task.NewLeaderTask("leader_only", time.Hour, func() error { return nil }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !e.IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatal("expect election to start after leader only task is added")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
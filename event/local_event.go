@@ -7,6 +7,7 @@ import (
 
 	"github.com/warjiang/page-spy-api/api/event"
 	"github.com/warjiang/page-spy-api/rpc"
+	"github.com/warjiang/page-spy-api/trace"
 )
 
 func NewLocalEventEmitter(addressManager *rpc.AddressManager, rpcManager *rpc.RpcManager) event.EventEmitter {
@@ -105,6 +106,10 @@ func (e *LocalEventEmitter) EmitLocal(ctx context.Context, address *event.Addres
 }
 
 func (e *LocalEventEmitter) Emit(ctx context.Context, address *event.Address, msg *event.Package) error {
+	if msg.RequestId == "" {
+		msg.RequestId = trace.RequestId(ctx)
+	}
+
 	if e.addressManager.IsSelfMachineAddress(address) {
 		return e.EmitLocal(ctx, address, msg)
 	}
@@ -8,6 +8,7 @@ import (
 	"github.com/warjiang/page-spy-api/api/event"
 	"github.com/warjiang/page-spy-api/api/room"
 	"github.com/warjiang/page-spy-api/rpc"
+	"github.com/warjiang/page-spy-api/trace"
 )
 
 type RpcEventEmitter struct {
@@ -43,9 +44,9 @@ func NewRpcEventEmitter(localEventEmitter event.EventEmitter, rpcManager *rpc.Rp
 }
 
 func (e *RpcEventEmitter) Emit(r *http.Request, req *RpcEventEmitterRequest, res *RpcEventEmitterResponse) error {
-	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(req.ContextTimeout)*time.Second)
+	ctx, cancel := context.WithTimeout(trace.WithRequestId(r.Context(), req.Package.RequestId), time.Duration(req.ContextTimeout)*time.Second)
 	defer cancel()
 	err := e.localEventEmitter.EmitLocal(ctx, req.Address, req.Package)
-	log.Debugf("rpc serve RpcEventEmitter.Emit from machine: %s room: %s err: %v", req.Address.MachineID, req.Address.ID, err)
+	trace.Entry(ctx, log).Debugf("rpc serve RpcEventEmitter.Emit from machine: %s room: %s err: %v", req.Address.MachineID, req.Address.ID, err)
 	return res.SetError(err)
 }
@@ -70,6 +70,21 @@ func (r *LocalRoomManager) isFull() bool {
 	return len(rooms) >= int(r.maxRoomSize)
 }
 
+func (r *LocalRoomManager) GetLoad() *NodeLoad {
+	rooms := r.GetRooms()
+	connectionCount := 0
+	for _, rr := range rooms {
+		connectionCount = connectionCount + len(rr.GetRoomUsers())
+	}
+
+	return &NodeLoad{
+		MachineID:       r.AddressManager.GetSelfMachineID(),
+		RoomCount:       len(rooms),
+		ConnectionCount: connectionCount,
+		MaxRoomSize:     r.maxRoomSize,
+	}
+}
+
 func (r *LocalRoomManager) UpdateRoomOption(ctx context.Context, info *room.Info) (room.Room, error) {
 	if info.Address == nil {
 		return nil, errors.New("update room options address is nil")
@@ -12,6 +12,7 @@ import (
 	"github.com/warjiang/page-spy-api/metric"
 	"github.com/warjiang/page-spy-api/rpc"
 	"github.com/warjiang/page-spy-api/state"
+	"github.com/warjiang/page-spy-api/trace"
 )
 
 func NewLocalRoom(opt *room.Info, event event.EventEmitter, addressManager *rpc.AddressManager) (room.Room, error) {
@@ -82,9 +83,10 @@ func (r *localRoom) Start(ctx context.Context) error {
 		for {
 			select {
 			case msg := <-r.OnMessage():
-				err := r.SendMessage(context.Background(), msg)
+				ctx := trace.WithRequestId(context.Background(), msg.RequestId)
+				err := r.SendMessage(ctx, msg)
 				if err != nil {
-					r.log.WithError(err).Errorf("local room broadcast messages failed, %s", err)
+					trace.Entry(ctx, r.log).WithError(err).Errorf("local room broadcast messages failed, %s", err)
 				}
 			case <-r.Done():
 				return
@@ -177,7 +179,7 @@ func (r *localRoom) otherMessage(ctx context.Context, msg *room.Message) error {
 	for _, c := range connections {
 		e := r.event.Emit(ctx, c.Address, eventMsg)
 		if e != nil {
-			r.log.WithError(e).Errorf("emit connection %s message failed", c.Address.ID)
+			trace.Entry(ctx, r.log).WithError(e).Errorf("emit connection %s message failed", c.Address.ID)
 			err = e
 		}
 	}
@@ -202,7 +204,7 @@ func (r *localRoom) broadcastMessage(ctx context.Context, msg *room.Message) err
 		if !(c.Address.Equal(content.From.Address) && !content.IncludeSelf) {
 			e := r.event.Emit(ctx, c.Address, eventMsg)
 			if e != nil {
-				r.log.WithError(e).Errorf("emit connection %s message failed, %s", c.Address.ID, e.Error())
+				trace.Entry(ctx, r.log).WithError(e).Errorf("emit connection %s message failed, %s", c.Address.ID, e.Error())
 				err = e
 			}
 		}
@@ -232,7 +234,7 @@ func (r *localRoom) messageMessage(ctx context.Context, msg *room.Message) error
 		if c.Address.Equal(content.To.Address) {
 			e := r.event.Emit(ctx, c.Address, eventMsg)
 			if e != nil {
-				r.log.WithError(e).Errorf("emit connection %s message failed, %s", c.Address.ID, e.Error())
+				trace.Entry(ctx, r.log).WithError(e).Errorf("emit connection %s message failed, %s", c.Address.ID, e.Error())
 				err = e
 			}
 		}
@@ -349,7 +351,7 @@ func (r *localRoom) Listen(ctx context.Context, pkg *event.Package) {
 		return
 	case <-ctx.Done():
 		status = "timeout"
-		r.log.Errorf("listen message %s timeout", pkg.Content)
+		trace.Entry(ctx, r.log).Errorf("listen message %s timeout", pkg.Content)
 		return
 	}
 }
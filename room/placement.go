@@ -0,0 +1,145 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/warjiang/page-spy-api/api/room"
+	localRpc "github.com/warjiang/page-spy-api/rpc"
+)
+
+const (
+	PlacementLocal            = "local"
+	PlacementLeastRooms       = "leastRooms"
+	PlacementLeastConnections = "leastConnections"
+	PlacementGroupHash        = "groupHash"
+)
+
+func IsValidPlacement(placement string) bool {
+	switch placement {
+	case PlacementLocal, PlacementLeastRooms, PlacementLeastConnections, PlacementGroupHash:
+		return true
+	}
+
+	return false
+}
+
+type NodeLoad struct {
+	MachineID       string `json:"machineId"`
+	RoomCount       int    `json:"roomCount"`
+	ConnectionCount int    `json:"connectionCount"`
+	MaxRoomSize     int64  `json:"maxRoomSize"`
+}
+
+func (l *NodeLoad) isFull() bool {
+	return l.RoomCount >= int(l.MaxRoomSize)
+}
+
+// getLoads 获取所有可达节点的负载，不可达节点直接跳过
+func (r *RemoteRpcRoomManager) getLoads(ctx context.Context) []*NodeLoad {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	loads := make([]*NodeLoad, 0)
+	for machineID := range r.AddressManager.GetMachineIpInfo() {
+		if machineID == r.AddressManager.GetSelfMachineID() {
+			loads = append(loads, r.localRoomManager.GetLoad())
+			continue
+		}
+
+		c := r.rpcManager.GetRpcByMachineID(machineID)
+		if c == nil {
+			continue
+		}
+
+		req := NewRpcLocalRoomManagerRequest()
+		res := NewRpcLocalRoomManagerResponse()
+		err := c.Call(ctx, "LocalRpcRoomManager.GetLoad", req, res)
+		if err != nil || res.Load == nil {
+			log.WithError(err).Warnf("get room load of %s failed, skip it in placement", machineID)
+			continue
+		}
+
+		loads = append(loads, res.Load)
+	}
+
+	sort.Slice(loads, func(i, j int) bool {
+		return loads[i].MachineID < loads[j].MachineID
+	})
+
+	return loads
+}
+
+// pickMachine 按策略在未满的节点中选出一个，同等负载优先本机
+func (r *RemoteRpcRoomManager) pickMachine(info *room.Info, loads []*NodeLoad) string {
+	selfID := r.AddressManager.GetSelfMachineID()
+	placement := r.placement
+	if placement == PlacementGroupHash && info.Group == "" {
+		// 没有分组的房间无法哈希，退化为按房间数放置
+		placement = PlacementLeastRooms
+	}
+
+	var picked *NodeLoad
+	for _, load := range loads {
+		if load.isFull() {
+			continue
+		}
+
+		if picked == nil {
+			picked = load
+			continue
+		}
+
+		better := false
+		switch placement {
+		case PlacementLeastRooms:
+			better = load.RoomCount < picked.RoomCount ||
+				(load.RoomCount == picked.RoomCount && load.MachineID == selfID)
+		case PlacementLeastConnections:
+			better = load.ConnectionCount < picked.ConnectionCount ||
+				(load.ConnectionCount == picked.ConnectionCount && load.MachineID == selfID)
+		case PlacementGroupHash:
+			better = localRpc.HashScore(info.Group, load.MachineID) > localRpc.HashScore(info.Group, picked.MachineID)
+		}
+
+		if better {
+			picked = load
+		}
+	}
+
+	if picked == nil {
+		return selfID
+	}
+
+	return picked.MachineID
+}
+
+// PlaceRoom 根据放置策略选择节点并创建房间，info.Address 会被替换为目标节点上的地址
+func (r *RemoteRpcRoomManager) PlaceRoom(ctx context.Context, info *room.Info) (room.Room, error) {
+	if r.placement == PlacementLocal && r.maxClusterRoomSize <= 0 {
+		info.Address = r.AddressManager.GeneratorRoomAddress()
+		return r.CreateLocalRoom(ctx, info)
+	}
+
+	loads := r.getLoads(ctx)
+	if r.maxClusterRoomSize > 0 {
+		total := 0
+		for _, load := range loads {
+			total = total + load.RoomCount
+		}
+
+		if total >= r.maxClusterRoomSize {
+			return nil, errors.New("the maximum number of rooms of the cluster has been reached and no more can be created")
+		}
+	}
+
+	machineID := r.AddressManager.GetSelfMachineID()
+	if r.placement != PlacementLocal {
+		machineID = r.pickMachine(info, loads)
+	}
+
+	info.Address = r.AddressManager.GeneratorRoomAddressOn(machineID)
+	return r.CreateRoom(ctx, info)
+}
@@ -17,7 +17,7 @@ func NewLocalRpcRoomManager(localRoomManager *LocalRoomManager, rpcManager *rpc.
 	manager := &LocalRpcRoomManager{
 		localRoomManager: localRoomManager,
 	}
-	return manager, rpcManager.Regist("LocalRpcRoomManager", manager)
+	return manager, rpcManager.Regist("LocalRpcRoomManager", manager, "GetRoomsByGroup", "GetRooms", "GetRoom", "GetLoad")
 }
 
 type RpcLocalRoomManagerResponse struct {
@@ -25,6 +25,7 @@ type RpcLocalRoomManagerResponse struct {
 	Connection *room.Connection
 	Rooms      []*localRoom
 	Room       *localRoom
+	Load       *NodeLoad
 }
 
 func NewRpcLocalRoomManagerResponse() *RpcLocalRoomManagerResponse {
@@ -77,6 +78,11 @@ func (r *LocalRpcRoomManager) GetRooms(_ *http.Request, req *RpcLocalRoomManager
 	return nil
 }
 
+func (r *LocalRpcRoomManager) GetLoad(_ *http.Request, req *RpcLocalRoomManagerRequest, res *RpcLocalRoomManagerResponse) error {
+	res.Load = r.localRoomManager.GetLoad()
+	return nil
+}
+
 func (r *LocalRpcRoomManager) CreateConnection(_ *http.Request, req *RpcLocalRoomManagerRequest, res *RpcLocalRoomManagerResponse) error {
 	c, err := r.localRoomManager.CreateConnection()
 	if err != nil {
@@ -15,23 +15,34 @@ import (
 func NewRemoteRpcRoomManager(addressManager *localRpc.AddressManager,
 	rpcManager *localRpc.RpcManager,
 	event event.EventEmitter,
-	localRoomManager *LocalRoomManager) *RemoteRpcRoomManager {
+	localRoomManager *LocalRoomManager,
+	placement string,
+	maxClusterRoomSize int) *RemoteRpcRoomManager {
+
+	if !IsValidPlacement(placement) {
+		log.Warnf("room placement %s is invalid, fallback to %s", placement, PlacementLocal)
+		placement = PlacementLocal
+	}
 
 	return &RemoteRpcRoomManager{
-		BasicManager:     *NewBasicManager(),
-		AddressManager:   addressManager,
-		rpcManager:       rpcManager,
-		event:            event,
-		localRoomManager: localRoomManager,
+		BasicManager:       *NewBasicManager(),
+		AddressManager:     addressManager,
+		rpcManager:         rpcManager,
+		event:              event,
+		localRoomManager:   localRoomManager,
+		placement:          placement,
+		maxClusterRoomSize: maxClusterRoomSize,
 	}
 }
 
 type RemoteRpcRoomManager struct {
 	BasicManager
-	AddressManager   *localRpc.AddressManager
-	rpcManager       *localRpc.RpcManager
-	event            event.EventEmitter
-	localRoomManager *LocalRoomManager
+	AddressManager     *localRpc.AddressManager
+	rpcManager         *localRpc.RpcManager
+	event              event.EventEmitter
+	localRoomManager   *LocalRoomManager
+	placement          string
+	maxClusterRoomSize int
 }
 
 func (r *RemoteRpcRoomManager) getRpcByAddress(address *event.Address) (*localRpc.RpcClient, error) {
@@ -111,6 +122,12 @@ func (r *RemoteRpcRoomManager) CreateConnection() *room.Connection {
 		CreatedAt: time.Now(),
 	}
 }
+
+// GetLocalRooms 只返回当前节点上的房间
+func (r *RemoteRpcRoomManager) GetLocalRooms() []room.Room {
+	return r.localRoomManager.GetRooms()
+}
+
 func (r *RemoteRpcRoomManager) CreateLocalRoom(ctx context.Context, info *room.Info) (room.Room, error) {
 	return r.localRoomManager.CreateRoom(ctx, info)
 }
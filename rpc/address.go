@@ -3,6 +3,7 @@ package rpc
 import (
 	"fmt"
 	"github.com/warjiang/page-spy-api/util"
+	"hash/fnv"
 	"math/rand"
 	"net"
 	"sort"
@@ -55,8 +56,21 @@ func GetSelfAddress(info []*config.Address) *config.Address {
 	return nil
 }
 
+// getLocalPort 单机模式下的 RPC 端口，unix socket 和进程内调用不占用端口
+func getLocalPort(c *config.RpcConfig) (string, error) {
+	if c.IsListenerDisabled() || c.GetUnixSocket() != "" {
+		return "0", nil
+	}
+
+	if c.GetListenPort() != "" {
+		return c.GetListenPort(), nil
+	}
+
+	return getAvailablePortWithLimit()
+}
+
 func NewAddressManager(c *config.Config) (*AddressManager, error) {
-	port, err := getAvailablePortWithLimit()
+	port, err := getLocalPort(c.RpcConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -140,6 +154,16 @@ func (a *AddressManager) GeneratorRoomAddress() *event.Address {
 	}
 }
 
+// GeneratorRoomAddressOn 生成指定节点上的房间地址，用于在其它节点创建房间
+func (a *AddressManager) GeneratorRoomAddressOn(machineID string) *event.Address {
+	lID := a.GeneratorLocalID()
+	return &event.Address{
+		ID:        newAddressID(lID, machineID),
+		MachineID: machineID,
+		LocalID:   lID,
+	}
+}
+
 func (a *AddressManager) GeneratorLocalID() string {
 	return uuid.New().String()
 }
@@ -148,6 +172,35 @@ func (a *AddressManager) GetSelfMachineID() string {
 	return a.selfMachineId
 }
 
+// HashScore rendezvous hash 分数，同一个 key 分数最高的节点即为其归属节点
+func HashScore(key string, machineID string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(machineID))
+	return h.Sum64()
+}
+
+// GetHomeMachineID 按 key 计算归属节点，所有节点使用同一份配置时结果一致
+func (a *AddressManager) GetHomeMachineID(key string) string {
+	home := a.GetSelfMachineID()
+	var best uint64
+	for machineID := range a.machineInfo {
+		score := HashScore(key, machineID)
+		if score > best || (score == best && machineID < home) {
+			best = score
+			home = machineID
+		}
+	}
+
+	return home
+}
+
+// IsSingleNode 未配置 rpcAddress 时只有本机一个节点
+func (a *AddressManager) IsSingleNode() bool {
+	return a.selfMachineId == LOCAL_NAME
+}
+
 func (a *AddressManager) IsSelfMachineAddress(address *event.Address) bool {
 	return a.GetSelfMachineID() == address.MachineID
 }
@@ -0,0 +1,273 @@
+package rpc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/warjiang/page-spy-api/config"
+	"github.com/warjiang/page-spy-api/metric"
+)
+
+const (
+	HeaderRpcTimestamp = "X-Rpc-Timestamp"
+	HeaderRpcNonce     = "X-Rpc-Nonce"
+	HeaderRpcSignature = "X-Rpc-Signature"
+	// 流式请求体的 SHA-256，代替请求体参与签名
+	HeaderRpcBodyDigest = "X-Rpc-Body-Sha256"
+)
+
+// 空请求体的 SHA-256
+var emptyBodyDigest = hex.EncodeToString(sha256.New().Sum(nil))
+
+// 签名时间戳允许的最大偏差，超出即视为重放，窗口内的重放由 nonce 拒绝
+const maxSignatureSkew = time.Minute
+
+// sign 签名覆盖时间戳、nonce、方法和请求路径，JSON-RPC 请求同时覆盖请求体，流式请求覆盖请求体的 SHA-256
+func sign(secret string, timestamp string, nonce string, method string, uri string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(method))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(uri))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func signRequest(request *http.Request, secret string, body []byte) {
+	if secret == "" {
+		return
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := newNonce()
+	request.Header.Set(HeaderRpcTimestamp, timestamp)
+	request.Header.Set(HeaderRpcNonce, nonce)
+	request.Header.Set(HeaderRpcSignature, sign(secret, timestamp, nonce, request.Method, request.URL.RequestURI(), body))
+}
+
+func newNonce() string {
+	bs := make([]byte, 16)
+	_, _ = rand.Read(bs)
+	return hex.EncodeToString(bs)
+}
+
+// nonceCache 记录签名有效期内已经使用过的 nonce，同一个签名请求只能执行一次
+type nonceCache struct {
+	lock      sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{
+		seen:      map[string]time.Time{},
+		lastPrune: time.Now(),
+	}
+}
+
+// use 返回 nonce 是否第一次使用，时间戳在前后偏差范围内都有效，记录保留两倍的偏差
+func (c *nonceCache) use(nonce string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastPrune) > maxSignatureSkew {
+		for key, expireAt := range c.seen {
+			if now.After(expireAt) {
+				delete(c.seen, key)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	if expireAt, ok := c.seen[nonce]; ok && now.Before(expireAt) {
+		return false
+	}
+
+	c.seen[nonce] = now.Add(2 * maxSignatureSkew)
+	return true
+}
+
+func verifyRequest(request *http.Request, secret string, nonces *nonceCache, withBody bool) ([]byte, error) {
+	var body []byte
+	if withBody {
+		bs, err := io.ReadAll(request.Body)
+		if err != nil {
+			return nil, fmt.Errorf("read rpc body error %w", err)
+		}
+		body = bs
+	} else {
+		digest := request.Header.Get(HeaderRpcBodyDigest)
+		if digest == "" {
+			return nil, fmt.Errorf("rpc body digest is missing")
+		}
+		body = []byte(digest)
+	}
+
+	timestamp := request.Header.Get(HeaderRpcTimestamp)
+	nonce := request.Header.Get(HeaderRpcNonce)
+	signature := request.Header.Get(HeaderRpcSignature)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return nil, fmt.Errorf("rpc request is not signed")
+	}
+
+	if len(nonce) > 64 {
+		return nil, fmt.Errorf("rpc nonce too long")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("rpc timestamp format error %w", err)
+	}
+
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > maxSignatureSkew || skew < -maxSignatureSkew {
+		return nil, fmt.Errorf("rpc timestamp expired")
+	}
+
+	expected := sign(secret, timestamp, nonce, request.Method, request.RequestURI, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, fmt.Errorf("rpc signature invalid")
+	}
+
+	// 签名校验通过后才记录，未签名的请求不能占用 nonce
+	if !nonces.use(nonce) {
+		return nil, fmt.Errorf("rpc request replayed")
+	}
+
+	return body, nil
+}
+
+// authHandler 校验集群内 RPC 请求的签名，未签名或签名错误的请求直接拒绝
+func authHandler(secret string, nonces *nonceCache, withBody bool, next http.Handler) http.Handler {
+	if secret == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := verifyRequest(r, secret, nonces, withBody)
+		if err != nil {
+			log.Warnf("reject rpc request from %s, %s", r.RemoteAddr, err)
+			metric.Count("page_spy_rpc_reject", map[string]string{
+				"reason": "signature",
+			}, 1)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if withBody {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// 请求体校验通过后才交给处理函数，避免被篡改的内容写入一部分
+		if r.ContentLength == 0 && string(body) == emptyBodyDigest {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		spool, digest, _, err := spoolBody(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer closeSpool(spool)
+
+		if digest != string(body) {
+			log.Warnf("reject rpc request from %s, body digest mismatch", r.RemoteAddr)
+			metric.Count("page_spy_rpc_reject", map[string]string{
+				"reason": "body_digest",
+			}, 1)
+			http.Error(w, "rpc body digest mismatch", http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = spool
+		next.ServeHTTP(w, r)
+	})
+}
+
+// spoolBody 把流式请求体写入临时文件并计算 SHA-256，返回的文件已经回到开头，用完调用 closeSpool
+func spoolBody(reader io.Reader) (*os.File, string, int64, error) {
+	file, err := os.CreateTemp("", "page-spy-rpc-*")
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("create rpc body temp file error %w", err)
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), reader)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		closeSpool(file)
+		return nil, "", 0, fmt.Errorf("read rpc body error %w", err)
+	}
+
+	return file, hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+func closeSpool(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read rpc ca file %s error %w", caFile, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("rpc ca file %s has no valid certificate", caFile)
+	}
+
+	return pool, nil
+}
+
+// newTLSConfig 生成双向 TLS 配置，服务端要求并校验客户端证书
+func newTLSConfig(c *config.RpcTLSConfig, isServer bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load rpc certificate error %w", err)
+	}
+
+	pool, err := loadCertPool(c.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if isServer {
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		tlsConfig.RootCAs = pool
+		tlsConfig.ServerName = c.ServerName
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,126 @@
+package rpc
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/warjiang/page-spy-api/metric"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = 0
+	BreakerHalfOpen BreakerState = 1
+	BreakerOpen     BreakerState = 2
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half_open"
+	case BreakerOpen:
+		return "open"
+	}
+
+	return "unknown"
+}
+
+var ErrBreakerOpen = errors.New("rpc circuit breaker is open")
+
+// circuitBreaker 按节点熔断，连续失败达到阈值后直接拒绝请求，冷却后放行一个探测请求
+type circuitBreaker struct {
+	lock      sync.Mutex
+	address   string
+	state     BreakerState
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(address string, threshold int, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{
+		address:   address,
+		state:     BreakerClosed,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+	b.report()
+	return b
+}
+
+func (b *circuitBreaker) report() {
+	metric.Summary("page_spy_rpc_breaker_state", map[string]string{
+		"address": b.address,
+	}, float64(b.state))
+}
+
+func (b *circuitBreaker) setState(s BreakerState) {
+	if b.state == s {
+		return
+	}
+
+	log.Infof("rpc breaker %s %s => %s", b.address, b.state, s)
+	b.state = s
+	metric.Count("page_spy_rpc_breaker", map[string]string{
+		"address": b.address,
+		"state":   s.String(),
+	}, 1)
+	b.report()
+}
+
+// Allow 判断当前是否可以发起请求
+func (b *circuitBreaker) Allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrBreakerOpen
+		}
+
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrBreakerOpen
+		}
+
+		b.probing = true
+		return nil
+	}
+
+	return nil
+}
+
+func (b *circuitBreaker) Success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = 0
+	b.probing = false
+	b.setState(BreakerClosed)
+}
+
+func (b *circuitBreaker) Failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = b.failures + 1
+	b.probing = false
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	}
+}
+
+func (b *circuitBreaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
@@ -0,0 +1,122 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/warjiang/page-spy-api/config"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+type memoryAddr struct{}
+
+func (memoryAddr) Network() string {
+	return "memory"
+}
+
+func (memoryAddr) String() string {
+	return "memory"
+}
+
+// memoryListener 进程内监听，连接由 net.Pipe 建立，不占用任何端口
+type memoryListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newMemoryListener() *memoryListener {
+	return &memoryListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return memoryAddr{}
+}
+
+func (l *memoryListener) DialContext(ctx context.Context, _ string, _ string) (net.Conn, error) {
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func listenUnix(path string) (net.Listener, dialFunc, error) {
+	info, err := os.Stat(path)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		// 清理上次退出残留的 socket 文件
+		err = os.Remove(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("remove stale unix socket %s error %w", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dial := func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+		dialer := &net.Dialer{}
+		return dialer.DialContext(ctx, "unix", path)
+	}
+
+	return listener, dial, nil
+}
+
+// newListener 根据部署模式创建 RPC 监听，返回的 dialFunc 不为空时本机客户端必须使用它连接
+func newListener(c *config.RpcConfig, addressManager *AddressManager) (net.Listener, dialFunc, error) {
+	self := addressManager.GetSelfAddress()
+	if !addressManager.IsSingleNode() {
+		if c.IsListenerDisabled() || c.GetUnixSocket() != "" {
+			return nil, nil, fmt.Errorf("rpcConfig.disableListener and rpcConfig.unixSocket only work without rpcAddress")
+		}
+
+		listener, err := net.Listen("tcp", net.JoinHostPort(c.GetListenHost(), self.Port))
+		return listener, nil, err
+	}
+
+	if c.IsListenerDisabled() {
+		listener := newMemoryListener()
+		return listener, listener.DialContext, nil
+	}
+
+	if c.GetUnixSocket() != "" {
+		return listenUnix(c.GetUnixSocket())
+	}
+
+	host := c.GetListenHost()
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, self.Port))
+	return listener, nil, err
+}
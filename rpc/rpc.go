@@ -2,41 +2,75 @@ package rpc
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"sync"
 
-	"github.com/gorilla/mux"
 	hRpc "github.com/gorilla/rpc/v2"
 	hJson "github.com/gorilla/rpc/v2/json"
 	"github.com/warjiang/page-spy-api/api/event"
+	"github.com/warjiang/page-spy-api/config"
+	"github.com/warjiang/page-spy-api/trace"
 )
 
 type RpcManager struct {
-	addressManager *AddressManager
-	rpcList        map[string]*RpcClient
-	server         *hRpc.Server
+	config            *config.RpcConfig
+	addressManager    *AddressManager
+	rpcList           map[string]*RpcClient
+	server            *hRpc.Server
+	listener          net.Listener
+	idempotentMethods sync.Map
+	streams           sync.Map
+	nonces            *nonceCache
 }
 
-func NewRpcManager(addressManager *AddressManager) *RpcManager {
-	rpcList := make(map[string]*RpcClient)
-	for machineID, address := range addressManager.GetMachineIpInfo() {
-		rpcList[machineID] = NewRpcClient(address.Ip + ":" + address.Port)
+func NewRpcManager(config *config.Config, addressManager *AddressManager) (*RpcManager, error) {
+	// 集群模式下 RPC 端口对其它节点开放，必须校验请求来源
+	if len(config.RpcAddress) > 0 && config.RpcConfig.GetSecret() == "" && !config.RpcConfig.IsTLS() {
+		return nil, fmt.Errorf("RPC Server start failed, set rpcConfig.secret or rpcConfig.tls in cluster mode")
 	}
+
 	server := hRpc.NewServer()
 	server.RegisterCodec(hJson.NewCodec(), "application/json")
 	rpcManager := &RpcManager{
+		config:         config.RpcConfig,
 		addressManager: addressManager,
-		rpcList:        rpcList,
+		rpcList:        make(map[string]*RpcClient),
 		server:         server,
+		nonces:         newNonceCache(),
+	}
+
+	listener, selfDial, err := newListener(config.RpcConfig, addressManager)
+	if err != nil {
+		return nil, fmt.Errorf("RPC Server start failed, %w", err)
+	}
+	rpcManager.listener = listener
+
+	for machineID, address := range addressManager.GetMachineIpInfo() {
+		var dial dialFunc
+		if machineID == addressManager.GetSelfMachineID() {
+			dial = selfDial
+		}
+
+		client, err := NewRpcClient(address.Ip+":"+address.Port, config.RpcConfig, rpcManager.isIdempotent, dial)
+		if err != nil {
+			return nil, fmt.Errorf("init rpc client %s error %w", machineID, err)
+		}
+		rpcManager.rpcList[machineID] = client
 	}
 
 	rpcManager.Run()
-	return rpcManager
+	return rpcManager, nil
 }
 
 func (r *RpcManager) GetRpcByAddress(address *event.Address) *RpcClient {
 	return r.rpcList[address.MachineID]
 }
 
+func (r *RpcManager) GetRpcByMachineID(machineID string) *RpcClient {
+	return r.rpcList[machineID]
+}
+
 func (r *RpcManager) GetRpcList() []*RpcClient {
 	list := make([]*RpcClient, 0, len(r.rpcList))
 	for _, l := range r.rpcList {
@@ -46,14 +80,60 @@ func (r *RpcManager) GetRpcList() []*RpcClient {
 	return list
 }
 
-func (r *RpcManager) Regist(name string, api interface{}) error {
+// Regist 注册 RPC 服务，idempotentMethods 为只读方法，调用失败时允许重试
+func (r *RpcManager) Regist(name string, api interface{}, idempotentMethods ...string) error {
+	for _, method := range idempotentMethods {
+		r.idempotentMethods.Store(name+"."+method, struct{}{})
+	}
+
 	return r.server.RegisterService(api, name)
 }
 
+func (r *RpcManager) isIdempotent(method string) bool {
+	_, ok := r.idempotentMethods.Load(method)
+	return ok
+}
+
+// RegistStream 注册流式接口，用于节点间直接传输文件内容，签名覆盖请求体的 SHA-256
+func (r *RpcManager) RegistStream(path string, handler http.Handler) {
+	r.streams.Store(path, authHandler(r.config.GetSecret(), r.nonces, false, handler))
+}
+
+func (r *RpcManager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// 沿用调用方的请求 ID，RPC 方法通过 req.Context() 获取
+	ctx, span := trace.Start(trace.Extract(req.Context(), req.Header), "rpc.server "+req.URL.Path, trace.KindServer)
+	defer span.End(nil)
+	req = req.WithContext(ctx)
+	if req.URL.Path == "/rpc" {
+		authHandler(r.config.GetSecret(), r.nonces, true, r.server).ServeHTTP(w, req)
+		return
+	}
+
+	handler, ok := r.streams.Load(req.URL.Path)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	handler.(http.Handler).ServeHTTP(w, req)
+}
+
 func (r *RpcManager) listen() error {
-	route := mux.NewRouter()
-	route.Handle("/rpc", r.server)
-	err := http.ListenAndServe(":"+r.addressManager.GetSelfAddress().Port, route)
+	server := &http.Server{
+		Handler: r,
+	}
+
+	var err error
+	if r.config.IsTLS() {
+		server.TLSConfig, err = newTLSConfig(r.config.TLS, true)
+		if err != nil {
+			return fmt.Errorf("RPC Server start failed, %w", err)
+		}
+		err = server.ServeTLS(r.listener, "", "")
+	} else {
+		err = server.Serve(r.listener)
+	}
+
 	if err != nil {
 		return fmt.Errorf("RPC Server start failed, %w", err)
 	}
@@ -61,11 +141,11 @@ func (r *RpcManager) listen() error {
 }
 
 func (r *RpcManager) Run() {
+	log.Infof("RPC server started on %s", r.listener.Addr().String())
 	go func() {
 		err := r.listen()
 		if err != nil {
 			log.Fatal(err)
 		}
-		log.Infof("RPC server started on :%s", r.addressManager.GetSelfAddress().Port)
 	}()
 }
@@ -1,75 +1,111 @@
 package rpc
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/rpc"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 
-	req "github.com/imroc/req/v2"
 	"github.com/warjiang/page-spy-api/api/room"
+	"github.com/warjiang/page-spy-api/config"
 	"github.com/warjiang/page-spy-api/metric"
-	"github.com/warjiang/page-spy-api/state"
+	"github.com/warjiang/page-spy-api/trace"
 )
 
 type RpcClient struct {
-	state.StatusMachine
-	client  *rpc.Client
-	lock    sync.RWMutex
-	address string
-	err     error
-	id      int64
+	lock         sync.RWMutex
+	address      string
+	id           int64
+	client       *http.Client
+	streamClient *http.Client
+	scheme       string
+	secret       string
+	breaker      *circuitBreaker
+	maxRetry     int
+	backoff      time.Duration
+	isIdempotent func(method string) bool
 }
 
-func NewRpcClient(address string) *RpcClient {
-	req.SetTimeout(4 * time.Second)
-	return &RpcClient{
-		StatusMachine: *state.NewStatusMachine(),
-		address:       address,
+func newHttpClient(c *config.RpcConfig, dial dialFunc) (*http.Client, error) {
+	if dial == nil {
+		dialer := &net.Dialer{
+			Timeout:   c.GetTimeout(),
+			KeepAlive: 30 * time.Second,
+		}
+		dial = dialer.DialContext
 	}
-}
 
-func (r *RpcClient) getId() int64 {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	r.id = r.id + 1
-	return r.id
-}
+	transport := &http.Transport{
+		DialContext:         dial,
+		MaxIdleConns:        c.GetMaxIdleConnsPerHost(),
+		MaxIdleConnsPerHost: c.GetMaxIdleConnsPerHost(),
+		IdleConnTimeout:     c.GetIdleConnTimeout(),
+		DisableCompression:  true,
+	}
 
-func (r *RpcClient) initClient() {
-	if !r.IsStatus(state.InitStatus) && !r.IsStatus(state.ErrorStatus) {
-		return
+	if c.IsTLS() {
+		tlsConfig, err := newTLSConfig(c.TLS, false)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
 	}
 
-	r.lock.Lock()
-	defer r.lock.Unlock()
+	return &http.Client{
+		Timeout:   c.GetTimeout(),
+		Transport: transport,
+	}, nil
+}
 
-	if !r.IsStatus(state.InitStatus) && !r.IsStatus(state.ErrorStatus) {
-		return
+// NewRpcClient dial 为空时通过 tcp 连接 address
+func NewRpcClient(address string, c *config.RpcConfig, isIdempotent func(method string) bool, dial dialFunc) (*RpcClient, error) {
+	client, err := newHttpClient(c, dial)
+	if err != nil {
+		return nil, err
 	}
 
-	client, err := rpc.Dial("tcp", r.address)
-	if err != nil {
-		r.err = err
-		r.SetStatus(state.ErrorStatus)
-		return
+	// 流式传输耗时与文件大小相关，streamClient 不设置整体超时，由调用方的 ctx 控制
+	scheme := "http"
+	if c.IsTLS() {
+		scheme = "https"
 	}
 
-	r.SetStatus(state.RunningStatus)
-	r.client = client
-	r.err = nil
+	return &RpcClient{
+		address:      address,
+		client:       client,
+		streamClient: &http.Client{Transport: client.Transport},
+		scheme:       scheme,
+		secret:       c.GetSecret(),
+		breaker:      newCircuitBreaker(address, c.GetBreakerFailureThreshold(), c.GetBreakerCooldown()),
+		maxRetry:     c.GetMaxRetry(),
+		backoff:      c.GetRetryBackoff(),
+		isIdempotent: isIdempotent,
+	}, nil
 }
 
-func (r *RpcClient) GetClient() (*rpc.Client, error) {
-	r.initClient()
-	if r.err != nil && r.IsStatus(state.ErrorStatus) {
-		return nil, r.err
-	}
+func (r *RpcClient) getId() int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.id = r.id + 1
+	return r.id
+}
+
+func (r *RpcClient) GetAddress() string {
+	return r.address
+}
 
-	return r.client, nil
+func (r *RpcClient) GetBreakerState() BreakerState {
+	return r.breaker.State()
 }
 
 type Result struct {
@@ -78,12 +114,61 @@ type Result struct {
 	Id     int64       `json:"id"`
 }
 
+// transportError 表示请求没有得到对端的正常处理，会计入熔断并允许重试
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
+func isTransportError(err error) bool {
+	var te *transportError
+	return errors.As(err, &te)
+}
+
+// IsUnreachable 调用失败是因为对端不可达，而不是对端返回了业务错误
+func IsUnreachable(err error) bool {
+	return isTransportError(err) || errors.Is(err, ErrBreakerOpen)
+}
+
 func (r *RpcClient) call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
 	id := r.getId()
-	body := map[string]interface{}{
+	body, err := json.Marshal(map[string]interface{}{
 		"method": serviceMethod,
 		"params": []interface{}{args},
 		"id":     id,
+	})
+	if err != nil {
+		return fmt.Errorf("rpc request marshal error %w", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s://%s/rpc", r.scheme, r.address), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	trace.Inject(ctx, request.Header)
+	signRequest(request, r.secret, body)
+
+	resp, err := r.client.Do(request)
+	if err != nil {
+		return &transportError{err: err}
+	}
+	defer resp.Body.Close()
+
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return &transportError{err: err}
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("rpc request to %s unauthorized, %s", r.address, string(bs))
 	}
 
 	result := &Result{
@@ -92,22 +177,24 @@ func (r *RpcClient) call(ctx context.Context, serviceMethod string, args interfa
 		Id:     id,
 	}
 
-	resp, err := req.R().SetContext(ctx).SetBody(body).SetResult(result).Post(fmt.Sprintf("http://%s/rpc", r.address))
-	if err != nil {
-		return err
-	}
-
-	if !resp.IsSuccess() {
-		bs := resp.Bytes()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		err = json.Unmarshal(bs, result)
-		if err != nil {
-			return fmt.Errorf("request status %s error %s", resp.Status, string(bs))
+		if err != nil || result.Error == "" {
+			return &transportError{err: fmt.Errorf("request status %s error %s", resp.Status, string(bs))}
 		}
 
-		return fmt.Errorf(result.Error)
+		return errors.New(result.Error)
+	}
+
+	err = json.Unmarshal(bs, result)
+	if err != nil {
+		return fmt.Errorf("rpc response unmarshal error %w", err)
+	}
+
+	if result.Error != "" {
+		return errors.New(result.Error)
 	}
 
-	bs, _ := json.Marshal(result)
 	log.Debugf("rpc call %s method %s response %s", r.address, serviceMethod, string(bs))
 	basicRes, ok := reply.(room.BasicRpcResponseInterface)
 	if ok && !reflect.ValueOf(basicRes).IsNil() && basicRes.GetError() != nil {
@@ -117,21 +204,148 @@ func (r *RpcClient) call(ctx context.Context, serviceMethod string, args interfa
 	return nil
 }
 
+// backoffDuration 指数退避并加入随机抖动，避免多个节点同时重试
+func (r *RpcClient) backoffDuration(attempt int) time.Duration {
+	d := r.backoff << attempt
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+func (r *RpcClient) callWithRetry(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	retry := 0
+	if r.isIdempotent != nil && r.isIdempotent(serviceMethod) {
+		retry = r.maxRetry
+	}
+
+	var err error
+	for attempt := 0; attempt <= retry; attempt++ {
+		if attempt > 0 {
+			metric.Count("page_spy_rpc_retry", map[string]string{
+				"method": serviceMethod,
+			}, 1)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(r.backoffDuration(attempt - 1)):
+			}
+		}
+
+		if e := r.breaker.Allow(); e != nil {
+			if err == nil {
+				err = fmt.Errorf("call %s method %s failed, %w", r.address, serviceMethod, e)
+			}
+			return err
+		}
+
+		err = r.call(ctx, serviceMethod, args, reply)
+		if err == nil || !isTransportError(err) {
+			r.breaker.Success()
+			return err
+		}
+
+		r.breaker.Failure()
+	}
+
+	return err
+}
+
 func (r *RpcClient) Call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
 	start := time.Now()
 	status := "success"
+	ctx, span := trace.Start(ctx, "rpc "+serviceMethod, trace.KindClient)
+	span.SetAttribute("rpc.method", serviceMethod)
+	span.SetAttribute("net.peer", r.address)
 	defer func() {
 		metric.Time("page_spy_rpc_call", map[string]string{
 			"status": status,
 		}, float64(time.Since(start).Milliseconds()))
 	}()
 
-	err := r.call(ctx, serviceMethod, args, reply)
+	err := r.callWithRetry(ctx, serviceMethod, args, reply)
+	span.End(err)
+	logger := trace.Entry(ctx, log)
 	if err != nil {
 		status = "error"
-		log.Errorf("rpc_call_error %s method %s error %s", r.address, serviceMethod, err)
+		if errors.Is(err, ErrBreakerOpen) {
+			status = "breaker_open"
+		}
+		logger.Errorf("rpc_call_error %s method %s error %s", r.address, serviceMethod, err)
 	}
 
-	log.Debugf("rpc call %s method %s", r.address, serviceMethod)
+	logger.Debugf("rpc call %s method %s", r.address, serviceMethod)
 	return err
 }
+
+// StreamError 流式接口返回了非 2xx 的响应
+type StreamError struct {
+	StatusCode int
+	Message    string
+	Header     http.Header
+}
+
+func (e *StreamError) Error() string {
+	return e.Message
+}
+
+// Stream 通过 RPC 端口直接传输二进制内容，调用方负责关闭返回的 Body
+func (r *RpcClient) Stream(ctx context.Context, method string, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	u := fmt.Sprintf("%s://%s%s", r.scheme, r.address, path)
+	if len(query) > 0 {
+		u = u + "?" + query.Encode()
+	}
+
+	// 签名时需要请求体的 SHA-256，先写入临时文件计算
+	digest := emptyBodyDigest
+	size := int64(0)
+	if body != nil && r.secret != "" {
+		spool, spoolDigest, spoolSize, err := spoolBody(body)
+		if err != nil {
+			return nil, err
+		}
+		defer closeSpool(spool)
+		body, digest, size = spool, spoolDigest, spoolSize
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if size > 0 {
+		request.ContentLength = size
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	trace.Inject(ctx, request.Header)
+	if r.secret != "" {
+		request.Header.Set(HeaderRpcBodyDigest, digest)
+	}
+	signRequest(request, r.secret, []byte(digest))
+
+	// 先准备好请求再判断熔断，放行后的每个分支都记录结果，否则半开状态的探测一直不会结束
+	if err := r.breaker.Allow(); err != nil {
+		return nil, fmt.Errorf("stream %s %s failed, %w", r.address, path, err)
+	}
+
+	resp, err := r.streamClient.Do(request)
+	if err != nil {
+		r.breaker.Failure()
+		return nil, &transportError{err: err}
+	}
+
+	// 5xx 说明节点异常，和传输错误一样计入熔断，4xx 是请求本身的问题
+	if resp.StatusCode >= 500 {
+		r.breaker.Failure()
+	} else {
+		r.breaker.Success()
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		bs, _ := io.ReadAll(resp.Body)
+		return nil, &StreamError{
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("stream %s %s status %s error %s", r.address, path, resp.Status, strings.TrimSpace(string(bs))),
+			Header:     resp.Header,
+		}
+	}
+
+	return resp, nil
+}
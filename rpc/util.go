@@ -2,6 +2,7 @@ package rpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
 )
 
@@ -30,3 +31,49 @@ func CallAllClient[T MergeResult](r *RpcManager, ctx context.Context, method str
 
 	return nil
 }
+
+// PartialError 部分节点调用失败，其它节点的结果仍然有效
+type PartialError struct {
+	Failed int
+	Total  int
+	Err    error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d of %d nodes failed, %s", e.Failed, e.Total, e.Err.Error())
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// CallEachClient 调用所有节点，单个节点失败不影响其它节点，res 中是成功节点合并的结果
+// 部分节点失败时返回 PartialError，全部失败时返回所有节点的错误
+func CallEachClient[T MergeResult](r *RpcManager, ctx context.Context, method string, req any, res T) error {
+	if len(r.rpcList) == 0 {
+		return fmt.Errorf("rpc client list is empty")
+	}
+
+	errs := []error{}
+	for _, client := range r.rpcList {
+		tmp := res.New()
+		err := client.Call(ctx, method, req, tmp)
+		if err == nil {
+			err = res.Merge(tmp)
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("call %s on %s error %w", method, client.address, err))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	if len(errs) == len(r.rpcList) {
+		return errors.Join(errs...)
+	}
+
+	return &PartialError{Failed: len(errs), Total: len(r.rpcList), Err: errors.Join(errs...)}
+}
@@ -14,8 +14,8 @@ func CORS(c *config.Config) echo.MiddlewareFunc {
 	config := middleware.CORSConfig{
 		AllowOrigins:     []string{},
 		AllowMethods:     []string{"HEAD", "POST", "GET", "OPTIONS", "PUT", "DELETE", "UPDATE"},
-		AllowHeaders:     []string{"Origin", "Authorization", "Content-Length", "X-Request-Id", "Content-Type", "Referer", "User-Agent", "Host"},
-		ExposeHeaders:    []string{"X-Request-Id"},
+		AllowHeaders:     []string{"Origin", "Authorization", "Content-Length", "X-Request-Id", "Upload-Length", "Upload-Offset", "Content-Type", "Referer", "User-Agent", "Host"},
+		ExposeHeaders:    []string{"X-Request-Id", "Upload-Offset"},
 		AllowCredentials: true,
 		MaxAge:           12 * 60 * 60,
 		AllowOriginFunc: func(origin string) (bool, error) {
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
@@ -13,6 +14,11 @@ func Error() echo.MiddlewareFunc {
 		return func(c echo.Context) error {
 			err := next(c)
 			if err != nil {
+				he, ok := err.(*echo.HTTPError)
+				if ok {
+					return c.JSON(he.Code, common.NewErrorResponse(fmt.Errorf("%v", he.Message)))
+				}
+
 				res := common.NewErrorResponse(err)
 				if res.Code == room.ServeError {
 					return c.JSON(http.StatusInternalServerError, res)
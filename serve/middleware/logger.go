@@ -4,10 +4,10 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/google/uuid"
 	echo "github.com/labstack/echo/v4"
 	"github.com/warjiang/page-spy-api/logger"
 	"github.com/warjiang/page-spy-api/metric"
+	"github.com/warjiang/page-spy-api/trace"
 )
 
 const HeaderXRequestID = "X-Request-ID"
@@ -18,13 +18,7 @@ func Logger() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			startTime := time.Now()
-			rid := c.Request().Header.Get(HeaderXRequestID)
-			if rid == "" {
-				rid = uuid.New().String()
-				c.Response().Header().Set(HeaderXRequestID, rid)
-			}
-
-			logger := middlewareLogger.WithField("_request_id", rid)
+			logger := trace.Entry(c.Request().Context(), middlewareLogger)
 			route := "/404"
 			for _, r := range c.Echo().Routes() {
 				if r.Method == c.Request().Method && r.Path == c.Path() {
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"strconv"
+
+	echo "github.com/labstack/echo/v4"
+	"github.com/warjiang/page-spy-api/trace"
+)
+
+// Trace 为每个请求生成或沿用请求 ID，并记录一个 server span
+func Trace() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := trace.Extract(req.Context(), req.Header)
+			if trace.RequestId(ctx) == "" {
+				ctx = trace.WithRequestId(ctx, trace.NewRequestId())
+			}
+
+			c.Response().Header().Set(HeaderXRequestID, trace.RequestId(ctx))
+			ctx, span := trace.Start(ctx, req.Method+" "+c.Path(), trace.KindServer)
+			span.SetAttribute("http.method", req.Method)
+			span.SetAttribute("http.route", c.Path())
+			span.SetAttribute("http.client_ip", c.RealIP())
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+			span.SetAttribute("http.status_code", strconv.Itoa(c.Response().Status))
+			span.End(err)
+			return err
+		}
+	}
+}
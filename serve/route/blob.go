@@ -0,0 +1,351 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/warjiang/page-spy-api/rpc"
+	"github.com/warjiang/page-spy-api/storage"
+)
+
+// 节点间传输文件内容的流式接口，挂在 RPC 端口上，不依赖对外的 HTTP 端口
+const (
+	blobLogPath         = "/blob/log"
+	blobGroupUploadPath = "/blob/logGroup"
+)
+
+const (
+	headerFileName     = "X-File-Name"
+	headerFileEncoding = "X-File-Encoding"
+	headerFileSize     = "X-File-Size"
+)
+
+type FileRequest struct {
+	FileId string
+}
+
+type FileResponse struct {
+}
+
+type PresignFileRequest struct {
+	FileId         string
+	AcceptEncoding string
+}
+
+type PresignFileResponse struct {
+	Url string
+}
+
+func (c *CoreApi) getRpcByMachine(machineId string) (*rpc.RpcClient, error) {
+	client := c.rpcManager.GetRpcByMachineID(machineId)
+	if client == nil {
+		return nil, fmt.Errorf("rpc client of machine %s not found", machineId)
+	}
+
+	return client, nil
+}
+
+// GetClusterFile 获取集群内任意节点上的文件，非本机文件通过 RPC 端口流式读取
+func (c *CoreApi) GetClusterFile(ctx context.Context, fileId string, opts *FileReadOptions) (*storage.LogFile, error) {
+	machineId, err := c.GetMachineIdByFileName(fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.CanServeLocally(machineId) {
+		return c.GetFile(fileId, opts)
+	}
+
+	client, err := c.getRpcByMachine(machineId)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"fileId": {fileId}}
+	opts.encode(query)
+	resp, err := client.Stream(ctx, http.MethodGet, blobLogPath, query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := url.PathUnescape(resp.Header.Get(headerFileName))
+	if err != nil {
+		name = fileId
+	}
+
+	file := &storage.LogFile{
+		Name:      name,
+		FileId:    fileId,
+		Size:      resp.ContentLength,
+		FileSteam: resp.Body,
+	}
+
+	// 压缩的文件原样传输，由最终响应客户端的节点决定是否解压
+	file.Encoding = resp.Header.Get(headerFileEncoding)
+	if file.Encoding != storage.EncodingIdentity {
+		file.EncodedSize = resp.ContentLength
+		file.Size, _ = strconv.ParseInt(resp.Header.Get(headerFileSize), 10, 64)
+	}
+
+	readFileReadHeaders(resp.Header, file)
+	return file, nil
+}
+
+// PresignFile 返回直接从存储下载文件的临时地址，返回空地址时需要由节点读取文件
+func (c *CoreApi) PresignFile(fileId string, acceptEncoding string) (string, error) {
+	if !c.presignDownload {
+		return "", nil
+	}
+
+	fileData, err := c.data.FindLogByFileId(fileId)
+	if err != nil {
+		return "", err
+	}
+	// 没有记录时不生成地址，由读取文件的请求返回 404，RPC 返回的错误不能区分文件不存在
+	if fileData == nil {
+		return "", nil
+	}
+
+	st, err := c.findBlobStorage(fileData.GetBlobId())
+	if err != nil {
+		return "", err
+	}
+
+	presigner, ok := st.(storage.Presigner)
+	if !ok {
+		return "", nil
+	}
+
+	return presigner.PresignLog(&storage.PresignRequest{
+		FileId:         fileData.GetBlobId(),
+		Name:           fileData.Name,
+		Expire:         c.presignExpire,
+		AcceptEncoding: acceptEncoding,
+	})
+}
+
+// PresignClusterFile 由保存文件记录的节点生成预签名地址
+func (c *CoreApi) PresignClusterFile(ctx context.Context, fileId string, acceptEncoding string) (string, error) {
+	if !c.presignDownload {
+		return "", nil
+	}
+
+	machineId, err := c.GetMachineIdByFileName(fileId)
+	if err != nil {
+		return "", err
+	}
+
+	if c.CanServeLocally(machineId) {
+		return c.PresignFile(fileId, acceptEncoding)
+	}
+
+	client, err := c.getRpcByMachine(machineId)
+	if err != nil {
+		return "", err
+	}
+
+	res := &PresignFileResponse{}
+	err = client.Call(ctx, "CoreApi.PresignFile", &PresignFileRequest{FileId: fileId, AcceptEncoding: acceptEncoding}, res)
+	if err != nil {
+		return "", err
+	}
+
+	return res.Url, nil
+}
+
+// DeleteClusterFile 删除集群内任意节点上的文件
+func (c *CoreApi) DeleteClusterFile(fileId string) error {
+	machineId, err := c.GetMachineIdByFileName(fileId)
+	if err != nil {
+		return err
+	}
+
+	if c.CanServeLocally(machineId) {
+		return c.DeleteFile(fileId)
+	}
+
+	client, err := c.getRpcByMachine(machineId)
+	if err != nil {
+		return err
+	}
+
+	return client.Call(context.Background(), "CoreApi.DeleteFile", &FileRequest{FileId: fileId}, &FileResponse{})
+}
+
+// DeleteClusterFiles 逐个删除文件，单个失败不影响其它文件，最后汇总错误
+func (c *CoreApi) DeleteClusterFiles(fileIds []string) error {
+	errs := []error{}
+	for _, fileId := range fileIds {
+		err := c.DeleteClusterFile(fileId)
+		if err != nil {
+			log.Errorf("delete file %s error %s", fileId, err.Error())
+			errs = append(errs, fmt.Errorf("delete file %s error %w", fileId, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// CreateLogGroupFileOn 在指定节点上创建组文件，文件内容通过 RPC 端口流式发送
+func (c *CoreApi) CreateLogGroupFileOn(ctx context.Context, machineId string, file *storage.LogGroupFile) (*storage.LogGroupFile, error) {
+	if c.IsSelfMachine(machineId) {
+		return c.CreateLogGroupFile(file)
+	}
+
+	client, err := c.getRpcByMachine(machineId)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := json.Marshal(file.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{
+		"groupId": {file.GroupId},
+		"name":    {file.Name},
+		"tags":    {string(tags)},
+	}
+
+	resp, err := client.Stream(ctx, http.MethodPost, blobGroupUploadPath, query, file.FileSteam)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	res := &storage.LogGroupFile{}
+	err = json.NewDecoder(resp.Body).Decode(res)
+	if err != nil {
+		return nil, fmt.Errorf("decode upload response of machine %s error %w", machineId, err)
+	}
+
+	return res, nil
+}
+
+// streamErrorStatus 流式接口的错误状态码，调用方把 5xx 计入熔断，只有节点本身的故障返回 5xx
+func streamErrorStatus(err error) int {
+	if status := uploadErrorStatus(err); status != 0 {
+		return status
+	}
+
+	if isFileNotFound(err) {
+		return http.StatusNotFound
+	}
+
+	if errors.Is(err, storage.ErrRangeNotSatisfiable) {
+		return http.StatusRequestedRangeNotSatisfiable
+	}
+
+	// 请求体没有传完是调用方的问题
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+func (c *CoreApi) serveBlobLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	file, err := c.GetFile(query.Get("fileId"), decodeFileReadOptions(query))
+	if err != nil {
+		rangeErr := &storage.RangeNotSatisfiableError{}
+		if errors.As(err, &rangeErr) {
+			w.Header().Set(headerFileSize, strconv.FormatInt(rangeErr.Size, 10))
+		}
+		http.Error(w, err.Error(), streamErrorStatus(err))
+		return
+	}
+
+	defer file.FileSteam.Close()
+	w.Header().Set(headerFileName, url.PathEscape(file.Name))
+	writeFileReadHeaders(w.Header(), file)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// 304 也返回压缩编码，由响应客户端的节点决定 ETag
+	if file.Encoding != storage.EncodingIdentity {
+		w.Header().Set(headerFileEncoding, file.Encoding)
+	}
+
+	size := file.Size
+	if file.Range != nil {
+		size = file.Range.Length
+	} else if file.NotModified {
+		size = 0
+	} else if file.Encoding != storage.EncodingIdentity {
+		w.Header().Set(headerFileSize, strconv.FormatInt(file.Size, 10))
+		size = file.EncodedSize
+	}
+
+	if size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	_, err = io.Copy(w, file.FileSteam)
+	if err != nil {
+		log.Errorf("stream file %s error %s", file.FileId, err.Error())
+	}
+}
+
+func (c *CoreApi) serveBlobGroupUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("groupId") == "" {
+		http.Error(w, "groupId is required", http.StatusBadRequest)
+		return
+	}
+
+	tags := []*storage.Tag{}
+	err := json.Unmarshal([]byte(query.Get("tags")), &tags)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("tags format error %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	createFile, err := c.CreateLogGroupFile(&storage.LogGroupFile{
+		LogFile: storage.LogFile{
+			Tags:      tags,
+			Name:      query.Get("name"),
+			FileSteam: r.Body,
+		},
+		GroupId: query.Get("groupId"),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), streamErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(createFile)
+	if err != nil {
+		log.Errorf("write upload response error %s", err.Error())
+	}
+}
+
+func (r *RcpCoreApi) PresignFile(_ *http.Request, req *PresignFileRequest, res *PresignFileResponse) error {
+	url, err := r.core.PresignFile(req.FileId, req.AcceptEncoding)
+	if err != nil {
+		return err
+	}
+
+	res.Url = url
+	return nil
+}
+
+func (r *RcpCoreApi) DeleteFile(_ *http.Request, req *FileRequest, res *FileResponse) error {
+	return r.core.DeleteFile(req.FileId)
+}
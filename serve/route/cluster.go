@@ -0,0 +1,176 @@
+package route
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/warjiang/page-spy-api/config"
+	"github.com/warjiang/page-spy-api/data"
+	"github.com/warjiang/page-spy-api/election"
+	"github.com/warjiang/page-spy-api/room"
+	"github.com/warjiang/page-spy-api/rpc"
+)
+
+type NodeInfo struct {
+	MachineID       string    `json:"machineId"`
+	Address         string    `json:"address"`
+	Self            bool      `json:"self"`
+	Leader          bool      `json:"leader"`
+	Reachable       bool      `json:"reachable"`
+	LatencyOfMs     int64     `json:"latencyOfMs"`
+	Breaker         string    `json:"breaker"`
+	Error           string    `json:"error,omitempty"`
+	Version         string    `json:"version"`
+	GitHash         string    `json:"gitHash"`
+	RoomCount       int       `json:"roomCount"`
+	ConnectionCount int       `json:"connectionCount"`
+	LogCount        int64     `json:"logCount"`
+	LogSize         int64     `json:"logSize"`
+	StartedAt       time.Time `json:"startedAt"`
+	UptimeOfSecond  int64     `json:"uptimeOfSecond"`
+}
+
+type ClusterApi struct {
+	addressManager *rpc.AddressManager
+	rpcManager     *rpc.RpcManager
+	roomManager    *room.RemoteRpcRoomManager
+	data           data.DataApi
+	staticConfig   *config.StaticConfig
+	elector        *election.Elector
+	startedAt      time.Time
+}
+
+type RpcClusterApi struct {
+	cluster *ClusterApi
+}
+
+type NodeInfoRequest struct {
+}
+
+type NodeInfoResponse struct {
+	Node *NodeInfo
+}
+
+func NewClusterApi(addressManager *rpc.AddressManager, rpcManager *rpc.RpcManager, roomManager *room.RemoteRpcRoomManager, data data.DataApi, staticConfig *config.StaticConfig, elector *election.Elector) (*ClusterApi, error) {
+	clusterApi := &ClusterApi{
+		addressManager: addressManager,
+		rpcManager:     rpcManager,
+		roomManager:    roomManager,
+		data:           data,
+		staticConfig:   staticConfig,
+		elector:        elector,
+		startedAt:      time.Now(),
+	}
+
+	return clusterApi, rpcManager.Regist("ClusterApi", &RpcClusterApi{cluster: clusterApi}, "NodeInfo")
+}
+
+// getSelfNodeInfo 当前节点的运行信息，可达性和延迟由调用方填充
+func (c *ClusterApi) getSelfNodeInfo() (*NodeInfo, error) {
+	logCount, err := c.data.CountLogs()
+	if err != nil {
+		return nil, err
+	}
+
+	logSize, err := c.data.CountLogsSize()
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := c.roomManager.GetLocalRooms()
+	connectionCount := 0
+	for _, r := range rooms {
+		connectionCount = connectionCount + len(r.GetRoomUsers())
+	}
+
+	return &NodeInfo{
+		MachineID:       c.addressManager.GetSelfMachineID(),
+		Leader:          c.elector.IsLeader(),
+		Version:         c.staticConfig.GetVersion(),
+		GitHash:         c.staticConfig.GetGitHash(),
+		RoomCount:       len(rooms),
+		ConnectionCount: connectionCount,
+		LogCount:        logCount,
+		LogSize:         logSize,
+		StartedAt:       c.startedAt,
+		UptimeOfSecond:  int64(time.Since(c.startedAt).Seconds()),
+	}, nil
+}
+
+func (c *ClusterApi) getNodeInfo(ctx context.Context, machineID string, address *config.Address) *NodeInfo {
+	node := &NodeInfo{
+		MachineID: machineID,
+		Address:   address.Ip + ":" + address.Port,
+		Self:      c.addressManager.GetSelfMachineID() == machineID,
+	}
+
+	client := c.rpcManager.GetRpcByMachineID(machineID)
+	if client == nil {
+		node.Error = "rpc client not found"
+		return node
+	}
+
+	node.Breaker = client.GetBreakerState().String()
+	start := time.Now()
+	res := &NodeInfoResponse{}
+	err := client.Call(ctx, "ClusterApi.NodeInfo", &NodeInfoRequest{}, res)
+	node.LatencyOfMs = time.Since(start).Milliseconds()
+	if err != nil {
+		node.Reachable = !rpc.IsUnreachable(err)
+		node.Error = err.Error()
+		return node
+	}
+
+	if res.Node != nil {
+		res.Node.Address = node.Address
+		res.Node.Self = node.Self
+		res.Node.Breaker = node.Breaker
+		res.Node.LatencyOfMs = node.LatencyOfMs
+		node = res.Node
+	}
+
+	node.MachineID = machineID
+	node.Reachable = true
+	return node
+}
+
+// ListNodes 并发查询所有节点，单个节点不可达不影响其它节点的结果
+func (c *ClusterApi) ListNodes(ctx context.Context) []*NodeInfo {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	machines := c.addressManager.GetMachineIpInfo()
+	nodes := make([]*NodeInfo, 0, len(machines))
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for machineID, address := range machines {
+		wg.Add(1)
+		go func(machineID string, address *config.Address) {
+			defer wg.Done()
+			node := c.getNodeInfo(ctx, machineID, address)
+			lock.Lock()
+			defer lock.Unlock()
+			nodes = append(nodes, node)
+		}(machineID, address)
+	}
+
+	wg.Wait()
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].MachineID < nodes[j].MachineID
+	})
+
+	return nodes
+}
+
+func (r *RpcClusterApi) NodeInfo(_ *http.Request, req *NodeInfoRequest, res *NodeInfoResponse) error {
+	node, err := r.cluster.getSelfNodeInfo()
+	if err != nil {
+		return err
+	}
+
+	res.Node = node
+	return nil
+}
@@ -2,44 +2,176 @@ package route
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/warjiang/page-spy-api/config"
 	"github.com/warjiang/page-spy-api/data"
 	"github.com/warjiang/page-spy-api/logger"
 	"github.com/warjiang/page-spy-api/rpc"
 	"github.com/warjiang/page-spy-api/storage"
 	"github.com/warjiang/page-spy-api/task"
-	"github.com/warjiang/page-spy-api/util"
+	"github.com/warjiang/page-spy-api/upload"
 )
 
 var log = logger.Log().WithField("module", "core")
 
 type CoreApi struct {
-	rpcManager     *rpc.RpcManager
-	storage        storage.StorageApi
-	data           data.DataApi
-	maxSizeOfByte  int64 // unit byte
-	maxLifeOfHour  int64 // unit Hour
-	addressManager *rpc.AddressManager
+	rpcManager        *rpc.RpcManager
+	storage           storage.StorageApi
+	data              data.DataApi
+	maxSizeOfByte     int64 // unit byte
+	maxLifeOfHour     int64 // unit Hour
+	maxUploadSize     int64 // unit byte
+	maxJsonUploadSize int64 // unit byte
+	uploads           *upload.SessionManager
+	addressManager    *rpc.AddressManager
+	sharedMetadata    bool
+	remoteStorage     bool
+	// 文件在 S3 时使用预签名地址下载和上传
+	presignDownload bool
+	presignUpload   bool
+	presignExpire   time.Duration
+	// 按 blob ID 分段加锁，避免同一个 blob 同时被引用和删除
+	blobLocks  [64]sync.Mutex
+	scrubState scrubState
+	// 按标签或日志组匹配的保留策略，没有匹配的日志使用 maxLifeOfHour
+	retentionRules []*config.RetentionRule
+	retentionState retentionState
 }
 
 type RcpCoreApi struct {
 	core *CoreApi
 }
 
-func (c *CoreApi) CreateFileId(md5 string) string {
+// CreateFileId 每条日志记录有单独的文件 ID，内容相同的日志共用同一个 blob
+func (c *CoreApi) CreateFileId() string {
+	return fmt.Sprintf("%s.%s", c.addressManager.GetSelfMachineID(), strings.ReplaceAll(uuid.New().String(), "-", ""))
+}
+
+// CreateBlobId blob ID 由文件内容的 MD5 得到
+func (c *CoreApi) CreateBlobId(md5 string) string {
 	return fmt.Sprintf("%s.%s", c.addressManager.GetSelfMachineID(), md5)
 }
 
+func (c *CoreApi) lockBlob(blobId string) func() {
+	hash := fnv.New32a()
+	hash.Write([]byte(blobId))
+	mutex := &c.blobLocks[hash.Sum32()%uint32(len(c.blobLocks))]
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// saveBlob 增加 blob 的引用并保存文件内容，内容相同的文件只保存一份，返回 blob ID
+func (c *CoreApi) saveBlob(file *storage.LogFile, spool *storage.SpoolFile) (string, error) {
+	blobId := c.CreateBlobId(spool.MD5)
+	unlock := c.lockBlob(blobId)
+	defer unlock()
+
+	encoding := storage.SaveEncoding(c.storage)
+	blob := &data.Blob{BlobId: blobId, Size: spool.Size, Encoding: &encoding}
+	existed, err := c.data.AcquireBlob(blob)
+	if errors.Is(err, data.ErrBlobDeleting) {
+		// 内容相同的 blob 正在被删除，这次不去重，和直接上传一样使用文件 ID 作为 blob ID
+		blobId = file.FileId
+		blob = &data.Blob{BlobId: blobId, Size: spool.Size, Encoding: &encoding}
+		existed, err = c.data.AcquireBlob(blob)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// blob 已存在时文件通常也存在，SaveLog 会跳过已存在的文件；新创建的 blob 总是重新上传
+	err = c.blobStorage(blob).SaveLog(&storage.LogFile{
+		Name:      file.Name,
+		FileId:    blobId,
+		Size:      file.Size,
+		Tags:      file.Tags,
+		Overwrite: !existed,
+		FileSteam: spool,
+	})
+	if err != nil {
+		released, releaseErr := c.data.ReleaseBlob(blobId)
+		if releaseErr == nil && released != nil {
+			releaseErr = c.blobStorage(released).RemoveLog(blobId)
+		}
+		if releaseErr != nil {
+			log.Errorf("release blob %s error %s", blobId, releaseErr.Error())
+		}
+		return "", err
+	}
+
+	file.Dedupe = existed
+	return blobId, nil
+}
+
+// releaseBlob 释放 blob 的引用，没有引用时从存储删除
+func (c *CoreApi) releaseBlob(blobId string) error {
+	unlock := c.lockBlob(blobId)
+	defer unlock()
+
+	released, err := c.data.ReleaseBlob(blobId)
+	if err != nil || released == nil {
+		return err
+	}
+
+	return c.blobStorage(released).RemoveLog(blobId)
+}
+
+// blobStorage 按 blob 记录的编码读写文件，没有记录时由存储探测
+func (c *CoreApi) blobStorage(blob *data.Blob) storage.StorageApi {
+	if blob == nil {
+		return c.storage
+	}
+
+	return storage.WithEncoding(c.storage, blob.Encoding)
+}
+
+func (c *CoreApi) findBlobStorage(blobId string) (storage.StorageApi, error) {
+	blob, err := c.data.FindBlob(blobId)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.blobStorage(blob), nil
+}
+
+// blobEncoding 返回文件保存的压缩编码，没有记录编码的历史文件需要查询存储
+func (c *CoreApi) blobEncoding(blobId string) (string, error) {
+	blob, err := c.data.FindBlob(blobId)
+	if err != nil {
+		return "", err
+	}
+
+	if blob != nil && blob.Encoding != nil {
+		return *blob.Encoding, nil
+	}
+
+	logFile, err := storage.StatLog(c.blobStorage(blob), blobId)
+	if err != nil {
+		return "", err
+	}
+
+	return logFile.Encoding, nil
+}
+
 func (c *CoreApi) IsSelfMachine(machineId string) bool {
 	return c.addressManager.GetSelfMachineID() == machineId
 }
 
+// CanServeLocally 文件可以由当前节点直接处理，共享元数据模式下任意节点都能访问所有文件
+func (c *CoreApi) CanServeLocally(machineId string) bool {
+	return c.sharedMetadata || c.IsSelfMachine(machineId)
+}
+
 func (c *CoreApi) GetMachineIdByFileName(name string) (string, error) {
 	names := strings.Split(name, ".")
 	if len(names) != 2 {
@@ -60,10 +192,40 @@ func (e *EmptyReaderClose) Close() error {
 	return nil
 }
 
+// spoolFile 把上传内容写入临时文件，同时得到文件 ID 和大小，调用方负责关闭返回的文件
+func (c *CoreApi) spoolFile(file *storage.LogFile, maxSize int64) (*storage.SpoolFile, error) {
+	if file.FileSteam == nil {
+		return nil, fmt.Errorf("upload file is empty")
+	}
+
+	spool, err := storage.NewSpoolFile(file.FileSteam, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	file.FileId = c.CreateFileId()
+	file.Size = spool.Size
+	file.FileSteam = spool
+	return spool, nil
+}
+
 func (c *CoreApi) CreateFile(file *storage.LogFile) (*storage.LogFile, error) {
-	file.FileId = c.CreateFileId(util.MD5(file.UpdateFile))
+	return c.createFile(file, c.maxUploadSize)
+}
+
+// CreateJsonFile /jsonLog/upload 上传的日志，使用 maxJsonUploadSizeOfMB 限制大小
+func (c *CoreApi) CreateJsonFile(file *storage.LogFile) (*storage.LogFile, error) {
+	return c.createFile(file, c.maxJsonUploadSize)
+}
+
+func (c *CoreApi) createFile(file *storage.LogFile, maxSize int64) (*storage.LogFile, error) {
+	spool, err := c.spoolFile(file, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	defer spool.Close()
 
-	err := c.storage.SaveLog(file)
+	blobId, err := c.saveBlob(file, spool)
 	if err != nil {
 		return file, err
 	}
@@ -82,12 +244,14 @@ func (c *CoreApi) CreateFile(file *storage.LogFile) (*storage.LogFile, error) {
 		},
 		Tags:   ts,
 		FileId: file.FileId,
+		BlobId: blobId,
 		Status: data.Saved,
 		Size:   file.Size,
 		Name:   file.Name,
 	})
 
 	if err != nil {
+		c.releaseBlobOnError(blobId)
 		return nil, err
 	}
 
@@ -95,9 +259,13 @@ func (c *CoreApi) CreateFile(file *storage.LogFile) (*storage.LogFile, error) {
 }
 
 func (c *CoreApi) CreateLogGroupFile(file *storage.LogGroupFile) (*storage.LogGroupFile, error) {
-	file.FileId = c.CreateFileId(util.MD5(file.UpdateFile))
+	spool, err := c.spoolFile(&file.LogFile, c.maxUploadSize)
+	if err != nil {
+		return nil, err
+	}
+	defer spool.Close()
 
-	err := c.storage.SaveLog(&file.LogFile)
+	blobId, err := c.saveBlob(&file.LogFile, spool)
 	if err != nil {
 		return file, err
 	}
@@ -117,6 +285,7 @@ func (c *CoreApi) CreateLogGroupFile(file *storage.LogGroupFile) (*storage.LogGr
 		},
 		Tags:   ts,
 		FileId: file.FileId,
+		BlobId: blobId,
 		Status: data.Saved,
 		Size:   file.Size,
 		Name:   file.Name,
@@ -124,6 +293,7 @@ func (c *CoreApi) CreateLogGroupFile(file *storage.LogGroupFile) (*storage.LogGr
 
 	logGroup, err := c.data.FindLogGroup(file.GroupId)
 	if err != nil {
+		c.releaseBlobOnError(blobId)
 		return nil, err
 	}
 
@@ -140,6 +310,9 @@ func (c *CoreApi) CreateLogGroupFile(file *storage.LogGroupFile) (*storage.LogGr
 			Name:    file.Name,
 		}
 		err = c.data.CreateLogGroup(logGroup)
+		if err != nil {
+			c.releaseBlobOnError(blobId)
+		}
 		return file, err
 	}
 
@@ -149,13 +322,33 @@ func (c *CoreApi) CreateLogGroupFile(file *storage.LogGroupFile) (*storage.LogGr
 	err = c.data.UpdateLogGroup(logGroup)
 
 	if err != nil {
+		c.releaseBlobOnError(blobId)
 		return nil, err
 	}
 
 	return file, err
 }
 
+// GetGroupHomeMachine 日志组的归属节点，同一个组的文件都上传到该节点
+func (c *CoreApi) GetGroupHomeMachine(groupId string) string {
+	if c.sharedMetadata {
+		return c.addressManager.GetSelfMachineID()
+	}
+
+	return c.addressManager.GetHomeMachineID(groupId)
+}
+
+// DeleteLogGroup 删除所有节点上的同名日志组，兼容历史上分散在多个节点的组
+// 单个节点失败时继续删除其它节点，最后返回失败的节点
 func (c *CoreApi) DeleteLogGroup(groupId string) error {
+	if c.sharedMetadata {
+		return c.deleteLocalLogGroup(groupId)
+	}
+
+	return rpc.CallEachClient(c.rpcManager, context.Background(), "CoreApi.DeleteLogGroup", &GroupRequest{GroupId: groupId}, &GroupResponse{})
+}
+
+func (c *CoreApi) deleteLocalLogGroup(groupId string) error {
 	logGroup, err := c.data.FindLogGroup(groupId)
 	if err != nil {
 		return err
@@ -165,13 +358,20 @@ func (c *CoreApi) DeleteLogGroup(groupId string) error {
 		return nil
 	}
 
-	for _, log := range logGroup.Logs {
-		err := c.DeleteFile(log.FileId)
+	// 有文件删除失败时保留日志组，重新删除时只处理剩余的文件
+	errs := []error{}
+	for _, l := range logGroup.Logs {
+		err := c.deleteLog(l)
 		if err != nil {
-			return err
+			log.Errorf("delete file %s of group %s error %s", l.FileId, groupId, err.Error())
+			errs = append(errs, fmt.Errorf("delete file %s error %w", l.FileId, err))
 		}
 	}
 
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
 	return c.data.DeleteLogGroupByGroupId(groupId)
 }
 
@@ -183,68 +383,197 @@ func (c *CoreApi) getFileGroupList(query *data.FileListQuery) (*data.Page[*data.
 	return c.data.FindLogGroups(query)
 }
 
+// newPageFetchers 为每个节点生成分页拉取函数，用于全局归并分页
+func newPageFetchers[T data.OrderData](c *CoreApi, method string) []data.PageFetcher[T] {
+	fetchers := make([]data.PageFetcher[T], 0)
+	for _, client := range c.rpcManager.GetRpcList() {
+		client := client
+		fetchers = append(fetchers, func(ctx context.Context, query *data.FileListQuery) (*data.Page[T], error) {
+			res := &data.Page[T]{}
+			err := client.Call(ctx, method, query, res)
+			return res, err
+		})
+	}
+
+	return fetchers
+}
+
 func (c *CoreApi) GetLogGroupList(query *data.FileListQuery) (*data.Page[*data.LogGroup], error) {
-	res := &data.Page[*data.LogGroup]{}
-	err := rpc.CallAllClient(c.rpcManager, context.Background(), "CoreApi.FindLogGroups", query, res)
+	if c.sharedMetadata {
+		return c.getFileGroupList(query)
+	}
 
-	if err != nil {
+	return data.MergePages(context.Background(), query, newPageFetchers[*data.LogGroup](c, "CoreApi.FindLogGroups"))
+}
+
+// ListFilesInGroup 合并所有节点上该组的文件，部分节点失败时返回其它节点的文件和 rpc.PartialError
+func (c *CoreApi) ListFilesInGroup(groupId string) ([]*data.LogData, error) {
+	if c.sharedMetadata {
+		return c.listLocalFilesInGroup(groupId)
+	}
+
+	res := &GroupResponse{Logs: []*data.LogData{}}
+	err := rpc.CallEachClient(c.rpcManager, context.Background(), "CoreApi.ListFilesInGroup", &GroupRequest{GroupId: groupId}, res)
+	partialErr := &rpc.PartialError{}
+	if err != nil && !errors.As(err, &partialErr) {
 		return nil, err
 	}
 
-	res.Desc()
-	return res, nil
+	sort.SliceStable(res.Logs, func(i, j int) bool {
+		return res.Logs[i].CreatedAt.Before(res.Logs[j].CreatedAt)
+	})
+
+	return res.Logs, err
 }
 
-func (c *CoreApi) ListFilesInGroup(groupId string) ([]*data.LogData, error) {
+func (c *CoreApi) listLocalFilesInGroup(groupId string) ([]*data.LogData, error) {
 	logGroup, err := c.data.FindLogGroup(groupId)
 	if err != nil {
 		return nil, err
 	}
 
+	if logGroup == nil {
+		return []*data.LogData{}, nil
+	}
+
 	return logGroup.Logs, nil
 }
 
 func (c *CoreApi) GetFileList(query *data.FileListQuery) (*data.Page[*data.LogData], error) {
-	res := &data.Page[*data.LogData]{}
-	err := rpc.CallAllClient(c.rpcManager, context.Background(), "CoreApi.FindLogs", query, res)
+	if c.sharedMetadata {
+		return c.getFileList(query)
+	}
 
+	res, err := data.MergePages(context.Background(), query, newPageFetchers[*data.LogData](c, "CoreApi.FindLogs"))
 	if err != nil {
 		return nil, err
 	}
 
-	res.Desc()
 	res.UniqData()
 	return res, nil
 }
 
-func (c *CoreApi) GetFile(fileId string) (*storage.LogFile, error) {
+// ErrFileNotFound 没有这个文件的记录
+var ErrFileNotFound = errors.New("file not found")
+
+// GetFile 读取本机保存的文件，opts 为空时返回整个文件
+func (c *CoreApi) GetFile(fileId string, opts *FileReadOptions) (*storage.LogFile, error) {
 	fileData, err := c.data.FindLogByFileId(fileId)
 	if err != nil {
 		return nil, err
 	}
 	if fileData == nil {
-		return nil, fmt.Errorf("file %s not found", fileId)
+		return nil, fmt.Errorf("%w, file id %s", ErrFileNotFound, fileId)
 	}
 
-	logFile, err := c.storage.GetLog(fileId)
+	etag := fileETag(fileData)
+	if opts.notModified(etag, fileData.CreatedAt) {
+		// 不读取内容，但 304 的 ETag 取决于返回压缩还是未压缩的内容
+		encoding, err := c.blobEncoding(fileData.GetBlobId())
+		if err != nil {
+			return nil, err
+		}
+
+		return &storage.LogFile{
+			FileId:      fileId,
+			Name:        fileData.Name,
+			Size:        fileData.Size,
+			ETag:        etag,
+			ModTime:     fileData.CreatedAt,
+			Encoding:    encoding,
+			NotModified: true,
+			FileSteam:   &EmptyReaderClose{reader: strings.NewReader("")},
+		}, nil
+	}
+
+	st, err := c.findBlobStorage(fileData.GetBlobId())
+	if err != nil {
+		return nil, err
+	}
+
+	var byteRange *storage.ByteRange
+	rangeGetter, ok := st.(storage.RangeGetter)
+	if ok && opts.rangeApplies(etag, fileData.CreatedAt) {
+		byteRange, err = storage.ParseRange(opts.Range, fileData.Size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var logFile *storage.LogFile
+	if byteRange != nil {
+		logFile, err = rangeGetter.GetLogRange(fileData.GetBlobId(), byteRange)
+	} else {
+		logFile, err = st.GetLog(fileData.GetBlobId())
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	logFile.FileId = fileId
 	logFile.Name = fileData.Name
+	logFile.ETag = etag
+	logFile.ModTime = fileData.CreatedAt
+	logFile.Range = byteRange
+	if logFile.Encoding != storage.EncodingIdentity || byteRange != nil {
+		// 压缩保存的文件和部分内容，数据库里记录的是原始大小
+		logFile.Size = fileData.Size
+	}
+
 	return logFile, nil
 }
 
 func (c *CoreApi) DeleteFile(fileId string) error {
-	err := c.storage.RemoveLog(fileId)
+	logs, err := c.data.FindLogsByFileId(fileId)
 	if err != nil {
 		return err
 	}
 
-	return c.data.DeleteLogByFileId(fileId)
+	errs := []error{}
+	for _, l := range logs {
+		err := c.deleteLog(l)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// deleteLog 删除日志记录，blob 没有其它日志引用时同时删除文件
+func (c *CoreApi) deleteLog(l *data.LogData) error {
+	blobId := l.GetBlobId()
+	unlock := c.lockBlob(blobId)
+	defer unlock()
+
+	released, err := c.data.DeleteLog(l)
+	if err != nil || released == nil {
+		return err
+	}
+
+	return c.blobStorage(released).RemoveLog(blobId)
+}
+
+func (c *CoreApi) releaseBlobOnError(blobId string) {
+	err := c.releaseBlob(blobId)
+	if err != nil {
+		log.Errorf("release blob %s error %s", blobId, err.Error())
+	}
 }
 
-func (c *CoreApi) CleanFileByTime() error {
+// CleanFileByTime 没有配置保留策略时所有日志都按全局配置清理
+func (c *CoreApi) CleanFileByTime(report *RetentionRuleReport) error {
+	var err error
+	report.MatchedLogs, err = c.data.CountLogs()
+	if err != nil {
+		return err
+	}
+
+	report.MatchedSize, err = c.data.CountLogsSize()
+	if err != nil {
+		return err
+	}
+
 	before := time.Now().Add(-time.Duration(c.maxLifeOfHour) * time.Hour)
 	logs, err := c.data.FindTimeoutLogs(before, 1000)
 	if err != nil {
@@ -257,22 +586,24 @@ func (c *CoreApi) CleanFileByTime() error {
 
 	log.Infof("clean file by time %d file timeout before %s", len(logs), before.String())
 	for _, l := range logs {
-		err := c.DeleteFile(l.FileId)
-		if err != nil {
-			log.Errorf("delete file %s error %s", l.FileId, err.Error())
-		}
-		log.Infof("clean file %s name %s by time createdAt %s", l.FileId, l.Name, l.CreatedAt.String())
+		c.cleanLog(l, report, false)
 	}
 
 	return nil
 }
 
-func (c *CoreApi) CleanFileBySize() error {
+func (c *CoreApi) CleanFileBySize(report *RetentionRuleReport) error {
 	size, err := c.data.CountLogsSize()
 	if err != nil {
 		return err
 	}
 
+	report.MatchedSize = size
+	report.MatchedLogs, err = c.data.CountLogs()
+	if err != nil {
+		return err
+	}
+
 	if size < c.maxSizeOfByte {
 		return nil
 	}
@@ -290,29 +621,45 @@ func (c *CoreApi) CleanFileBySize() error {
 			return nil
 		}
 
-		err := c.DeleteFile(l.FileId)
-		if err != nil {
-			log.Errorf("delete file %s error %s", l.FileId, err.Error())
-		} else {
+		if c.cleanLog(l, report, true) {
 			deleteSize = deleteSize - l.Size
-			log.Infof("clean file %s name %s by size", l.FileId, l.Name)
 		}
-
 	}
 
 	return nil
 }
 
+// CleanFile 先按保留策略清理，所有日志仍然超过 maxLogFileSizeOfMB 时再从最早的日志开始删除
 func (c *CoreApi) CleanFile() error {
-	err := c.CleanFileBySize()
+	report := c.newRetentionReport()
+	errs := []error{}
+	if len(c.retentionRules) > 0 {
+		err := c.CleanFileByRules(report)
+		if err != nil {
+			errs = append(errs, err)
+			log.Errorf("clean file by rules error %s", err.Error())
+		}
+	} else {
+		err := c.CleanFileByTime(report.Default)
+		if err != nil {
+			errs = append(errs, err)
+			log.Errorf("clean file by time error %s", err.Error())
+		}
+	}
+
+	err := c.CleanFileBySize(report.TotalSize)
 	if err != nil {
+		errs = append(errs, err)
 		log.Errorf("clean file by size error %s", err.Error())
 	}
-	err = c.CleanFileByTime()
-	if err != nil {
-		log.Errorf("clean file by time error %s", err.Error())
+
+	if err := errors.Join(errs...); err != nil {
+		report.Error = err.Error()
 	}
 
+	report.FinishedAt = time.Now()
+	report.logDeleted()
+	c.setRetentionReport(report)
 	return nil
 }
 
@@ -321,22 +668,75 @@ func NewCore(config *config.Config, storage storage.StorageApi, taskManager *tas
 
 	maxLifeOfHour := config.GetMaxLogLifeTimeOfHour()
 
+	uploads, err := upload.NewSessionManager(config.GetUploadSessionDir(), config.GetUploadSessionExpire())
+	if err != nil {
+		return nil, err
+	}
+
 	coreApi := &CoreApi{
-		storage:        storage,
-		rpcManager:     rpcManager,
-		data:           data,
-		addressManager: addressManager,
-		maxSizeOfByte:  maxLogFileSizeOfMb * 1024 * 1024,
-		maxLifeOfHour:  maxLifeOfHour,
-	}
-	if !config.IsRemoteStorage() {
-		err := taskManager.AddTask(task.NewTask("clean_file", 10*time.Minute, coreApi.CleanFile))
+		uploads:           uploads,
+		storage:           storage,
+		rpcManager:        rpcManager,
+		data:              data,
+		addressManager:    addressManager,
+		maxSizeOfByte:     maxLogFileSizeOfMb * 1024 * 1024,
+		maxLifeOfHour:     maxLifeOfHour,
+		maxUploadSize:     config.GetMaxUploadSizeOfMB() * 1024 * 1024,
+		maxJsonUploadSize: config.GetMaxJsonUploadSizeOfMB() * 1024 * 1024,
+		sharedMetadata:    config.IsSharedMetadata(),
+		remoteStorage:     config.IsRemoteStorage(),
+		presignDownload:   config.StorageConfig.IsPresignedDownload(),
+		presignUpload:     config.StorageConfig.IsPresignedUpload(),
+		presignExpire:     config.StorageConfig.GetPresignExpire(),
+		retentionRules:    config.RetentionRules,
+	}
+	// S3 上的日志默认由存储桶的生命周期规则清理，配置了保留策略时同样由节点按策略清理
+	if !config.IsRemoteStorage() || len(config.RetentionRules) > 0 {
+		// 共享元数据时清理的是整个集群的数据，只由主节点执行
+		scope := task.ScopeEveryNode
+		if coreApi.sharedMetadata {
+			scope = task.ScopeLeaderOnly
+		}
+
+		err := taskManager.AddTask(task.NewScopeTask("clean_file", 10*time.Minute, scope, coreApi.CleanFile))
 		if err != nil {
 			log.Errorf("add clean file task error %s", err.Error())
 		}
 	}
 
-	return coreApi, rpcManager.Regist("CoreApi", NewRpcCore(coreApi))
+	if coreApi.presignUpload {
+		scope := task.ScopeEveryNode
+		if coreApi.sharedMetadata {
+			scope = task.ScopeLeaderOnly
+		}
+
+		err := taskManager.AddTask(task.NewScopeTask("clean_pending_upload", 10*time.Minute, scope, coreApi.CleanPendingUpload))
+		if err != nil {
+			log.Errorf("add clean pending upload task error %s", err.Error())
+		}
+	}
+
+	// 共享元数据时检查的是整个集群的数据，只由主节点执行
+	scrubScope := task.ScopeEveryNode
+	if coreApi.sharedMetadata {
+		scrubScope = task.ScopeLeaderOnly
+	}
+
+	scrub := config.ScrubConfig
+	err = taskManager.AddTask(task.NewScopeTask("scrub_storage", scrub.GetInterval(), scrubScope, coreApi.scrubTask(scrub.IsRepair(), scrub.IsDeep())))
+	if err != nil {
+		log.Errorf("add scrub storage task error %s", err.Error())
+	}
+
+	err = taskManager.AddTask(task.NewTask("clean_upload_session", 10*time.Minute, uploads.CleanExpired))
+	if err != nil {
+		log.Errorf("add clean upload session task error %s", err.Error())
+	}
+
+	rpcManager.RegistStream(blobLogPath, http.HandlerFunc(coreApi.serveBlobLog))
+	rpcManager.RegistStream(blobGroupUploadPath, http.HandlerFunc(coreApi.serveBlobGroupUpload))
+	rpcManager.RegistStream(blobUploadPath, http.HandlerFunc(coreApi.serveBlobUpload))
+	return coreApi, rpcManager.Regist("CoreApi", NewRpcCore(coreApi), "FindLogs", "FindLogGroups", "ListFilesInGroup", "PresignFile", "GetScrubReport", "GetRetentionReport")
 }
 
 func NewRpcCore(coreApi *CoreApi) *RcpCoreApi {
@@ -364,3 +764,39 @@ func (r *RcpCoreApi) FindLogGroups(_ *http.Request, req *data.FileListQuery, res
 	res.Total = page.Total
 	return nil
 }
+
+type GroupRequest struct {
+	GroupId string
+}
+
+type GroupResponse struct {
+	Logs []*data.LogData
+}
+
+func (g *GroupResponse) Merge(result rpc.MergeResult) error {
+	res, ok := result.(*GroupResponse)
+	if !ok {
+		return fmt.Errorf("type error")
+	}
+
+	g.Logs = append(g.Logs, res.Logs...)
+	return nil
+}
+
+func (g *GroupResponse) New() rpc.MergeResult {
+	return &GroupResponse{}
+}
+
+func (r *RcpCoreApi) ListFilesInGroup(_ *http.Request, req *GroupRequest, res *GroupResponse) error {
+	logs, err := r.core.listLocalFilesInGroup(req.GroupId)
+	if err != nil {
+		return err
+	}
+
+	res.Logs = logs
+	return nil
+}
+
+func (r *RcpCoreApi) DeleteLogGroup(_ *http.Request, req *GroupRequest, res *GroupResponse) error {
+	return r.core.deleteLocalLogGroup(req.GroupId)
+}
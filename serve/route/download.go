@@ -0,0 +1,277 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/warjiang/page-spy-api/data"
+	"github.com/warjiang/page-spy-api/rpc"
+	"github.com/warjiang/page-spy-api/storage"
+)
+
+const (
+	headerFileETag        = "X-File-ETag"
+	headerFileModified    = "X-File-Modified"
+	headerFileNotModified = "X-File-Not-Modified"
+	headerFileRange       = "X-File-Range"
+)
+
+// FileReadOptions 下载时的范围和条件请求头，由保存文件的节点判断
+type FileReadOptions struct {
+	Range           string
+	IfRange         string
+	IfNoneMatch     string
+	IfModifiedSince string
+}
+
+func newFileReadOptions(header http.Header) *FileReadOptions {
+	return &FileReadOptions{
+		Range:           header.Get("Range"),
+		IfRange:         header.Get("If-Range"),
+		IfNoneMatch:     header.Get("If-None-Match"),
+		IfModifiedSince: header.Get("If-Modified-Since"),
+	}
+}
+
+// RPC 流式读取不能传递请求头，通过查询参数转发
+func (o *FileReadOptions) encode(query url.Values) {
+	if o == nil {
+		return
+	}
+
+	for key, value := range map[string]string{
+		"range":           o.Range,
+		"ifRange":         o.IfRange,
+		"ifNoneMatch":     o.IfNoneMatch,
+		"ifModifiedSince": o.IfModifiedSince,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+}
+
+func decodeFileReadOptions(query url.Values) *FileReadOptions {
+	return &FileReadOptions{
+		Range:           query.Get("range"),
+		IfRange:         query.Get("ifRange"),
+		IfNoneMatch:     query.Get("ifNoneMatch"),
+		IfModifiedSince: query.Get("ifModifiedSince"),
+	}
+}
+
+// notModified If-None-Match 存在时忽略 If-Modified-Since
+func (o *FileReadOptions) notModified(etag string, modTime time.Time) bool {
+	if o == nil {
+		return false
+	}
+
+	if o.IfNoneMatch != "" {
+		return etagMatch(o.IfNoneMatch, etag)
+	}
+
+	if o.IfModifiedSince != "" {
+		since, err := http.ParseTime(o.IfModifiedSince)
+		return err == nil && !modTime.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// rangeApplies If-Range 和当前文件一致时才返回部分内容，否则返回整个文件
+// 部分内容总是未压缩的，只和不带压缩编码的强 ETag 比较
+func (o *FileReadOptions) rangeApplies(etag string, modTime time.Time) bool {
+	if o == nil || o.Range == "" {
+		return false
+	}
+
+	ifRange := strings.TrimSpace(o.IfRange)
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, "W/") {
+		return false
+	}
+
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == quoteETag(etag)
+	}
+
+	date, err := http.ParseTime(ifRange)
+	return err == nil && modTime.Truncate(time.Second).Equal(date)
+}
+
+// fileETag blob ID 去掉机器前缀，内容去重的 blob ID 是内容的 MD5，其它 blob ID 随机生成且内容不会改变，同样可以作为强校验值
+func fileETag(l *data.LogData) string {
+	blobId := l.GetBlobId()
+	_, hash, found := strings.Cut(blobId, ".")
+	if !found {
+		return blobId
+	}
+
+	return hash
+}
+
+func quoteETag(etag string) string {
+	return `"` + etag + `"`
+}
+
+// encodedETag 压缩返回的内容和原始内容不同，ETag 加上压缩编码区分
+func encodedETag(etag string, encoding string) string {
+	if encoding == storage.EncodingIdentity {
+		return quoteETag(etag)
+	}
+
+	return quoteETag(etag + "-" + encoding)
+}
+
+// etagMatch If-None-Match 使用弱比较，压缩和未压缩的内容视为同一个文件
+func etagMatch(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+
+		tag = strings.Trim(strings.TrimPrefix(tag, "W/"), `"`)
+		for _, encoding := range []string{storage.EncodingGzip, storage.EncodingZstd} {
+			tag = strings.TrimSuffix(tag, "-"+encoding)
+		}
+
+		if tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isFileNotFound 没有文件记录或者存储中没有文件，包括其它节点返回的 404
+func isFileNotFound(err error) bool {
+	if errors.Is(err, ErrFileNotFound) || errors.Is(err, storage.ErrLogNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+
+	streamErr := &rpc.StreamError{}
+	return errors.As(err, &streamErr) && streamErr.StatusCode == http.StatusNotFound
+}
+
+// rangeNotSatisfiableSize 范围超出文件大小时返回文件大小，转发的请求从响应头读取，大小未知时返回 -1
+func rangeNotSatisfiableSize(err error) (int64, bool) {
+	rangeErr := &storage.RangeNotSatisfiableError{}
+	if errors.As(err, &rangeErr) {
+		return rangeErr.Size, true
+	}
+
+	streamErr := &rpc.StreamError{}
+	if !errors.As(err, &streamErr) || streamErr.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		return 0, false
+	}
+
+	size, err := strconv.ParseInt(streamErr.Header.Get(headerFileSize), 10, 64)
+	if err != nil {
+		return -1, true
+	}
+
+	return size, true
+}
+
+// writeFileReadHeaders 保存文件的节点把校验值和范围通过响应头返回给转发请求的节点
+func writeFileReadHeaders(header http.Header, file *storage.LogFile) {
+	if file.ETag != "" {
+		header.Set(headerFileETag, file.ETag)
+	}
+
+	if !file.ModTime.IsZero() {
+		header.Set(headerFileModified, file.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	if file.NotModified {
+		header.Set(headerFileNotModified, "true")
+	}
+
+	if file.Range != nil {
+		header.Set(headerFileRange, fmt.Sprintf("%d-%d", file.Range.Start, file.Range.End()))
+		header.Set(headerFileSize, strconv.FormatInt(file.Size, 10))
+	}
+}
+
+func readFileReadHeaders(header http.Header, file *storage.LogFile) {
+	file.ETag = header.Get(headerFileETag)
+	file.ModTime, _ = http.ParseTime(header.Get(headerFileModified))
+	file.NotModified = header.Get(headerFileNotModified) == "true"
+
+	var start, end int64
+	_, err := fmt.Sscanf(header.Get(headerFileRange), "%d-%d", &start, &end)
+	if err == nil {
+		file.Range = &storage.ByteRange{Start: start, Length: end - start + 1}
+		file.Size, _ = strconv.ParseInt(header.Get(headerFileSize), 10, 64)
+	}
+}
+
+// writeDownload 返回下载的文件，支持条件请求和单个范围的部分内容
+func writeDownload(c echo.Context, file *storage.LogFile) error {
+	header := c.Response().Header()
+	header.Set("Content-Disposition", "attachment; filename="+file.Name)
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Accept-Ranges", "bytes")
+	if !file.ModTime.IsZero() {
+		header.Set("Last-Modified", file.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	// 客户端支持时直接返回压缩的内容，304 的 ETag 与完整响应选择的内容一致
+	encoding := storage.EncodingIdentity
+	if file.Encoding != storage.EncodingIdentity {
+		header.Add("Vary", "Accept-Encoding")
+		if storage.AcceptEncoding(c.Request().Header.Get("Accept-Encoding"), file.Encoding) {
+			encoding = file.Encoding
+		}
+	}
+
+	if file.NotModified {
+		if file.ETag != "" {
+			header.Set("ETag", encodedETag(file.ETag, encoding))
+		}
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	if file.Range != nil {
+		if file.ETag != "" {
+			header.Set("ETag", quoteETag(file.ETag))
+		}
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", file.Range.Start, file.Range.End(), file.Size))
+		header.Set("Content-Length", strconv.FormatInt(file.Range.Length, 10))
+		c.Response().WriteHeader(http.StatusPartialContent)
+		_, err := io.Copy(c.Response(), file.FileSteam)
+		return err
+	}
+
+	size := file.Size
+	if encoding != storage.EncodingIdentity {
+		header.Set("Content-Encoding", encoding)
+		size = file.EncodedSize
+	} else if err := file.Decode(); err != nil {
+		// 客户端不支持压缩编码时边读边解压
+		return err
+	}
+
+	if file.ETag != "" {
+		header.Set("ETag", encodedETag(file.ETag, encoding))
+	}
+
+	if size > 0 {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	_, err := io.Copy(c.Response().Writer, file.FileSteam)
+	return err
+}
@@ -0,0 +1,209 @@
+package route
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/warjiang/page-spy-api/data"
+	"github.com/warjiang/page-spy-api/rpc"
+)
+
+// RetentionRuleReport 一条保留策略在一次清理中匹配和删除的日志
+type RetentionRuleReport struct {
+	Name              string `json:"name"`
+	MaxLifeTimeOfHour int64  `json:"maxLifeTimeOfHour,omitempty"`
+	MaxSizeOfMB       int64  `json:"maxSizeOfMB,omitempty"`
+	MatchedLogs       int64  `json:"matchedLogs"`
+	MatchedSize       int64  `json:"matchedSize"`
+	DeletedByTime     int64  `json:"deletedByTime"`
+	DeletedBySize     int64  `json:"deletedBySize"`
+	DeletedSize       int64  `json:"deletedSize"`
+	Failed            int64  `json:"failed"`
+}
+
+func (r *RetentionRuleReport) deleted() int64 {
+	return r.DeletedByTime + r.DeletedBySize
+}
+
+// RetentionReport 一次清理的结果，每个节点清理自己的日志
+type RetentionReport struct {
+	MachineId  string                 `json:"machineId"`
+	StartedAt  time.Time              `json:"startedAt"`
+	FinishedAt time.Time              `json:"finishedAt"`
+	Error      string                 `json:"error,omitempty"`
+	Rules      []*RetentionRuleReport `json:"rules"`
+	// 没有匹配任何规则的日志按 maxLogLifeTimeOfHour 清理
+	Default *RetentionRuleReport `json:"default"`
+	// 所有日志超过 maxLogFileSizeOfMB 时从最早的日志开始删除，不区分规则
+	TotalSize *RetentionRuleReport `json:"totalSize"`
+}
+
+type retentionState struct {
+	lock sync.Mutex
+	last *RetentionReport
+}
+
+// GetRetentionReport 返回最近一次清理的结果，从未执行时返回 nil
+func (c *CoreApi) GetRetentionReport() *RetentionReport {
+	c.retentionState.lock.Lock()
+	defer c.retentionState.lock.Unlock()
+
+	return c.retentionState.last
+}
+
+func (c *CoreApi) setRetentionReport(report *RetentionReport) {
+	c.retentionState.lock.Lock()
+	defer c.retentionState.lock.Unlock()
+
+	c.retentionState.last = report
+}
+
+func (c *CoreApi) newRetentionReport() *RetentionReport {
+	report := &RetentionReport{
+		MachineId: c.addressManager.GetSelfMachineID(),
+		StartedAt: time.Now(),
+		Rules:     []*RetentionRuleReport{},
+		Default: &RetentionRuleReport{
+			Name:              "default",
+			MaxLifeTimeOfHour: c.maxLifeOfHour,
+		},
+		TotalSize: &RetentionRuleReport{
+			Name:        "totalSize",
+			MaxSizeOfMB: c.maxSizeOfByte / (1024 * 1024),
+		},
+	}
+
+	for _, rule := range c.retentionRules {
+		report.Rules = append(report.Rules, &RetentionRuleReport{
+			Name:              rule.Name,
+			MaxLifeTimeOfHour: rule.GetMaxLogLifeTimeOfHour(c.maxLifeOfHour),
+			MaxSizeOfMB:       rule.GetMaxLogFileSizeOfMB(),
+		})
+	}
+
+	return report
+}
+
+// cleanLog 删除日志并记录到规则的报告中，返回是否删除成功
+func (c *CoreApi) cleanLog(l *data.LogData, report *RetentionRuleReport, bySize bool) bool {
+	err := c.deleteLog(l)
+	if err != nil {
+		report.Failed++
+		log.Errorf("delete file %s error %s", l.FileId, err.Error())
+		return false
+	}
+
+	reason := "time"
+	if bySize {
+		reason = "size"
+		report.DeletedBySize++
+	} else {
+		report.DeletedByTime++
+	}
+
+	report.DeletedSize += l.Size
+	log.Infof("clean file %s name %s by %s of rule %s createdAt %s", l.FileId, l.Name, reason, report.Name, l.CreatedAt.String())
+	return true
+}
+
+// CleanFileByRules 按顺序匹配保留策略，每条规则在数据库中筛选日志，没有匹配任何规则的日志按全局配置清理
+func (c *CoreApi) CleanFileByRules(report *RetentionReport) error {
+	errs := []error{}
+	for i, ruleReport := range report.Rules {
+		errs = append(errs, c.applyRetention(i, ruleReport))
+	}
+
+	errs = append(errs, c.applyRetention(len(c.retentionRules), report.Default))
+	return errors.Join(errs...)
+}
+
+// applyRetention 从最早的日志开始删除超过保留时间的日志，剩余日志超过规则的大小限制时继续删除，直到遇到不需要删除的日志
+func (c *CoreApi) applyRetention(index int, report *RetentionRuleReport) error {
+	stat, err := c.data.CountRetentionLogs(c.retentionRules, index)
+	if err != nil {
+		return fmt.Errorf("count logs of rule %s error %w", report.Name, err)
+	}
+
+	report.MatchedLogs = stat.Count
+	report.MatchedSize = stat.Size
+
+	before := time.Now().Add(-time.Duration(report.MaxLifeTimeOfHour) * time.Hour)
+	maxSize := report.MaxSizeOfMB * 1024 * 1024
+	remaining := stat.Size
+	var last *data.LogData
+	for {
+		logs, err := c.data.FindRetentionLogsAfter(c.retentionRules, index, last, 1000)
+		if err != nil {
+			return fmt.Errorf("find logs of rule %s error %w", report.Name, err)
+		}
+
+		for _, l := range logs {
+			expired := l.CreatedAt.Before(before)
+			if !expired && (maxSize <= 0 || remaining <= maxSize) {
+				return nil
+			}
+
+			if c.cleanLog(l, report, !expired) {
+				remaining -= l.Size
+			}
+		}
+
+		if len(logs) < 1000 {
+			return nil
+		}
+
+		last = logs[len(logs)-1]
+	}
+}
+
+func (r *RetentionReport) logDeleted() {
+	for _, ruleReport := range append(append([]*RetentionRuleReport{}, r.Rules...), r.Default, r.TotalSize) {
+		if ruleReport.deleted() == 0 && ruleReport.Failed == 0 {
+			continue
+		}
+
+		log.Infof("retention rule %s deleted %d files by time and %d files by size, %dmb, %d failed",
+			ruleReport.Name, ruleReport.DeletedByTime, ruleReport.DeletedBySize, ruleReport.DeletedSize/(1024*1024), ruleReport.Failed)
+	}
+}
+
+type RetentionRequest struct {
+}
+
+type RetentionResponse struct {
+	Reports []*RetentionReport
+}
+
+func (r *RetentionResponse) Merge(result rpc.MergeResult) error {
+	res, ok := result.(*RetentionResponse)
+	if !ok {
+		return fmt.Errorf("type error")
+	}
+
+	r.Reports = append(r.Reports, res.Reports...)
+	return nil
+}
+
+func (r *RetentionResponse) New() rpc.MergeResult {
+	return &RetentionResponse{}
+}
+
+// GetClusterRetentionReports 共享元数据时只有主节点执行清理，同样查询所有节点
+func (c *CoreApi) GetClusterRetentionReports(ctx context.Context) ([]*RetentionReport, error) {
+	res := &RetentionResponse{}
+	err := rpc.CallAllClient(c.rpcManager, ctx, "CoreApi.GetRetentionReport", &RetentionRequest{}, res)
+	return res.Reports, err
+}
+
+func (r *RcpCoreApi) GetRetentionReport(_ *http.Request, _ *RetentionRequest, res *RetentionResponse) error {
+	res.Reports = []*RetentionReport{}
+	if report := r.core.GetRetentionReport(); report != nil {
+		res.Reports = append(res.Reports, report)
+	}
+
+	return nil
+}
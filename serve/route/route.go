@@ -1,8 +1,8 @@
 package route
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"net/http"
 	"net/url"
@@ -12,12 +12,13 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/warjiang/page-spy-api/config"
 	"github.com/warjiang/page-spy-api/data"
-	"github.com/warjiang/page-spy-api/proxy"
+	"github.com/warjiang/page-spy-api/rpc"
 	"github.com/warjiang/page-spy-api/serve/common"
 	selfMiddleware "github.com/warjiang/page-spy-api/serve/middleware"
 	"github.com/warjiang/page-spy-api/serve/socket"
 	"github.com/warjiang/page-spy-api/static"
 	"github.com/warjiang/page-spy-api/storage"
+	"github.com/warjiang/page-spy-api/upload"
 )
 
 var blackTagName = []string{"page", "size", "from", "to"}
@@ -92,8 +93,9 @@ func getQueryList(c echo.Context) (*data.FileListQuery, error) {
 	return query, nil
 }
 
-func NewEcho(socket *socket.WebSocket, core *CoreApi, config *config.Config, proxyManager *proxy.ProxyManager, staticConfig *config.StaticConfig) *echo.Echo {
+func NewEcho(socket *socket.WebSocket, core *CoreApi, cluster *ClusterApi, config *config.Config, staticConfig *config.StaticConfig) *echo.Echo {
 	e := echo.New()
+	e.Use(selfMiddleware.Trace())
 	e.Use(selfMiddleware.Logger())
 	e.Use(selfMiddleware.Error())
 	e.Use(selfMiddleware.CORS(config))
@@ -103,6 +105,8 @@ func NewEcho(socket *socket.WebSocket, core *CoreApi, config *config.Config, pro
 
 	// 公共路由 - 无需认证
 	publicRoute := route.Group("")
+	maxUploadSize := config.GetMaxUploadSizeOfMB() * 1024 * 1024
+	maxJsonUploadSize := config.GetMaxJsonUploadSizeOfMB() * 1024 * 1024
 
 	// 认证相关API
 	publicRoute.POST("/auth/verify", func(c echo.Context) error {
@@ -170,6 +174,10 @@ func NewEcho(socket *socket.WebSocket, core *CoreApi, config *config.Config, pro
 		return nil
 	})
 
+	protectedRoute.GET("/cluster/nodes", func(c echo.Context) error {
+		return c.JSON(200, common.NewSuccessResponse(cluster.ListNodes(c.Request().Context())))
+	})
+
 	protectedRoute.GET("/log/count", func(c echo.Context) error {
 		key := c.QueryParam("key")
 		result, err := core.data.CountLogsGroup(key)
@@ -182,29 +190,71 @@ func NewEcho(socket *socket.WebSocket, core *CoreApi, config *config.Config, pro
 
 	protectedRoute.GET("/log/download", func(c echo.Context) error {
 		fileId := c.QueryParam("fileId")
-		machine, err := core.GetMachineIdByFileName(fileId)
+		// 文件在 S3 时重定向到预签名地址，由客户端直接从 S3 下载
+		presignUrl, err := core.PresignClusterFile(c.Request().Context(), fileId, c.Request().Header.Get("Accept-Encoding"))
 		if err != nil {
 			return err
 		}
-		if !core.IsSelfMachine(machine) {
-			return proxyManager.Proxy(machine, c)
+
+		if presignUrl != "" {
+			c.Response().Header().Add("Vary", "Accept-Encoding")
+			return c.Redirect(http.StatusFound, presignUrl)
 		}
 
-		file, err := core.GetFile(fileId)
+		file, err := core.GetClusterFile(c.Request().Context(), fileId, newFileReadOptions(c.Request().Header))
+		if size, ok := rangeNotSatisfiableSize(err); ok {
+			if size >= 0 {
+				c.Response().Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			}
+			return echo.NewHTTPError(http.StatusRequestedRangeNotSatisfiable, err.Error())
+		}
+		if isFileNotFound(err) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
 		if err != nil {
 			return err
 		}
 
-		defer file.FileSteam.Close()
-		c.Response().Header().Set("Content-Disposition", "attachment; filename="+file.Name)
-		c.Response().Header().Set("Content-Type", "application/octet-stream")
-		c.Response().Header().Set("Content-Length", strconv.FormatInt(file.Size, 10))
-		_, err = io.Copy(c.Response().Writer, file.FileSteam)
+		defer func() {
+			file.FileSteam.Close()
+		}()
+
+		return writeDownload(c, file)
+	})
+
+	// 最近一次按保留策略清理的结果
+	protectedRoute.GET("/log/retention", func(c echo.Context) error {
+		reports, err := core.GetClusterRetentionReports(c.Request().Context())
 		if err != nil {
 			return err
 		}
 
-		return nil
+		return c.JSON(200, common.NewSuccessResponse(reports))
+	})
+
+	// 存储一致性检查，每个节点检查自己的记录和文件
+	protectedRoute.GET("/storage/scrub", func(c echo.Context) error {
+		reports, err := core.GetClusterScrubReports(c.Request().Context())
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(200, common.NewSuccessResponse(reports))
+	})
+
+	protectedRoute.POST("/storage/scrub", func(c echo.Context) error {
+		repair := c.QueryParam("repair") == "true"
+		deep := c.QueryParam("deep") == "true"
+		reports, err := core.StartClusterScrub(c.Request().Context(), repair, deep)
+		if errors.Is(err, ErrScrubRunning) {
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(200, common.NewSuccessResponse(reports))
 	})
 
 	protectedRoute.GET("/logGroup/list", func(c echo.Context) error {
@@ -228,11 +278,18 @@ func NewEcho(socket *socket.WebSocket, core *CoreApi, config *config.Config, pro
 		}
 
 		logFiles, err := core.ListFilesInGroup(groupId)
+		partialErr := &rpc.PartialError{}
+		if err != nil && !errors.As(err, &partialErr) {
+			return err
+		}
 
+		// 部分节点不可用时返回其它节点的文件，在 message 中说明失败的节点
+		res := common.NewSuccessResponse(logFiles)
 		if err != nil {
-			return err
+			log.Warnf("list files of group %s error %s", groupId, err.Error())
+			res.Message = err.Error()
 		}
-		return c.JSON(200, common.NewSuccessResponse(logFiles))
+		return c.JSON(200, res)
 	})
 
 	protectedRoute.GET("/log/list", func(c echo.Context) error {
@@ -255,19 +312,9 @@ func NewEcho(socket *socket.WebSocket, core *CoreApi, config *config.Config, pro
 		}
 
 		fileIds := c.QueryParams()["fileId"]
-		for _, fileId := range fileIds {
-			machine, err := core.GetMachineIdByFileName(fileId)
-			if err != nil {
-				return err
-			}
-			if !core.IsSelfMachine(machine) {
-				return proxyManager.Proxy(machine, c)
-			}
-
-			err = core.DeleteFile(fileId)
-			if err != nil {
-				return err
-			}
+		err := core.DeleteClusterFiles(fileIds)
+		if err != nil {
+			return err
 		}
 
 		return c.JSON(200, common.NewSuccessResponse(true))
@@ -278,13 +325,19 @@ func NewEcho(socket *socket.WebSocket, core *CoreApi, config *config.Config, pro
 			return fmt.Errorf("not allowed delete log")
 		}
 
+		// 单个组删除失败不影响其它组，最后汇总错误
 		groupIds := c.QueryParams()["groupId"]
+		errs := []error{}
 		for _, groupId := range groupIds {
 			err := core.DeleteLogGroup(groupId)
 			if err != nil {
-				return err
+				log.Errorf("delete group %s error %s", groupId, err.Error())
+				errs = append(errs, fmt.Errorf("delete group %s error %w", groupId, err))
 			}
+		}
 
+		if err := errors.Join(errs...); err != nil {
+			return err
 		}
 
 		return c.JSON(200, common.NewSuccessResponse(true))
@@ -292,98 +345,191 @@ func NewEcho(socket *socket.WebSocket, core *CoreApi, config *config.Config, pro
 
 	// 以下是需要公开的上传接口
 	publicRoute.POST("/logGroup/upload", func(c echo.Context) error {
-		file, err := c.FormFile("log")
-		if err != nil {
-			return err
+		groupId := c.QueryParam("groupId")
+		if groupId == "" {
+			return fmt.Errorf("groupId is required")
 		}
 
-		src, err := file.Open()
+		err := limitUploadBody(c, maxUploadSize+multipartOverhead)
 		if err != nil {
-			return fmt.Errorf("open upload file error: %w", err)
+			return err
 		}
 
-		defer src.Close()
-		fileBs, err := io.ReadAll(src)
+		part, err := openMultipartFile(c, "log")
 		if err != nil {
-			return fmt.Errorf("read upload file error: %w", err)
-		}
-
-		ts := getTags(c.QueryParams())
-
-		groupId := c.QueryParam("groupId")
-		if groupId == "" {
-			return fmt.Errorf("groupId is required")
+			return err
 		}
 
+		defer part.Close()
 		logFile := &storage.LogGroupFile{
 			LogFile: storage.LogFile{
-				Tags:       ts,
-				Name:       file.Filename,
-				Size:       file.Size,
-				UpdateFile: fileBs,
+				Tags:      getTags(c.QueryParams()),
+				Name:      part.FileName(),
+				FileSteam: part,
 			},
 			GroupId: groupId,
 		}
 
-		createFile, err := core.CreateLogGroupFile(logFile)
+		// 同一个组的文件统一上传到归属节点，避免组被拆分到多个节点
+		home := core.GetGroupHomeMachine(groupId)
+		createFile, err := core.CreateLogGroupFileOn(c.Request().Context(), home, logFile)
 		if err != nil {
-			return err
+			return uploadError(err)
 		}
 
 		return c.JSON(200, common.NewSuccessResponse(createFile))
 	})
 
 	publicRoute.POST("/jsonLog/upload", func(c echo.Context) error {
-		fileName := c.QueryParam("name")
-		body, err := io.ReadAll(c.Request().Body)
+		err := limitUploadBody(c, maxJsonUploadSize)
 		if err != nil {
-			return fmt.Errorf("open upload file error: %w", err)
+			return err
 		}
 
 		logFile := &storage.LogFile{
-			Tags:       getTags(c.QueryParams()),
-			Name:       fileName,
-			Size:       int64(len(body)),
-			UpdateFile: body,
+			Tags:      getTags(c.QueryParams()),
+			Name:      c.QueryParam("name"),
+			FileSteam: c.Request().Body,
 		}
 
-		createFile, err := core.CreateFile(logFile)
+		createFile, err := core.CreateJsonFile(logFile)
 		if err != nil {
-			return err
+			return uploadError(err)
 		}
 
 		return c.JSON(200, common.NewSuccessResponse(createFile))
 	})
 
 	publicRoute.POST("/log/upload", func(c echo.Context) error {
-		file, err := c.FormFile("log")
+		err := limitUploadBody(c, maxUploadSize+multipartOverhead)
 		if err != nil {
 			return err
 		}
 
-		src, err := file.Open()
+		part, err := openMultipartFile(c, "log")
 		if err != nil {
-			return fmt.Errorf("open upload file error: %w", err)
+			return err
 		}
 
-		defer src.Close()
-		fileBs, err := io.ReadAll(src)
+		defer part.Close()
+		logFile := &storage.LogFile{
+			Tags:      getTags(c.QueryParams()),
+			Name:      part.FileName(),
+			FileSteam: part,
+		}
+
+		createFile, err := core.CreateFile(logFile)
 		if err != nil {
-			return fmt.Errorf("read upload file error: %w", err)
+			return uploadError(err)
 		}
 
-		logFile := &storage.LogFile{
-			Tags:       getTags(c.QueryParams()),
-			Name:       file.Filename,
-			Size:       file.Size,
-			UpdateFile: fileBs,
+		return c.JSON(200, common.NewSuccessResponse(createFile))
+	})
+
+	// 断点续传：创建会话后按 Upload-Offset 分片上传，全部上传后调用 finalize 生成日志
+	publicRoute.POST("/upload/session", func(c echo.Context) error {
+		size := c.Request().Header.Get(HeaderUploadLength)
+		if size == "" {
+			size = c.QueryParam("size")
 		}
 
-		createFile, err := core.CreateFile(logFile)
+		sizeNum, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s header is required", HeaderUploadLength)
+		}
+
+		session, err := core.CreateUploadSession(&upload.Session{
+			Name:    c.QueryParam("name"),
+			GroupId: c.QueryParam("groupId"),
+			Tags:    getTags(c.QueryParams()),
+			Size:    sizeNum,
+		})
+		if err != nil {
+			return uploadError(err)
+		}
+
+		c.Response().Header().Set(HeaderUploadOffset, strconv.FormatInt(session.Offset, 10))
+		return c.JSON(200, common.NewSuccessResponse(session))
+	})
+
+	publicRoute.GET("/upload/session/:uploadId", func(c echo.Context) error {
+		session, err := core.GetUploadSession(c.Request().Context(), c.Param("uploadId"))
+		if err != nil {
+			return uploadError(err)
+		}
+
+		c.Response().Header().Set(HeaderUploadOffset, strconv.FormatInt(session.Offset, 10))
+		return c.JSON(200, common.NewSuccessResponse(session))
+	})
+
+	publicRoute.PUT("/upload/session/:uploadId", func(c echo.Context) error {
+		offset, err := strconv.ParseInt(c.Request().Header.Get(HeaderUploadOffset), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s header is required", HeaderUploadOffset)
+		}
+
+		err = limitUploadBody(c, maxUploadSize)
 		if err != nil {
 			return err
 		}
 
+		session, err := core.AppendUpload(c.Request().Context(), c.Param("uploadId"), offset, c.Request().Body)
+		if err != nil {
+			return uploadError(err)
+		}
+
+		c.Response().Header().Set(HeaderUploadOffset, strconv.FormatInt(session.Offset, 10))
+		return c.JSON(200, common.NewSuccessResponse(session))
+	})
+
+	publicRoute.POST("/upload/session/:uploadId/finalize", func(c echo.Context) error {
+		createFile, err := core.FinalizeUpload(c.Request().Context(), c.Param("uploadId"))
+		if err != nil {
+			return uploadError(err)
+		}
+
+		return c.JSON(200, common.NewSuccessResponse(createFile))
+	})
+
+	publicRoute.DELETE("/upload/session/:uploadId", func(c echo.Context) error {
+		err := core.AbortUpload(c.Request().Context(), c.Param("uploadId"))
+		if err != nil {
+			return uploadError(err)
+		}
+
+		return c.JSON(200, common.NewSuccessResponse(true))
+	})
+
+	// 直接上传到 S3：获取预签名地址后由客户端 PUT 文件内容，上传完成后调用 finalize 生成日志
+	publicRoute.POST("/log/upload/direct", func(c echo.Context) error {
+		size := c.Request().Header.Get(HeaderUploadLength)
+		if size == "" {
+			size = c.QueryParam("size")
+		}
+
+		sizeNum, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s header is required", HeaderUploadLength)
+		}
+
+		directUpload, err := core.CreateDirectUpload(&storage.LogFile{
+			Name: c.QueryParam("name"),
+			Tags: getTags(c.QueryParams()),
+			Size: sizeNum,
+		})
+		if err != nil {
+			return uploadError(err)
+		}
+
+		return c.JSON(200, common.NewSuccessResponse(directUpload))
+	})
+
+	publicRoute.POST("/log/upload/direct/:fileId/finalize", func(c echo.Context) error {
+		createFile, err := core.FinalizeDirectUpload(c.Request().Context(), c.Param("fileId"))
+		if err != nil {
+			return uploadError(err)
+		}
+
 		return c.JSON(200, common.NewSuccessResponse(createFile))
 	})
 
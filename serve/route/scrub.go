@@ -0,0 +1,527 @@
+package route
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/warjiang/page-spy-api/data"
+	"github.com/warjiang/page-spy-api/rpc"
+	"github.com/warjiang/page-spy-api/storage"
+)
+
+// 报告中每类问题最多保留的条数，超过时只计数
+const maxScrubIssues = 1000
+
+// 最近写入的文件可能还没有创建记录，比如正在上传或者直接上传还没有完成
+const scrubOrphanGrace = time.Hour
+
+var ErrScrubRunning = errors.New("storage scrub is already running")
+
+type ScrubIssue struct {
+	FileId  string `json:"fileId,omitempty"`
+	BlobId  string `json:"blobId,omitempty"`
+	GroupId string `json:"groupId,omitempty"`
+	// 数据库中记录的大小和实际的大小
+	Recorded int64  `json:"recorded,omitempty"`
+	Actual   int64  `json:"actual,omitempty"`
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error,omitempty"`
+}
+
+type ScrubIssues struct {
+	Total int64         `json:"total"`
+	Items []*ScrubIssue `json:"items"`
+}
+
+func (s *ScrubIssues) add(issue *ScrubIssue) {
+	s.Total++
+	if len(s.Items) < maxScrubIssues {
+		s.Items = append(s.Items, issue)
+	}
+}
+
+// ScrubReport 一次存储一致性检查的结果，每个节点检查自己的记录和文件
+type ScrubReport struct {
+	MachineId     string    `json:"machineId"`
+	Running       bool      `json:"running"`
+	Repair        bool      `json:"repair"`
+	Deep          bool      `json:"deep"`
+	StartedAt     time.Time `json:"startedAt"`
+	FinishedAt    time.Time `json:"finishedAt"`
+	Error         string    `json:"error,omitempty"`
+	CheckedLogs   int64     `json:"checkedLogs"`
+	CheckedBlobs  int64     `json:"checkedBlobs"`
+	CheckedGroups int64     `json:"checkedGroups"`
+	// 压缩或加密保存的文件只有 deep 检查时才读取内容得到大小
+	UncheckedSizes int64 `json:"uncheckedSizes"`
+	// 记录存在但文件不存在
+	MissingBlobs *ScrubIssues `json:"missingBlobs"`
+	// 文件存在但没有记录引用
+	OrphanBlobs *ScrubIssues `json:"orphanBlobs"`
+	// 记录的大小与文件不一致
+	SizeMismatches *ScrubIssues `json:"sizeMismatches"`
+	// 日志组的大小与组内日志大小之和不一致
+	GroupSizeMismatches *ScrubIssues `json:"groupSizeMismatches"`
+}
+
+type scrubState struct {
+	lock sync.Mutex
+	// 正在执行的检查，只包含开始时的信息
+	running *ScrubReport
+	last    *ScrubReport
+}
+
+// ScrubStorage 检查当前节点的记录和存储中的文件是否一致，repair 时修复发现的问题
+func (c *CoreApi) ScrubStorage(repair bool, deep bool) (*ScrubReport, error) {
+	report, err := c.beginScrub(repair, deep)
+	if err != nil {
+		return nil, err
+	}
+
+	c.scrub(report)
+	c.endScrub(report)
+	return report, nil
+}
+
+// StartScrub 在后台执行检查，通过 GetScrubReport 获取结果
+func (c *CoreApi) StartScrub(repair bool, deep bool) (*ScrubReport, error) {
+	report, err := c.beginScrub(repair, deep)
+	if err != nil {
+		return nil, err
+	}
+
+	running := *report
+	go func() {
+		c.scrub(report)
+		c.endScrub(report)
+	}()
+
+	return &running, nil
+}
+
+// GetScrubReport 返回正在执行或最近一次检查的结果，从未执行时返回 nil
+func (c *CoreApi) GetScrubReport() *ScrubReport {
+	c.scrubState.lock.Lock()
+	defer c.scrubState.lock.Unlock()
+
+	if c.scrubState.running != nil {
+		return c.scrubState.running
+	}
+
+	return c.scrubState.last
+}
+
+func (c *CoreApi) beginScrub(repair bool, deep bool) (*ScrubReport, error) {
+	c.scrubState.lock.Lock()
+	defer c.scrubState.lock.Unlock()
+
+	if c.scrubState.running != nil {
+		return nil, ErrScrubRunning
+	}
+
+	report := &ScrubReport{
+		MachineId:           c.addressManager.GetSelfMachineID(),
+		Running:             true,
+		Repair:              repair,
+		Deep:                deep,
+		StartedAt:           time.Now(),
+		MissingBlobs:        &ScrubIssues{Items: []*ScrubIssue{}},
+		OrphanBlobs:         &ScrubIssues{Items: []*ScrubIssue{}},
+		SizeMismatches:      &ScrubIssues{Items: []*ScrubIssue{}},
+		GroupSizeMismatches: &ScrubIssues{Items: []*ScrubIssue{}},
+	}
+
+	running := *report
+	c.scrubState.running = &running
+	return report, nil
+}
+
+func (c *CoreApi) endScrub(report *ScrubReport) {
+	report.Running = false
+	report.FinishedAt = time.Now()
+
+	c.scrubState.lock.Lock()
+	c.scrubState.running = nil
+	c.scrubState.last = report
+	c.scrubState.lock.Unlock()
+
+	if report.Error != "" {
+		log.Errorf("scrub storage error %s", report.Error)
+	}
+
+	log.Infof("scrub storage finished in %s, %d missing blobs, %d orphan blobs, %d size mismatches, %d group size mismatches, repair %t",
+		report.FinishedAt.Sub(report.StartedAt).Round(time.Second), report.MissingBlobs.Total, report.OrphanBlobs.Total,
+		report.SizeMismatches.Total, report.GroupSizeMismatches.Total, report.Repair)
+}
+
+func (c *CoreApi) scrub(report *ScrubReport) {
+	lister, ok := c.storage.(storage.Lister)
+	if !ok {
+		report.Error = storage.ErrListNotSupported.Error()
+		return
+	}
+
+	blobs, err := c.listScrubBlobs(lister)
+	if err != nil {
+		// 列表不完整时会把存在的文件当作丢失，不能继续检查
+		report.Error = fmt.Sprintf("list stored files error %s", err.Error())
+		return
+	}
+	report.CheckedBlobs = int64(len(blobs))
+
+	errs := []error{}
+	referenced, err := c.scrubLogs(report, blobs)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("check logs error %w", err))
+	} else {
+		// 没有遍历完所有记录时无法判断文件是否被引用
+		c.scrubOrphans(report, blobs, referenced)
+	}
+
+	err = c.scrubGroups(report)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("check log groups error %w", err))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		report.Error = err.Error()
+	}
+}
+
+// ownsBlob 非共享元数据时 S3 中有其它节点的文件，只检查当前节点创建的文件
+func (c *CoreApi) ownsBlob(blobId string) bool {
+	if c.sharedMetadata || !c.remoteStorage {
+		return true
+	}
+
+	return strings.HasPrefix(blobId, c.addressManager.GetSelfMachineID()+".")
+}
+
+func (c *CoreApi) listScrubBlobs(lister storage.Lister) (map[string]*storage.LogInfo, error) {
+	blobs := map[string]*storage.LogInfo{}
+	err := lister.ListLogs(func(info *storage.LogInfo) error {
+		if c.ownsBlob(info.FileId) {
+			blobs[info.FileId] = info
+		}
+		return nil
+	})
+
+	return blobs, err
+}
+
+// scrubLogs 检查所有记录引用的文件，返回被引用的 blob
+func (c *CoreApi) scrubLogs(report *ScrubReport, blobs map[string]*storage.LogInfo) (map[string]struct{}, error) {
+	referenced := map[string]struct{}{}
+	sizes := map[string]int64{}
+	lastId := uint(0)
+	for {
+		logs, err := c.data.FindLogsAfter(lastId, 1000)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(logs) == 0 {
+			return referenced, nil
+		}
+
+		for _, l := range logs {
+			lastId = l.ID
+			blobId := l.GetBlobId()
+			referenced[blobId] = struct{}{}
+
+			// 未完成的上传由清理任务处理，检查开始后创建的记录对应的文件可能不在列表中
+			if l.Status != data.Saved || !l.CreatedAt.Before(report.StartedAt) || !c.ownsBlob(blobId) {
+				continue
+			}
+
+			report.CheckedLogs++
+			info, ok := blobs[blobId]
+			if !ok {
+				c.scrubMissingBlob(report, l)
+				continue
+			}
+
+			size, ok := sizes[blobId]
+			if !ok {
+				size, ok = c.scrubBlobSize(report, info)
+				if !ok {
+					report.UncheckedSizes++
+					continue
+				}
+				sizes[blobId] = size
+			}
+
+			if size != l.Size {
+				c.scrubLogSize(report, l, size)
+			}
+		}
+	}
+}
+
+// scrubBlobSize 返回文件内容的原始大小，不能得到大小时返回 false
+func (c *CoreApi) scrubBlobSize(report *ScrubReport, info *storage.LogInfo) (int64, bool) {
+	if !info.Encrypted && info.Encoding == storage.EncodingIdentity {
+		return info.Size, true
+	}
+
+	if !report.Deep {
+		return 0, false
+	}
+
+	logFile, err := c.storage.GetLog(info.FileId)
+	if err != nil {
+		log.Errorf("scrub read file %s error %s", info.FileId, err.Error())
+		return 0, false
+	}
+	defer logFile.FileSteam.Close()
+
+	err = logFile.Decode()
+	if err != nil {
+		log.Errorf("scrub decode file %s error %s", info.FileId, err.Error())
+		return 0, false
+	}
+
+	size, err := io.Copy(io.Discard, logFile.FileSteam)
+	if err != nil {
+		log.Errorf("scrub read file %s error %s", info.FileId, err.Error())
+		return 0, false
+	}
+
+	return size, true
+}
+
+// scrubMissingBlob 文件已经不存在，修复时删除记录
+func (c *CoreApi) scrubMissingBlob(report *ScrubReport, l *data.LogData) {
+	blobId := l.GetBlobId()
+	issue := &ScrubIssue{FileId: l.FileId, BlobId: blobId, Recorded: l.Size}
+	if report.Repair {
+		unlock := c.lockBlob(blobId)
+		defer unlock()
+
+		// 列出文件之后刚好写入的文件
+		st, err := c.findBlobStorage(blobId)
+		exist := false
+		if err == nil {
+			exist, err = st.ExistLog(blobId)
+		}
+
+		if err == nil && exist {
+			return
+		}
+
+		if err == nil {
+			_, err = c.data.DeleteLog(l)
+		}
+
+		if err != nil {
+			issue.Error = err.Error()
+		} else {
+			issue.Repaired = true
+			log.Infof("scrub delete log %s of missing blob %s", l.FileId, blobId)
+		}
+	}
+
+	report.MissingBlobs.add(issue)
+}
+
+// scrubLogSize 以文件的实际大小为准更新记录
+func (c *CoreApi) scrubLogSize(report *ScrubReport, l *data.LogData, size int64) {
+	issue := &ScrubIssue{FileId: l.FileId, BlobId: l.GetBlobId(), Recorded: l.Size, Actual: size}
+	if report.Repair {
+		err := c.data.UpdateLogSize(l, size)
+		if err != nil {
+			issue.Error = err.Error()
+		} else {
+			issue.Repaired = true
+		}
+	}
+
+	report.SizeMismatches.add(issue)
+}
+
+// scrubOrphans 没有记录引用的文件，修复时删除文件
+func (c *CoreApi) scrubOrphans(report *ScrubReport, blobs map[string]*storage.LogInfo, referenced map[string]struct{}) {
+	before := report.StartedAt.Add(-scrubOrphanGrace)
+	orphans := []*storage.LogInfo{}
+	for blobId, info := range blobs {
+		if _, ok := referenced[blobId]; ok || !info.ModTime.Before(before) {
+			continue
+		}
+
+		orphans = append(orphans, info)
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].FileId < orphans[j].FileId
+	})
+
+	for _, info := range orphans {
+		issue := &ScrubIssue{BlobId: info.FileId, Actual: info.Size}
+		if report.Repair && !c.removeOrphanBlob(issue, before) {
+			continue
+		}
+
+		report.OrphanBlobs.add(issue)
+	}
+}
+
+// removeOrphanBlob 加锁后确认 blob 仍然没有被引用再删除，已经被引用时返回 false
+func (c *CoreApi) removeOrphanBlob(issue *ScrubIssue, before time.Time) bool {
+	unlock := c.lockBlob(issue.BlobId)
+	defer unlock()
+
+	orphan, err := c.data.RemoveOrphanBlob(issue.BlobId, before)
+	if err == nil && !orphan {
+		return false
+	}
+
+	if err == nil {
+		err = c.storage.RemoveLog(issue.BlobId)
+	}
+
+	if err != nil {
+		issue.Error = err.Error()
+	} else {
+		issue.Repaired = true
+		log.Infof("scrub remove orphan blob %s", issue.BlobId)
+	}
+
+	return true
+}
+
+// scrubGroups 日志组的大小应该等于组内日志大小之和，修复时以日志为准
+func (c *CoreApi) scrubGroups(report *ScrubReport) error {
+	lastId := uint(0)
+	for {
+		logGroups, err := c.data.FindLogGroupsAfter(lastId, 100)
+		if err != nil {
+			return err
+		}
+
+		if len(logGroups) == 0 {
+			return nil
+		}
+
+		for _, logGroup := range logGroups {
+			lastId = logGroup.ID
+			// 检查开始后有新文件写入的组
+			if !logGroup.UpdatedAt.Before(report.StartedAt) {
+				continue
+			}
+
+			report.CheckedGroups++
+			size := int64(0)
+			for _, l := range logGroup.Logs {
+				size += l.Size
+			}
+
+			if size == logGroup.Size {
+				continue
+			}
+
+			issue := &ScrubIssue{GroupId: logGroup.GroupId, Recorded: logGroup.Size, Actual: size}
+			if report.Repair {
+				err := c.data.UpdateLogGroupSize(logGroup, size)
+				if err != nil {
+					issue.Error = err.Error()
+				} else {
+					issue.Repaired = true
+				}
+			}
+
+			report.GroupSizeMismatches.add(issue)
+		}
+	}
+}
+
+// scrubTask 定时检查，使用配置中的修复选项
+func (c *CoreApi) scrubTask(repair bool, deep bool) func() error {
+	return func() error {
+		_, err := c.ScrubStorage(repair, deep)
+		if errors.Is(err, ErrScrubRunning) {
+			return nil
+		}
+
+		return err
+	}
+}
+
+type ScrubRequest struct {
+	Repair bool
+	Deep   bool
+}
+
+type ScrubResponse struct {
+	Reports []*ScrubReport
+}
+
+func (s *ScrubResponse) Merge(result rpc.MergeResult) error {
+	res, ok := result.(*ScrubResponse)
+	if !ok {
+		return fmt.Errorf("type error")
+	}
+
+	s.Reports = append(s.Reports, res.Reports...)
+	return nil
+}
+
+func (s *ScrubResponse) New() rpc.MergeResult {
+	return &ScrubResponse{}
+}
+
+// StartClusterScrub 共享元数据时由当前节点检查所有数据，否则每个节点检查自己的数据
+func (c *CoreApi) StartClusterScrub(ctx context.Context, repair bool, deep bool) ([]*ScrubReport, error) {
+	if c.sharedMetadata {
+		report, err := c.StartScrub(repair, deep)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*ScrubReport{report}, nil
+	}
+
+	res := &ScrubResponse{}
+	err := rpc.CallAllClient(c.rpcManager, ctx, "CoreApi.StartScrub", &ScrubRequest{Repair: repair, Deep: deep}, res)
+	return res.Reports, err
+}
+
+func (c *CoreApi) GetClusterScrubReports(ctx context.Context) ([]*ScrubReport, error) {
+	if c.sharedMetadata {
+		reports := []*ScrubReport{}
+		if report := c.GetScrubReport(); report != nil {
+			reports = append(reports, report)
+		}
+
+		return reports, nil
+	}
+
+	res := &ScrubResponse{}
+	err := rpc.CallAllClient(c.rpcManager, ctx, "CoreApi.GetScrubReport", &ScrubRequest{}, res)
+	return res.Reports, err
+}
+
+func (r *RcpCoreApi) StartScrub(_ *http.Request, req *ScrubRequest, res *ScrubResponse) error {
+	report, err := r.core.StartScrub(req.Repair, req.Deep)
+	if err != nil {
+		return err
+	}
+
+	res.Reports = []*ScrubReport{report}
+	return nil
+}
+
+func (r *RcpCoreApi) GetScrubReport(_ *http.Request, _ *ScrubRequest, res *ScrubResponse) error {
+	res.Reports = []*ScrubReport{}
+	if report := r.core.GetScrubReport(); report != nil {
+		res.Reports = append(res.Reports, report)
+	}
+
+	return nil
+}
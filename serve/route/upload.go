@@ -0,0 +1,92 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/warjiang/page-spy-api/rpc"
+	"github.com/warjiang/page-spy-api/storage"
+	"github.com/warjiang/page-spy-api/upload"
+)
+
+const (
+	HeaderUploadLength = "Upload-Length"
+	HeaderUploadOffset = "Upload-Offset"
+)
+
+// multipart 表单中除文件外其它内容允许占用的大小
+const multipartOverhead = 1024 * 1024
+
+// limitUploadBody 请求体超过限制时直接拒绝，未声明长度的请求在读取超限时中断
+func limitUploadBody(c echo.Context, limit int64) error {
+	if c.Request().ContentLength > limit {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("upload body is larger than %d bytes", limit))
+	}
+
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, limit)
+	return nil
+}
+
+// openMultipartFile 按顺序读取 multipart 找到文件字段，内容不会被提前解析到内存或临时文件
+func openMultipartFile(c echo.Context, field string) (*multipart.Part, error) {
+	reader, err := c.Request().MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, http.ErrMissingFile
+		}
+
+		if err != nil {
+			return nil, uploadError(err)
+		}
+
+		if part.FormName() == field && part.FileName() != "" {
+			return part, nil
+		}
+	}
+}
+
+// uploadErrorStatus 上传相关错误对应的状态码，不是上传错误时返回 0
+func uploadErrorStatus(err error) int {
+	var maxBytesError *http.MaxBytesError
+	if errors.Is(err, storage.ErrFileTooLarge) || errors.As(err, &maxBytesError) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	if errors.Is(err, ErrDirectUploadDisabled) {
+		return http.StatusBadRequest
+	}
+
+	if errors.Is(err, upload.ErrSessionNotFound) {
+		return http.StatusNotFound
+	}
+
+	if errors.Is(err, upload.ErrOffsetMismatch) || errors.Is(err, upload.ErrIncomplete) {
+		return http.StatusConflict
+	}
+
+	// 其它节点返回的错误保留原状态码
+	var streamError *rpc.StreamError
+	if errors.As(err, &streamError) && streamError.StatusCode >= 400 && streamError.StatusCode < 500 {
+		return streamError.StatusCode
+	}
+
+	return 0
+}
+
+func uploadError(err error) error {
+	status := uploadErrorStatus(err)
+	if status == 0 {
+		return err
+	}
+
+	return echo.NewHTTPError(status, err.Error())
+}
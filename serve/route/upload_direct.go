@@ -0,0 +1,248 @@
+package route
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/warjiang/page-spy-api/data"
+	"github.com/warjiang/page-spy-api/storage"
+	"github.com/warjiang/page-spy-api/upload"
+)
+
+var ErrDirectUploadDisabled = errors.New("direct upload to storage is not enabled")
+
+// 没有完成的上传至少保留一小时
+const minPendingUploadExpire = time.Hour
+
+// 预签名地址过期前开始的上传可能还在进行，在过期时间之外多等待一段时间
+const pendingUploadMargin = 10 * time.Minute
+
+// DirectUpload 客户端直接上传到存储的地址，上传完成后调用 finalize 才会生成日志
+type DirectUpload struct {
+	UploadUrl string        `json:"uploadUrl"`
+	ExpireAt  time.Time     `json:"expireAt"`
+	Log       *data.LogData `json:"log"`
+}
+
+// CreateDirectUpload 创建等待上传的日志记录并返回预签名的上传地址
+// 上传前不知道文件内容，不能按内容去重，文件 ID 同时作为 blob ID
+func (c *CoreApi) CreateDirectUpload(file *storage.LogFile) (*DirectUpload, error) {
+	if !c.presignUpload {
+		return nil, ErrDirectUploadDisabled
+	}
+
+	// 加密或本地存储时没有实现 Presigner
+	presigner, ok := c.storage.(storage.Presigner)
+	if !ok {
+		return nil, ErrDirectUploadDisabled
+	}
+
+	if file.Size <= 0 {
+		return nil, fmt.Errorf("upload size should be greater than 0")
+	}
+
+	if c.maxUploadSize > 0 && file.Size > c.maxUploadSize {
+		return nil, fmt.Errorf("%w, max size is %d bytes", storage.ErrFileTooLarge, c.maxUploadSize)
+	}
+
+	fileId := c.CreateFileId()
+	uploadUrl, err := presigner.PresignSaveLog(&storage.PresignRequest{
+		FileId: fileId,
+		Size:   file.Size,
+		Expire: c.presignExpire,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if uploadUrl == "" {
+		return nil, ErrDirectUploadDisabled
+	}
+
+	ts := []*data.Tag{}
+	for _, t := range file.Tags {
+		ts = append(ts, &data.Tag{
+			Key:   t.Key,
+			Value: t.Value,
+		})
+	}
+
+	logData := &data.LogData{
+		Model: data.Model{
+			UpdatedAt: time.Now(),
+			CreatedAt: time.Now(),
+		},
+		Tags:   ts,
+		FileId: fileId,
+		BlobId: fileId,
+		Status: data.Created,
+		Size:   file.Size,
+		Name:   file.Name,
+	}
+	err = c.data.CreateLog(logData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DirectUpload{
+		UploadUrl: uploadUrl,
+		ExpireAt:  time.Now().Add(c.presignExpire),
+		Log:       logData,
+	}, nil
+}
+
+// FinalizeDirectUpload 由保存日志记录的节点确认上传结果
+func (c *CoreApi) FinalizeDirectUpload(ctx context.Context, fileId string) (*storage.LogFile, error) {
+	machineId, err := c.GetMachineIdByFileName(fileId)
+	if err != nil {
+		return nil, upload.ErrSessionNotFound
+	}
+
+	if c.CanServeLocally(machineId) {
+		return c.finalizeDirectUpload(fileId)
+	}
+
+	// 通过 stream 转发才能保留上传未完成等错误的状态码
+	res := &storage.LogFile{}
+	err = c.forwardUpload(ctx, machineId, uploadOpFinalizeDirect, fileId, 0, nil, res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// finalizeDirectUpload 确认文件已经上传到存储且大小一致后把记录标记为已保存，重复调用返回同样的结果
+func (c *CoreApi) finalizeDirectUpload(fileId string) (*storage.LogFile, error) {
+	unlock := c.lockBlob(fileId)
+	defer unlock()
+
+	logs, err := c.data.FindLogsByFileId(fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending *data.LogData
+	for _, l := range logs {
+		if l.Status == data.Created || l.Status == data.Saved {
+			pending = l
+		}
+	}
+
+	if pending == nil {
+		return nil, upload.ErrSessionNotFound
+	}
+
+	result := &storage.LogFile{
+		Name:   pending.Name,
+		FileId: pending.FileId,
+		Size:   pending.Size,
+		Tags:   []*storage.Tag{},
+	}
+	for _, t := range pending.Tags {
+		result.Tags = append(result.Tags, &storage.Tag{Key: t.Key, Value: t.Value})
+	}
+
+	if pending.Status == data.Saved {
+		return result, nil
+	}
+
+	// 直接上传的文件不经过压缩
+	encoding := storage.EncodingIdentity
+	st := storage.WithEncoding(c.storage, &encoding)
+	logFile, err := storage.StatLog(st, fileId)
+	if isFileNotFound(err) {
+		return nil, upload.ErrIncomplete
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// 预签名地址限制了上传的大小，不一致说明对象被其它方式覆盖，记录标记为失败后由清理任务删除
+	if logFile.Encoding == storage.EncodingIdentity && logFile.Size != pending.Size {
+		err = c.data.UpdateLogStatus(fileId, data.Error)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("%w, uploaded %d bytes but expected %d bytes", upload.ErrIncomplete, logFile.Size, pending.Size)
+	}
+
+	_, err = c.data.AcquireBlob(&data.Blob{BlobId: fileId, Size: pending.Size, Encoding: &encoding})
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.data.UpdateLogStatus(fileId, data.Saved)
+	if err != nil {
+		_, releaseErr := c.data.ReleaseBlob(fileId)
+		if releaseErr != nil {
+			log.Errorf("release blob %s error %s", fileId, releaseErr.Error())
+		}
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// pendingUploadExpire 上传地址的有效期超过一小时时，按有效期判断上传是否已经放弃
+func (c *CoreApi) pendingUploadExpire() time.Duration {
+	expire := c.presignExpire
+	if expire < minPendingUploadExpire {
+		expire = minPendingUploadExpire
+	}
+
+	return expire + pendingUploadMargin
+}
+
+// CleanPendingUpload 删除超过有效期还没有完成上传或上传失败的记录，以及已经上传到存储的内容
+func (c *CoreApi) CleanPendingUpload() error {
+	logs, err := c.data.FindShouldDeleteLogs(time.Now().Add(-c.pendingUploadExpire()), 1000)
+	if err != nil {
+		return err
+	}
+
+	if len(logs) <= 0 {
+		return nil
+	}
+
+	log.Infof("clean %d pending uploads", len(logs))
+	for _, l := range logs {
+		err := c.deletePendingLog(l)
+		if err != nil {
+			log.Errorf("delete pending upload %s error %s", l.FileId, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// deletePendingLog 加锁后重新检查状态，查询之后刚好完成上传的记录不会被删除
+func (c *CoreApi) deletePendingLog(l *data.LogData) error {
+	blobId := l.GetBlobId()
+	unlock := c.lockBlob(blobId)
+	defer unlock()
+
+	logs, err := c.data.FindLogsByFileId(l.FileId)
+	if err != nil {
+		return err
+	}
+
+	for _, current := range logs {
+		if current.ID != l.ID || current.Status == data.Saved {
+			continue
+		}
+
+		released, err := c.data.DeleteLog(current)
+		if err != nil || released == nil {
+			return err
+		}
+
+		return c.blobStorage(released).RemoveLog(blobId)
+	}
+
+	return nil
+}
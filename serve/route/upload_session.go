@@ -0,0 +1,205 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/warjiang/page-spy-api/storage"
+	"github.com/warjiang/page-spy-api/upload"
+)
+
+const blobUploadPath = "/blob/upload"
+
+// 转发到会话所在节点的操作
+const (
+	uploadOpGet            = "get"
+	uploadOpAppend         = "append"
+	uploadOpFinalize       = "finalize"
+	uploadOpAbort          = "abort"
+	uploadOpFinalizeDirect = "finalizeDirect"
+)
+
+// CreateUploadSession 在当前节点创建断点续传会话，会话 ID 带上节点 ID，后续请求可以落到任意节点
+func (c *CoreApi) CreateUploadSession(session *upload.Session) (*upload.Session, error) {
+	if session.Size <= 0 {
+		return nil, fmt.Errorf("upload size should be greater than 0")
+	}
+
+	if c.maxUploadSize > 0 && session.Size > c.maxUploadSize {
+		return nil, fmt.Errorf("%w, max size is %d bytes", storage.ErrFileTooLarge, c.maxUploadSize)
+	}
+
+	session.Id = fmt.Sprintf("%s.%s", c.addressManager.GetSelfMachineID(), strings.ReplaceAll(uuid.New().String(), "-", ""))
+	err := c.uploads.Create(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (c *CoreApi) getUploadMachine(id string) (string, error) {
+	machineId, err := c.GetMachineIdByFileName(id)
+	if err != nil {
+		return "", upload.ErrSessionNotFound
+	}
+
+	return machineId, nil
+}
+
+func (c *CoreApi) forwardUpload(ctx context.Context, machineId string, op string, id string, offset int64, body io.Reader, out interface{}) error {
+	client, err := c.getRpcByMachine(machineId)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{
+		"op":       {op},
+		"uploadId": {id},
+		"offset":   {strconv.FormatInt(offset, 10)},
+	}
+
+	resp, err := client.Stream(ctx, http.MethodPost, blobUploadPath, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *CoreApi) GetUploadSession(ctx context.Context, id string) (*upload.Session, error) {
+	machineId, err := c.getUploadMachine(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.IsSelfMachine(machineId) {
+		session := &upload.Session{}
+		return session, c.forwardUpload(ctx, machineId, uploadOpGet, id, 0, nil, session)
+	}
+
+	return c.uploads.Get(id)
+}
+
+// AppendUpload 写入一个分片，返回写入后的会话
+func (c *CoreApi) AppendUpload(ctx context.Context, id string, offset int64, body io.Reader) (*upload.Session, error) {
+	machineId, err := c.getUploadMachine(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.IsSelfMachine(machineId) {
+		session := &upload.Session{}
+		return session, c.forwardUpload(ctx, machineId, uploadOpAppend, id, offset, body, session)
+	}
+
+	return c.uploads.Append(id, offset, body)
+}
+
+// FinalizeUpload 上传完成后创建日志记录并删除会话，带 groupId 的会话写入日志组
+func (c *CoreApi) FinalizeUpload(ctx context.Context, id string) (interface{}, error) {
+	machineId, err := c.getUploadMachine(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.IsSelfMachine(machineId) {
+		res := json.RawMessage{}
+		err = c.forwardUpload(ctx, machineId, uploadOpFinalize, id, 0, nil, &res)
+		if err != nil {
+			return nil, err
+		}
+
+		return res, nil
+	}
+
+	// 同时完成同一个会话时只创建一次日志，重复完成返回同样的日志
+	return c.uploads.Finalize(id, func(session *upload.Session, file io.Reader) (interface{}, error) {
+		logFile := storage.LogFile{
+			Name:      session.Name,
+			Tags:      session.Tags,
+			FileSteam: io.NopCloser(file),
+		}
+
+		if session.GroupId != "" {
+			return c.CreateLogGroupFileOn(ctx, c.GetGroupHomeMachine(session.GroupId), &storage.LogGroupFile{
+				LogFile: logFile,
+				GroupId: session.GroupId,
+			})
+		}
+
+		return c.CreateFile(&logFile)
+	})
+}
+
+func (c *CoreApi) AbortUpload(ctx context.Context, id string) error {
+	machineId, err := c.getUploadMachine(id)
+	if err != nil {
+		return err
+	}
+
+	if !c.IsSelfMachine(machineId) {
+		return c.forwardUpload(ctx, machineId, uploadOpAbort, id, 0, nil, nil)
+	}
+
+	return c.uploads.Remove(id)
+}
+
+func (c *CoreApi) serveBlobUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	id := query.Get("uploadId")
+	var res interface{}
+	var err error
+	switch query.Get("op") {
+	case uploadOpGet:
+		res, err = c.uploads.Get(id)
+	case uploadOpAppend:
+		offset, e := strconv.ParseInt(query.Get("offset"), 10, 64)
+		if e != nil {
+			http.Error(w, "offset format error", http.StatusBadRequest)
+			return
+		}
+		res, err = c.uploads.Append(id, offset, r.Body)
+	case uploadOpFinalize:
+		res, err = c.FinalizeUpload(r.Context(), id)
+	case uploadOpAbort:
+		err = c.uploads.Remove(id)
+	case uploadOpFinalizeDirect:
+		res, err = c.finalizeDirectUpload(id)
+	default:
+		http.Error(w, "unknown upload operation", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		status := uploadErrorStatus(err)
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		log.Errorf("write upload response error %s", err.Error())
+	}
+}
@@ -1,24 +1,30 @@
 package serve
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/labstack/echo/v4"
 	"github.com/warjiang/page-spy-api/config"
 	"github.com/warjiang/page-spy-api/container"
+	"github.com/warjiang/page-spy-api/storage"
+	"github.com/warjiang/page-spy-api/trace"
 	"github.com/warjiang/page-spy-api/util"
 )
 
+// 退出时等待处理中的请求完成的最长时间
+const shutdownTimeout = 10 * time.Second
+
 func Run() {
-	err := container.Container().Invoke(func(e *echo.Echo, config *config.Config, staticConfig *config.StaticConfig) {
+	// exporter 需要在服务启动前初始化，之后的 span 都通过它导出
+	err := container.Container().Invoke(func(e *echo.Echo, config *config.Config, staticConfig *config.StaticConfig, exporter trace.Exporter, st storage.StorageApi) {
 		if staticConfig != nil {
-			hash := staticConfig.GitHash
-			version := staticConfig.Version
-			if hash == "" {
-				hash = "local"
-			}
-			if version == "" {
-				version = "local"
-			}
-			log.Infof("server info: %s@%s", version, hash)
+			log.Infof("server info: %s@%s", staticConfig.GetVersion(), staticConfig.GetGitHash())
 		}
 
 		for _, ip := range util.GetLocalIPList() {
@@ -26,7 +32,30 @@ func Run() {
 		}
 
 		log.Infof("Local address http://localhost:%s", config.Port)
-		e.Logger.Fatal(e.Start(":" + config.Port))
+		go func() {
+			err := e.Start(":" + config.Port)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				e.Logger.Fatal(err)
+			}
+		}()
+
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+		<-quit
+
+		log.Infof("shutting down server")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := e.Shutdown(ctx)
+		if err != nil {
+			log.Errorf("shutdown server error %s", err.Error())
+		}
+
+		// 后台删除的对象在退出前删除，否则会留在存储中
+		err = storage.Close(st)
+		if err != nil {
+			log.Errorf("close storage error %s", err.Error())
+		}
 	})
 
 	if err != nil {
@@ -23,7 +23,7 @@ func NewManager(config *config.Config, rpcManager *rpc.RpcManager, addressManage
 		return nil, err
 	}
 
-	manager := room.NewRemoteRpcRoomManager(addressManager, rpcManager, localEvent, localRoomManager)
+	manager := room.NewRemoteRpcRoomManager(addressManager, rpcManager, localEvent, localRoomManager, config.GetRoomPlacement(), config.GetMaxClusterRoomNumber())
 	manager.Start()
 	logger.Log().Infof("start rpc server %s successful", addressManager.GetSelfMachineID())
 	logger.Log().Infof("local ip %s:%s", util.GetLocalIP(), config.Port)
@@ -19,6 +19,7 @@ import (
 	"github.com/warjiang/page-spy-api/metric"
 	"github.com/warjiang/page-spy-api/room"
 	"github.com/warjiang/page-spy-api/serve/common"
+	"github.com/warjiang/page-spy-api/trace"
 	"github.com/warjiang/page-spy-api/util"
 )
 
@@ -122,7 +123,13 @@ func (s *WebSocket) readClientMessage(ctx context.Context, socket *socket, room
 		return nil
 	}
 
-	log.Debugf("socket received %s", msg.Type)
+	// 前端没有带请求 ID 时补一个，消息经过的所有节点都使用同一个 ID
+	if msg.RequestId == "" {
+		msg.RequestId = trace.NewRequestId()
+	}
+
+	ctx = trace.WithRequestId(ctx, msg.RequestId)
+	trace.Entry(ctx, log).Debugf("socket received %s", msg.Type)
 	metric.Count("server_read_message", map[string]string{
 		"type": msg.Type,
 	}, 1)
@@ -306,7 +313,6 @@ type RoomOptions struct {
 }
 
 func (s *WebSocket) CreateRoom(rw http.ResponseWriter, r *http.Request) {
-	address := s.roomManager.AddressManager.GeneratorRoomAddress()
 	name := r.URL.Query().Get("name")
 	group := r.URL.Query().Get("group")
 	tags := getTags(r.URL.Query())
@@ -324,8 +330,8 @@ func (s *WebSocket) CreateRoom(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	opt := roomApi.NewRoomInfo(name, secretOpt.Secret, secretOpt.UseSecret, tags, group, address)
-	_, err = s.roomManager.CreateLocalRoom(r.Context(), opt)
+	opt := roomApi.NewRoomInfo(name, secretOpt.Secret, secretOpt.UseSecret, tags, group, nil)
+	createdRoom, err := s.roomManager.PlaceRoom(r.Context(), opt)
 	if err != nil {
 		writeResponse(rw, common.NewErrorResponse(err))
 		return
@@ -336,8 +342,8 @@ func (s *WebSocket) CreateRoom(rw http.ResponseWriter, r *http.Request) {
 		"code":   "success",
 	}, 1)
 
-	joinLog.Infof("create group %s room", group)
-	writeResponse(rw, common.NewSuccessResponse(opt))
+	joinLog.Infof("create group %s room on %s", group, opt.Address.MachineID)
+	writeResponse(rw, common.NewSuccessResponse(createdRoom.GetInfo()))
 }
 
 func (s *WebSocket) JoinRoom(rw http.ResponseWriter, r *http.Request) {
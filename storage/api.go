@@ -1,25 +1,47 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/warjiang/page-spy-api/config"
+	"github.com/warjiang/page-spy-api/task"
 )
 
+// ErrLogNotFound 存储中没有这个文件，或者文件正在删除
+var ErrLogNotFound = errors.New("log file not found")
+
 type Tag struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
 }
 
 type LogFile struct {
-	Name       string        `json:"name"`
-	FileId     string        `json:"fileId"`
-	Size       int64         `json:"size"`
-	Tags       []*Tag        `json:"tags"`
-	UpdateFile []byte        `json:"-"`
-	FileSteam  io.ReadCloser `json:"-"`
+	Name   string `json:"name"`
+	FileId string `json:"fileId"`
+	Size   int64  `json:"size"`
+	Tags   []*Tag `json:"tags"`
+	// 上传时内容与已有文件相同，没有重复保存
+	Dedupe bool `json:"dedupe"`
+	// 保存时文件已存在也重新写入，已存在的可能是正在删除或者没有写完的旧文件
+	Overwrite bool `json:"-"`
+	// 读取时文件内容的压缩编码，为空时是未压缩的内容
+	Encoding string `json:"-"`
+	// 压缩后的大小，Encoding 为空时无意义
+	EncodedSize int64 `json:"-"`
+	// 上传时为待写入的内容，读取时为文件内容
+	FileSteam io.ReadCloser `json:"-"`
+	// 读取时内容的强校验值，由内容哈希得到，不包含压缩编码
+	ETag string `json:"-"`
+	// 读取时文件的修改时间
+	ModTime time.Time `json:"-"`
+	// 读取时只返回了原始内容中的这一段，Size 为文件的总大小
+	Range *ByteRange `json:"-"`
+	// 条件请求命中，没有读取文件内容
+	NotModified bool `json:"-"`
 }
 
 type LogGroupFile struct {
@@ -33,27 +55,89 @@ type StorageApi interface {
 	ExistLog(fileId string) (bool, error)
 	RemoveLog(fileId string) error
 
-	Save(path string, data io.ReadSeeker) error
+	Save(path string, data io.Reader) error
 	Exist(path string) (bool, error)
 	Get(path string) (io.ReadCloser, int64, error)
 }
 
-func NewStorage(config *config.Config) (StorageApi, error) {
-	if config.IsRemoteStorage() {
-		return NewS3Api(config.StorageConfig)
+// Close 进程退出前关闭存储，比如等待 S3 在后台删除的对象删除完成，没有需要关闭的资源时直接返回
+func Close(s StorageApi) error {
+	closer, ok := s.(io.Closer)
+	if !ok {
+		return nil
+	}
+
+	return closer.Close()
+}
+
+func NewStorage(config *config.Config, taskManager *task.TaskManager) (StorageApi, error) {
+	var api StorageApi
+	var err error
+	if config.IsTieredStorage() {
+		api, err = newTieredStorage(config, taskManager)
+	} else if config.IsRemoteStorage() {
+		api, err = NewS3Api(config.StorageConfig)
+	} else {
+		api, err = NewFileApi(config.LocalStorageConfig)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// 先压缩再加密，加密后的内容无法压缩
+	if config.EncryptionConfig.IsEnabled() {
+		api, err = NewEncryptApi(api, config.EncryptionConfig)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return NewFileApi()
+	return NewCompressApi(api, config.GetCompression())
+}
+
+func newTieredStorage(config *config.Config, taskManager *task.TaskManager) (StorageApi, error) {
+	hot, err := newFileApi(config.LocalStorageConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	cold, err := NewS3Api(config.StorageConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// 本地文件只在当前节点，每个节点迁移自己的文件
+	tiered := NewTieredApi(hot, cold, config.TieredStorageConfig)
+	err = taskManager.AddTask(task.NewTask("migrate_tiered_storage", 10*time.Minute, tiered.Migrate))
+	if err != nil {
+		return nil, err
+	}
+
+	return tiered, nil
 }
 
 func NewS3Api(config *config.StorageConfig) (StorageApi, error) {
-	return &RemoteApi{config: config}, nil
+	return newRemoteApi(config)
 }
 
-func NewFileApi() (StorageApi, error) {
-	if err := os.MkdirAll(logDirPath, os.ModePerm); err != nil {
+func NewFileApi(config *config.LocalStorageConfig) (StorageApi, error) {
+	return newFileApi(config)
+}
+
+func newFileApi(config *config.LocalStorageConfig) (*FileApi, error) {
+	api := &FileApi{
+		root:   config.GetRootDir(),
+		levels: config.GetShardLevels(),
+	}
+
+	if err := os.MkdirAll(api.root, os.ModePerm); err != nil {
 		return nil, fmt.Errorf("init log file dir error: %w", err)
 	}
 
-	return &FileApi{}, nil
+	if err := api.migrate(); err != nil {
+		return nil, err
+	}
+
+	return api, nil
 }
@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingIdentity = ""
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+)
+
+// 压缩后的文件在文件 ID 后加上扩展名保存，没有扩展名的是未压缩的历史文件
+var encodingExtensions = map[string]string{
+	EncodingGzip: ".gz",
+	EncodingZstd: ".zst",
+}
+
+// 读取时依次尝试的编码，最后尝试未压缩的文件
+var readEncodings = []string{EncodingZstd, EncodingGzip, EncodingIdentity}
+
+func IsSupportedEncoding(encoding string) bool {
+	_, ok := encodingExtensions[encoding]
+	return ok || encoding == EncodingIdentity
+}
+
+func encodedFileId(fileId string, encoding string) string {
+	return fileId + encodingExtensions[encoding]
+}
+
+// CompressApi 在存储之上透明地压缩日志文件，其它路径的文件原样保存
+// 关闭压缩后仍然可以读取之前压缩保存的文件
+type CompressApi struct {
+	StorageApi
+	encoding string
+	// 调用方记录了文件保存时的编码，直接使用 encoding，不再逐个探测
+	located bool
+}
+
+func NewCompressApi(storage StorageApi, encoding string) (StorageApi, error) {
+	if !IsSupportedEncoding(encoding) {
+		return nil, fmt.Errorf("unsupported compression %s", encoding)
+	}
+
+	return &CompressApi{
+		StorageApi: storage,
+		encoding:   encoding,
+	}, nil
+}
+
+// SaveEncoding 新保存的文件使用的编码，调用方记录后通过 WithEncoding 读写
+func (c *CompressApi) SaveEncoding() string {
+	return c.encoding
+}
+
+// WithEncoding 按已知的编码访问文件，同一个文件只需要一次请求
+func (c *CompressApi) WithEncoding(encoding string) StorageApi {
+	return &CompressApi{
+		StorageApi: c.StorageApi,
+		encoding:   encoding,
+		located:    true,
+	}
+}
+
+// EncodingApi 由调用方记录文件保存时的编码，避免每次读写时探测所有编码
+type EncodingApi interface {
+	SaveEncoding() string
+	WithEncoding(encoding string) StorageApi
+}
+
+// SaveEncoding 存储没有压缩时返回未压缩
+func SaveEncoding(s StorageApi) string {
+	encodingApi, ok := s.(EncodingApi)
+	if !ok {
+		return EncodingIdentity
+	}
+
+	return encodingApi.SaveEncoding()
+}
+
+// WithEncoding encoding 为 nil 表示没有记录保存时的编码，比如之前保存的文件，仍然逐个探测
+func WithEncoding(s StorageApi, encoding *string) StorageApi {
+	encodingApi, ok := s.(EncodingApi)
+	if !ok || encoding == nil {
+		return s
+	}
+
+	return encodingApi.WithEncoding(*encoding)
+}
+
+func (c *CompressApi) SaveLog(log *LogFile) error {
+	if log.FileId == "" {
+		return fmt.Errorf("create log file error: fileId is empty")
+	}
+
+	if !log.Overwrite {
+		exist, err := c.ExistLog(log.FileId)
+		if err != nil {
+			return err
+		}
+
+		if exist {
+			return nil
+		}
+	}
+
+	if c.encoding == EncodingIdentity {
+		return c.StorageApi.SaveLog(log)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(compress(writer, log.FileSteam, c.encoding))
+	}()
+	defer reader.Close()
+
+	return c.StorageApi.SaveLog(&LogFile{
+		Name:      log.Name,
+		FileId:    encodedFileId(log.FileId, c.encoding),
+		Size:      log.Size,
+		Tags:      log.Tags,
+		Overwrite: log.Overwrite,
+		FileSteam: reader,
+	})
+}
+
+// locate 找到文件实际保存的编码，优先检查当前配置的编码；已知编码时不检查文件是否存在，由读取或删除返回错误
+func (c *CompressApi) locate(fileId string) (string, bool, error) {
+	if c.located {
+		return c.encoding, true, nil
+	}
+
+	encodings := []string{c.encoding}
+	for _, encoding := range readEncodings {
+		if encoding != c.encoding {
+			encodings = append(encodings, encoding)
+		}
+	}
+
+	for _, encoding := range encodings {
+		exist, err := c.StorageApi.ExistLog(encodedFileId(fileId, encoding))
+		if err != nil {
+			return "", false, err
+		}
+
+		if exist {
+			return encoding, true, nil
+		}
+	}
+
+	return "", false, nil
+}
+
+func (c *CompressApi) ExistLog(fileId string) (bool, error) {
+	if c.located {
+		return c.StorageApi.ExistLog(encodedFileId(fileId, c.encoding))
+	}
+
+	_, exist, err := c.locate(fileId)
+	return exist, err
+}
+
+// GetLog 返回保存的原始字节，Encoding 不为空时需要调用方解压
+func (c *CompressApi) GetLog(fileId string) (*LogFile, error) {
+	encoding, exist, err := c.locate(fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exist {
+		return nil, fmt.Errorf("%w, file id %s", ErrLogNotFound, fileId)
+	}
+
+	logFile, err := c.StorageApi.GetLog(encodedFileId(fileId, encoding))
+	if err != nil {
+		return nil, err
+	}
+
+	logFile.FileId = fileId
+	if encoding != EncodingIdentity {
+		logFile.Encoding = encoding
+		logFile.EncodedSize = logFile.Size
+		logFile.Size = 0
+	}
+
+	return logFile, nil
+}
+
+func (c *CompressApi) RemoveLog(fileId string) error {
+	encoding, exist, err := c.locate(fileId)
+	if err != nil {
+		return err
+	}
+
+	if !exist {
+		return nil
+	}
+
+	return c.StorageApi.RemoveLog(encodedFileId(fileId, encoding))
+}
+
+func (c *CompressApi) Close() error {
+	return Close(c.StorageApi)
+}
+
+// ReencryptLog 重新加密文件实际保存的压缩或未压缩版本
+func (c *CompressApi) ReencryptLog(fileId string) (bool, error) {
+	reencrypter, ok := c.StorageApi.(Reencrypter)
+	if !ok {
+		return false, fmt.Errorf("encryption is not enabled")
+	}
+
+	encoding, exist, err := c.locate(fileId)
+	if err != nil {
+		return false, err
+	}
+
+	if !exist {
+		return false, fmt.Errorf("%w, file id %s", ErrLogNotFound, fileId)
+	}
+
+	return reencrypter.ReencryptLog(encodedFileId(fileId, encoding))
+}
+
+func compress(dst io.Writer, src io.Reader, encoding string) error {
+	var writer io.WriteCloser
+	var err error
+	switch encoding {
+	case EncodingGzip:
+		writer = gzip.NewWriter(dst)
+	case EncodingZstd:
+		writer, err = zstd.NewWriter(dst)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported compression %s", encoding)
+	}
+
+	_, err = io.Copy(writer, src)
+	closeErr := writer.Close()
+	if err != nil {
+		return fmt.Errorf("compress log file error: %w", err)
+	}
+
+	return closeErr
+}
+
+type decodeReader struct {
+	io.Reader
+	close func() error
+}
+
+func (d *decodeReader) Close() error {
+	return d.close()
+}
+
+// NewDecodeReader 解压文件内容，关闭时同时关闭原始内容
+func NewDecodeReader(encoding string, src io.ReadCloser) (io.ReadCloser, error) {
+	switch encoding {
+	case EncodingIdentity:
+		return src, nil
+	case EncodingGzip:
+		reader, err := gzip.NewReader(src)
+		if err != nil {
+			src.Close()
+			return nil, fmt.Errorf("decompress log file error: %w", err)
+		}
+
+		return &decodeReader{Reader: reader, close: func() error {
+			reader.Close()
+			return src.Close()
+		}}, nil
+	case EncodingZstd:
+		reader, err := zstd.NewReader(src)
+		if err != nil {
+			src.Close()
+			return nil, fmt.Errorf("decompress log file error: %w", err)
+		}
+
+		return &decodeReader{Reader: reader, close: func() error {
+			reader.Close()
+			return src.Close()
+		}}, nil
+	default:
+		src.Close()
+		return nil, fmt.Errorf("unsupported compression %s", encoding)
+	}
+}
+
+// Decode 把压缩的文件换成解压后的内容，Size 为原始大小
+func (l *LogFile) Decode() error {
+	if l.Encoding == EncodingIdentity {
+		return nil
+	}
+
+	reader, err := NewDecodeReader(l.Encoding, l.FileSteam)
+	if err != nil {
+		return err
+	}
+
+	l.FileSteam = reader
+	l.Encoding = EncodingIdentity
+	l.EncodedSize = 0
+	return nil
+}
+
+// AcceptEncoding 判断 Accept-Encoding 请求头是否接受该编码
+func AcceptEncoding(header string, encoding string) bool {
+	if encoding == EncodingIdentity {
+		return true
+	}
+
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.TrimSpace(name)
+		if !strings.EqualFold(name, encoding) && name != "*" {
+			continue
+		}
+
+		q, found := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !found {
+			return true
+		}
+
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+
+	return false
+}
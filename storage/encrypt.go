@@ -0,0 +1,462 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/warjiang/page-spy-api/config"
+)
+
+// 加密文件格式：
+// magic | key id 长度(1) | key id | 包装后的数据密钥长度(2) | nonce + 包装后的数据密钥 | 分片大小(4) | 分片...
+// 每个分片单独使用 AES-GCM 加密，nonce 为分片序号加最后一片标记，防止分片被截断或调换顺序
+var encryptMagic = []byte("PSENC\x00\x00\x01")
+
+const (
+	encryptChunkSize = 64 * 1024
+	dataKeySize      = 32
+)
+
+var ErrMasterKeyNotFound = errors.New("master key not found")
+
+type Keyring struct {
+	keys        map[string][]byte
+	activeKeyId string
+}
+
+func NewKeyring(c *config.EncryptionConfig) (*Keyring, error) {
+	keyring := &Keyring{
+		keys:        map[string][]byte{},
+		activeKeyId: c.GetActiveKeyId(),
+	}
+
+	for id, encoded := range c.MasterKeys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("master key id %q is invalid", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decode master key %s error: %w", id, err)
+		}
+
+		if len(key) != dataKeySize {
+			return nil, fmt.Errorf("master key %s should be %d bytes, got %d", id, dataKeySize, len(key))
+		}
+
+		keyring.keys[id] = key
+	}
+
+	if _, ok := keyring.keys[keyring.activeKeyId]; !ok {
+		return nil, fmt.Errorf("active master key %q: %w", keyring.activeKeyId, ErrMasterKeyNotFound)
+	}
+
+	return keyring, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+type encryptHeader struct {
+	keyId   string
+	dataKey []byte
+	chunk   int
+	size    int64 // 头部的字节数
+}
+
+func (k *Keyring) newHeader() ([]byte, *encryptHeader, error) {
+	dataKey := make([]byte, dataKeySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	master, err := newGCM(k.keys[k.activeKeyId])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, master.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped := master.Seal(nonce, nonce, dataKey, []byte(k.activeKeyId))
+	buf := &bytes.Buffer{}
+	buf.Write(encryptMagic)
+	buf.WriteByte(byte(len(k.activeKeyId)))
+	buf.WriteString(k.activeKeyId)
+	binary.Write(buf, binary.BigEndian, uint16(len(wrapped)))
+	buf.Write(wrapped)
+	binary.Write(buf, binary.BigEndian, uint32(encryptChunkSize))
+
+	return buf.Bytes(), &encryptHeader{
+		keyId:   k.activeKeyId,
+		dataKey: dataKey,
+		chunk:   encryptChunkSize,
+		size:    int64(buf.Len()),
+	}, nil
+}
+
+// readHeader 读取加密文件头，不是加密文件时返回 nil，未读取任何内容
+func (k *Keyring) readHeader(reader *bufio.Reader) (*encryptHeader, error) {
+	magic, err := reader.Peek(len(encryptMagic))
+	if err != nil || !bytes.Equal(magic, encryptMagic) {
+		return nil, nil
+	}
+	reader.Discard(len(encryptMagic))
+
+	header := &encryptHeader{size: int64(len(encryptMagic))}
+	idSize, err := reader.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("read encrypt header error: %w", err)
+	}
+
+	id := make([]byte, idSize)
+	var wrappedSize uint16
+	var chunkSize uint32
+	_, err = io.ReadFull(reader, id)
+	if err == nil {
+		err = binary.Read(reader, binary.BigEndian, &wrappedSize)
+	}
+
+	wrapped := make([]byte, wrappedSize)
+	if err == nil {
+		_, err = io.ReadFull(reader, wrapped)
+	}
+
+	if err == nil {
+		err = binary.Read(reader, binary.BigEndian, &chunkSize)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("read encrypt header error: %w", err)
+	}
+
+	if chunkSize == 0 || chunkSize > 16*1024*1024 {
+		return nil, fmt.Errorf("read encrypt header error: invalid chunk size %d", chunkSize)
+	}
+
+	header.keyId = string(id)
+	header.chunk = int(chunkSize)
+	header.size += 1 + int64(idSize) + 2 + int64(wrappedSize) + 4
+
+	key, ok := k.keys[header.keyId]
+	if !ok {
+		return nil, fmt.Errorf("decrypt file with key %s: %w", header.keyId, ErrMasterKeyNotFound)
+	}
+
+	master, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < master.NonceSize() {
+		return nil, fmt.Errorf("read encrypt header error: wrapped key is too short")
+	}
+
+	header.dataKey, err = master.Open(nil, wrapped[:master.NonceSize()], wrapped[master.NonceSize():], id)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key error: %w", err)
+	}
+
+	return header, nil
+}
+
+// plainSize 由加密文件的大小推算原文大小
+func (h *encryptHeader) plainSize(encryptedSize int64) int64 {
+	size := encryptedSize - h.size
+	if size <= 0 {
+		return 0
+	}
+
+	overhead := int64(16)
+	chunk := int64(h.chunk) + overhead
+	chunks := (size + chunk - 1) / chunk
+	return size - chunks*overhead
+}
+
+func chunkNonce(nonce []byte, index uint64, last bool) []byte {
+	binary.BigEndian.PutUint64(nonce, index)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+func (k *Keyring) encrypt(dst io.Writer, src io.Reader) error {
+	headerBytes, header, err := k.newHeader()
+	if err != nil {
+		return fmt.Errorf("create data key error: %w", err)
+	}
+
+	aead, err := newGCM(header.dataKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = dst.Write(headerBytes)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(src)
+	nonce := make([]byte, aead.NonceSize())
+	plain := make([]byte, header.chunk)
+	sealed := make([]byte, 0, header.chunk+aead.Overhead())
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(reader, plain)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+
+		if !last {
+			_, err = reader.Peek(1)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			last = err == io.EOF
+		}
+
+		sealed = aead.Seal(sealed[:0], chunkNonce(nonce, index, last), plain[:n], nil)
+		_, err = dst.Write(sealed)
+		if err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+type decryptReader struct {
+	reader  *bufio.Reader
+	closer  io.Closer
+	aead    cipher.AEAD
+	nonce   []byte
+	sealed  []byte
+	plain   []byte
+	pending []byte
+	index   uint64
+	done    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(d.reader, d.sealed)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, err
+		}
+
+		if !last {
+			_, err = d.reader.Peek(1)
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+			last = err == io.EOF
+		}
+
+		d.pending, err = d.aead.Open(d.plain[:0], chunkNonce(d.nonce, d.index, last), d.sealed[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("decrypt log file error: %w", err)
+		}
+
+		d.index++
+		d.done = last
+	}
+
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.closer.Close()
+}
+
+// decrypt 解密文件内容，未加密的历史文件原样返回；size 为加密后的大小，返回原文大小
+func (k *Keyring) decrypt(src io.ReadCloser, size int64) (io.ReadCloser, int64, string, error) {
+	reader := bufio.NewReader(src)
+	header, err := k.readHeader(reader)
+	if err != nil {
+		src.Close()
+		return nil, 0, "", err
+	}
+
+	if header == nil {
+		return &decodeReader{Reader: reader, close: src.Close}, size, "", nil
+	}
+
+	aead, err := newGCM(header.dataKey)
+	if err != nil {
+		src.Close()
+		return nil, 0, "", err
+	}
+
+	return &decryptReader{
+		reader: reader,
+		closer: src,
+		aead:   aead,
+		nonce:  make([]byte, aead.NonceSize()),
+		sealed: make([]byte, header.chunk+aead.Overhead()),
+		plain:  make([]byte, 0, header.chunk),
+	}, header.plainSize(size), header.keyId, nil
+}
+
+// Reencrypter 用当前主密钥重新加密已有的文件，返回文件是否被改写
+type Reencrypter interface {
+	ReencryptLog(fileId string) (bool, error)
+}
+
+// replacer 覆盖已存在的文件，SaveLog 在文件存在时不会写入
+type replacer interface {
+	ReplaceLog(log *LogFile) error
+}
+
+// EncryptApi 使用信封加密保存文件，每个文件使用单独的数据密钥，数据密钥由主密钥加密后保存在文件头
+type EncryptApi struct {
+	StorageApi
+	keyring *Keyring
+}
+
+func NewEncryptApi(storage StorageApi, c *config.EncryptionConfig) (StorageApi, error) {
+	keyring, err := NewKeyring(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptApi{
+		StorageApi: storage,
+		keyring:    keyring,
+	}, nil
+}
+
+// encryptStream 返回边读边加密的内容，调用方读取完成或出错后需要 Close
+func (e *EncryptApi) encryptStream(src io.Reader) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(e.keyring.encrypt(writer, src))
+	}()
+
+	return reader
+}
+
+func (e *EncryptApi) Close() error {
+	return Close(e.StorageApi)
+}
+
+func (e *EncryptApi) SaveLog(log *LogFile) error {
+	stream := e.encryptStream(log.FileSteam)
+	defer stream.Close()
+
+	return e.StorageApi.SaveLog(&LogFile{
+		Name:      log.Name,
+		FileId:    log.FileId,
+		Size:      log.Size,
+		Tags:      log.Tags,
+		Overwrite: log.Overwrite,
+		FileSteam: stream,
+	})
+}
+
+func (e *EncryptApi) Save(path string, data io.Reader) error {
+	stream := e.encryptStream(data)
+	defer stream.Close()
+
+	return e.StorageApi.Save(path, stream)
+}
+
+func (e *EncryptApi) GetLog(fileId string) (*LogFile, error) {
+	logFile, err := e.StorageApi.GetLog(fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	logFile.FileSteam, logFile.Size, _, err = e.keyring.decrypt(logFile.FileSteam, logFile.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	return logFile, nil
+}
+
+func (e *EncryptApi) Get(path string) (io.ReadCloser, int64, error) {
+	stream, size, err := e.StorageApi.Get(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stream, size, _, err = e.keyring.decrypt(stream, size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return stream, size, nil
+}
+
+// ReencryptLog 已经使用当前主密钥的文件跳过，未加密的历史文件会被加密
+func (e *EncryptApi) ReencryptLog(fileId string) (bool, error) {
+	replace, ok := e.StorageApi.(replacer)
+	if !ok {
+		return false, fmt.Errorf("storage does not support replacing files")
+	}
+
+	logFile, err := e.StorageApi.GetLog(fileId)
+	if err != nil {
+		return false, err
+	}
+
+	plain, _, keyId, err := e.keyring.decrypt(logFile.FileSteam, logFile.Size)
+	if err != nil {
+		return false, err
+	}
+	defer plain.Close()
+
+	if keyId == e.keyring.activeKeyId {
+		return false, nil
+	}
+
+	// 先完整写入临时文件，确认能够解密后再覆盖原文件
+	stream := e.encryptStream(plain)
+	defer stream.Close()
+	spool, err := NewSpoolFile(stream, 0)
+	if err != nil {
+		return false, err
+	}
+	defer spool.Close()
+
+	err = replace.ReplaceLog(&LogFile{
+		FileId:    fileId,
+		Size:      spool.Size,
+		FileSteam: spool,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -1,46 +1,132 @@
 package storage
 
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 )
 
-const logDirPath = "./log"
+// 记录当前目录结构的文件，目录结构变化后启动时重新迁移文件
+const layoutFileName = ".layout"
 
 type FileApi struct {
+	root   string
+	levels int
+}
+
+func (f *FileApi) layout() string {
+	return fmt.Sprintf("md5-prefix/%d", f.levels)
+}
+
+// logPath 文件放在由文件名 MD5 前缀组成的多级子目录中，避免单个目录下文件过多
+func (f *FileApi) logPath(fileId string) (string, error) {
+	if fileId == "" {
+		return "", fmt.Errorf("fileId is empty")
+	}
+
+	if strings.ContainsAny(fileId, `/\`) || fileId == "." || fileId == ".." {
+		return "", fmt.Errorf("fileId %s is invalid", fileId)
+	}
+
+	sum := md5.Sum([]byte(fileId))
+	prefix := hex.EncodeToString(sum[:])
+	parts := []string{f.root}
+	for i := 0; i < f.levels; i++ {
+		parts = append(parts, prefix[i*2:i*2+2])
+	}
+
+	return filepath.Join(append(parts, fileId)...), nil
 }
 
 func (f *FileApi) SaveLog(log *LogFile) error {
-	if log.FileId == "" {
-		return fmt.Errorf("create log file error: fileId is empty")
+	filePath, err := f.logPath(log.FileId)
+	if err != nil {
+		return fmt.Errorf("create log file error: %w", err)
 	}
 
-	filePath := fmt.Sprintf("%s/%s", logDirPath, log.FileId)
 	findFile, err := os.Stat(filePath)
-	if err == nil && findFile != nil {
+	if err == nil && findFile != nil && !log.Overwrite {
 		return nil
 	}
 
-	dst, err := os.Create(filePath)
+	return writeFile(filePath, log.FileSteam)
+}
+
+// writeFile 先写入同目录下的临时文件，fsync 后重命名，文件要么完整存在要么不存在
+func writeFile(path string, stream io.Reader) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("create log file dir error: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
 	if err != nil {
 		return fmt.Errorf("create log file error: %w", err)
 	}
 
-	defer dst.Close()
-	if _, err = dst.Write(log.UpdateFile); err != nil {
+	_, err = io.Copy(tmp, stream)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
 		return fmt.Errorf("create log file error: %w", err)
 	}
 
+	return syncDir(dir)
+}
+
+// syncDir 持久化目录项，保证重命名在断电后不会丢失
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open log file dir error: %w", err)
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("sync log file dir error: %w", err)
+	}
+
 	return nil
 }
 
-func (f *FileApi) ExistLog(fileId string) (bool, error) {
-	if fileId == "" {
-		return false, fmt.Errorf("get log file error: fileId is empty")
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp-")
+}
+
+// ReplaceLog 覆盖已存在的文件，写入失败时不影响原文件
+func (f *FileApi) ReplaceLog(log *LogFile) error {
+	filePath, err := f.logPath(log.FileId)
+	if err != nil {
+		return fmt.Errorf("replace log file error: %w", err)
 	}
 
-	logFilePath := fmt.Sprintf("%s/%s", logDirPath, fileId)
+	return writeFile(filePath, log.FileSteam)
+}
+
+func (f *FileApi) ExistLog(fileId string) (bool, error) {
+	logFilePath, err := f.logPath(fileId)
+	if err != nil {
+		return false, fmt.Errorf("get log file error: %w", err)
+	}
 
 	return f.Exist(logFilePath)
 }
@@ -63,12 +149,11 @@ func (f *FileApi) Exist(path string) (bool, error) {
 }
 
 func (f *FileApi) GetLog(fileId string) (*LogFile, error) {
-	if fileId == "" {
-		return nil, fmt.Errorf("get log file error: fileId is empty")
+	logFilePath, err := f.logPath(fileId)
+	if err != nil {
+		return nil, fmt.Errorf("get log file error: %w", err)
 	}
 
-	logFilePath := fmt.Sprintf("%s/%s", logDirPath, fileId)
-
 	fileSteam, fileSize, err := f.Get(logFilePath)
 	if err != nil {
 		return nil, err
@@ -81,28 +166,13 @@ func (f *FileApi) GetLog(fileId string) (*LogFile, error) {
 	}, nil
 }
 
-func (f *FileApi) Save(path string, stream io.ReadSeeker) error {
+func (f *FileApi) Save(path string, stream io.Reader) error {
 	findFile, err := os.Stat(path)
 	if err == nil && findFile != nil {
 		return nil
 	}
 
-	dst, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("create log file error: %w", err)
-	}
-
-	data, err := io.ReadAll(stream)
-	if err != nil {
-		return err
-	}
-
-	defer dst.Close()
-	if _, err = dst.Write(data); err != nil {
-		return fmt.Errorf("create log file error: %w", err)
-	}
-
-	return nil
+	return writeFile(path, stream)
 }
 
 func (f *FileApi) Get(path string) (io.ReadCloser, int64, error) {
@@ -120,20 +190,117 @@ func (f *FileApi) Get(path string) (io.ReadCloser, int64, error) {
 }
 
 func (f *FileApi) RemoveLog(fileId string) error {
-	if fileId == "" {
-		return fmt.Errorf("remove log file error: fileId is empty")
+	filePath, err := f.logPath(fileId)
+	if err != nil {
+		return fmt.Errorf("remove log file error: %w", err)
 	}
 
-	filePath := fmt.Sprintf("%s/%s", logDirPath, fileId)
-	_, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
+	err = os.Remove(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove log file error: %w", err)
+	}
+
+	return nil
+}
+
+// logFileName 日志文件名是 <机器 ID>.<32 位十六进制>，压缩的文件带压缩扩展名
+var logFileName = regexp.MustCompile(`^[0-9A-Za-z_-]+\.[0-9a-f]{32}(\.gz|\.zst)?$`)
+
+// shardDirName 目录结构中的子目录名是两位十六进制
+var shardDirName = regexp.MustCompile(`^[0-9a-f]{2}$`)
+
+// 目录结构最多的层数
+const maxShardLevels = 4
+
+// migrate 把不在当前目录结构中的文件移动到对应的子目录，比如之前直接放在根目录下的文件
+// 目录结构没有变化时跳过，避免每次启动都遍历所有文件
+func (f *FileApi) migrate() error {
+	layoutPath := filepath.Join(f.root, layoutFileName)
+	current, err := os.ReadFile(layoutPath)
+	if err == nil && string(current) == f.layout() {
 		return nil
 	}
 
-	err = os.Remove(filePath)
+	moved, err := f.migrateDir(f.root, 0)
 	if err != nil {
-		return fmt.Errorf("remove log file error: %w", err)
+		return fmt.Errorf("migrate log files error: %w", err)
 	}
 
-	return nil
+	if moved > 0 {
+		log.Infof("migrate log files to layout %s finished, moved %d files", f.layout(), moved)
+	}
+
+	return writeFile(layoutPath, strings.NewReader(f.layout()))
+}
+
+// migrateDir 只处理根目录和之前目录结构的子目录中符合日志文件名的文件
+// 根目录下的其它目录和文件不是日志文件，比如 data 目录下的数据库文件，保持不变
+func (f *FileApi) migrateDir(dir string, depth int) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if depth >= maxShardLevels || !shardDirName.MatchString(entry.Name()) {
+				continue
+			}
+
+			n, err := f.migrateDir(path, depth+1)
+			moved += n
+			if err != nil {
+				return moved, err
+			}
+
+			// 删除旧目录结构留下的空目录，不为空时删除失败
+			os.Remove(path)
+			continue
+		}
+
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		// 中断的写入留下的临时文件
+		if isTempFile(entry.Name()) {
+			err := os.Remove(path)
+			if err != nil {
+				return moved, err
+			}
+			continue
+		}
+
+		if !logFileName.MatchString(entry.Name()) {
+			continue
+		}
+
+		expected, err := f.logPath(entry.Name())
+		if err != nil {
+			return moved, err
+		}
+
+		if expected == path {
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(expected), os.ModePerm)
+		if err != nil {
+			return moved, err
+		}
+
+		err = os.Rename(path, expected)
+		if err != nil {
+			return moved, err
+		}
+
+		moved++
+		if moved%10000 == 0 {
+			log.Infof("migrate log files to layout %s, moved %d files", f.layout(), moved)
+		}
+	}
+
+	return moved, nil
 }
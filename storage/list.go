@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// LogInfo 存储中保存的一个日志文件
+type LogInfo struct {
+	FileId  string
+	Size    int64
+	ModTime time.Time
+	// 压缩保存的文件，FileId 为去掉扩展名后的 ID，Size 为压缩后的大小
+	Encoding string
+	// 经过 EncryptApi 的文件，Size 包含加密的文件头，未加密的历史文件也会被标记
+	Encrypted bool
+}
+
+// 不能遍历的存储返回错误，不能当作没有文件处理
+var ErrListNotSupported = errors.New("storage does not support listing log files")
+
+// Lister 遍历存储中所有的日志文件，按路径保存的其它文件不包含在内
+type Lister interface {
+	ListLogs(fn func(info *LogInfo) error) error
+}
+
+func (f *FileApi) ListLogs(fn func(info *LogInfo) error) error {
+	return filepath.WalkDir(f.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() || d.Name() == layoutFileName || isTempFile(d.Name()) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return fn(&LogInfo{
+			FileId:  d.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	})
+}
+
+// ListLogs 只列出日志目录下的一层对象，子目录中的数据库同步文件不包含在内
+func (a *RemoteApi) ListLogs(fn func(info *LogInfo) error) error {
+	prefix := a.joinPath("") + "/"
+	var fnErr error
+	err := a.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(a.config.Bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			if a.deleter.isPending(key) {
+				continue
+			}
+
+			fnErr = fn(&LogInfo{
+				FileId:  strings.TrimPrefix(key, prefix),
+				Size:    aws.Int64Value(object.Size),
+				ModTime: aws.TimeValue(object.LastModified),
+			})
+			if fnErr != nil {
+				return false
+			}
+		}
+
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+
+	return err
+}
+
+// ListLogs 迁移过程中的文件可能在两层存储中各出现一次
+func (t *TieredApi) ListLogs(fn func(info *LogInfo) error) error {
+	err := t.hot.ListLogs(fn)
+	if err != nil {
+		return err
+	}
+
+	cold, ok := t.cold.(Lister)
+	if !ok {
+		return ErrListNotSupported
+	}
+
+	return cold.ListLogs(fn)
+}
+
+func (e *EncryptApi) ListLogs(fn func(info *LogInfo) error) error {
+	lister, ok := e.StorageApi.(Lister)
+	if !ok {
+		return ErrListNotSupported
+	}
+
+	return lister.ListLogs(func(info *LogInfo) error {
+		info.Encrypted = true
+		return fn(info)
+	})
+}
+
+// ListLogs 把压缩文件的扩展名去掉，得到与未压缩时相同的 ID
+func (c *CompressApi) ListLogs(fn func(info *LogInfo) error) error {
+	lister, ok := c.StorageApi.(Lister)
+	if !ok {
+		return ErrListNotSupported
+	}
+
+	return lister.ListLogs(func(info *LogInfo) error {
+		for encoding, extension := range encodingExtensions {
+			if fileId, found := strings.CutSuffix(info.FileId, extension); found {
+				info.FileId = fileId
+				info.Encoding = encoding
+				break
+			}
+		}
+
+		return fn(info)
+	})
+}
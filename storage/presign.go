@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"time"
+)
+
+type PresignRequest struct {
+	FileId string
+	// 下载时的文件名
+	Name   string
+	Expire time.Duration
+	// 上传时文件的大小，上传的内容必须与该大小一致
+	Size int64
+	// 客户端的 Accept-Encoding 请求头，不接受文件的压缩编码时不能直接从存储下载
+	AcceptEncoding string
+	// 文件实际保存的压缩编码，由 CompressApi 设置
+	Encoding string
+}
+
+// Presigner 生成直接从存储下载或上传文件的临时地址
+type Presigner interface {
+	// PresignLog 返回空地址表示文件不能直接从存储下载，比如文件在本地磁盘或者是加密保存的
+	PresignLog(req *PresignRequest) (string, error)
+	// PresignSaveLog 返回空地址表示不能直接上传到存储
+	PresignSaveLog(req *PresignRequest) (string, error)
+}
+
+func (c *CompressApi) PresignLog(req *PresignRequest) (string, error) {
+	// 加密保存的文件只能由节点解密，EncryptApi 没有实现 Presigner
+	presigner, ok := c.StorageApi.(Presigner)
+	if !ok {
+		return "", nil
+	}
+
+	encoding, exist, err := c.locate(req.FileId)
+	if err != nil || !exist {
+		return "", err
+	}
+
+	if !AcceptEncoding(req.AcceptEncoding, encoding) {
+		return "", nil
+	}
+
+	presign := *req
+	presign.FileId = encodedFileId(req.FileId, encoding)
+	presign.Encoding = encoding
+	return presigner.PresignLog(&presign)
+}
+
+// PresignSaveLog 直接上传的文件不经过压缩，读取时按未压缩的文件处理
+func (c *CompressApi) PresignSaveLog(req *PresignRequest) (string, error) {
+	presigner, ok := c.StorageApi.(Presigner)
+	if !ok {
+		return "", nil
+	}
+
+	return presigner.PresignSaveLog(req)
+}
+
+// PresignLog 还没有迁移到 S3 的文件只能从本地读取
+func (t *TieredApi) PresignLog(req *PresignRequest) (string, error) {
+	exist, err := t.hot.ExistLog(req.FileId)
+	if err != nil || exist {
+		return "", err
+	}
+
+	presigner, ok := t.cold.(Presigner)
+	if !ok {
+		return "", nil
+	}
+
+	return presigner.PresignLog(req)
+}
+
+// PresignSaveLog 直接上传的文件保存在 S3，读取时会从本地找不到后继续查找 S3
+func (t *TieredApi) PresignSaveLog(req *PresignRequest) (string, error) {
+	presigner, ok := t.cold.(Presigner)
+	if !ok {
+		return "", nil
+	}
+
+	return presigner.PresignSaveLog(req)
+}
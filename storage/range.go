@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// RangeNotSatisfiableError 范围超出文件大小，416 响应需要在 Content-Range 中返回文件大小
+type RangeNotSatisfiableError struct {
+	Size int64
+}
+
+func (e *RangeNotSatisfiableError) Error() string {
+	return fmt.Sprintf("%s, file size is %d bytes", ErrRangeNotSatisfiable.Error(), e.Size)
+}
+
+func (e *RangeNotSatisfiableError) Is(target error) bool {
+	return target == ErrRangeNotSatisfiable
+}
+
+// ByteRange 文件原始内容中的一段
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+func (r *ByteRange) End() int64 {
+	return r.Start + r.Length - 1
+}
+
+// ParseRange 解析 Range 请求头，只支持单个范围，多个范围或者无法识别的格式返回 nil，按读取整个文件处理
+func ParseRange(header string, size int64) (*ByteRange, error) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+
+	startText, endText, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return nil, nil
+	}
+
+	// bytes=-n 表示最后 n 个字节
+	if startText == "" {
+		suffix, err := strconv.ParseInt(endText, 10, 64)
+		if err != nil || suffix < 0 {
+			return nil, nil
+		}
+
+		if suffix == 0 || size == 0 {
+			return nil, &RangeNotSatisfiableError{Size: size}
+		}
+
+		suffix = min(suffix, size)
+		return &ByteRange{Start: size - suffix, Length: suffix}, nil
+	}
+
+	start, err := strconv.ParseInt(startText, 10, 64)
+	if err != nil || start < 0 {
+		return nil, nil
+	}
+
+	end := size - 1
+	if endText != "" {
+		end, err = strconv.ParseInt(endText, 10, 64)
+		if err != nil || end < start {
+			return nil, nil
+		}
+		end = min(end, size-1)
+	}
+
+	if start >= size {
+		return nil, &RangeNotSatisfiableError{Size: size}
+	}
+
+	return &ByteRange{Start: start, Length: end - start + 1}, nil
+}
+
+// RangeGetter 读取文件的一部分，范围按原始内容计算，返回的 Size 为读取的长度
+type RangeGetter interface {
+	GetLogRange(fileId string, r *ByteRange) (*LogFile, error)
+}
+
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+func (f *FileApi) GetLogRange(fileId string, r *ByteRange) (*LogFile, error) {
+	logFilePath, err := f.logPath(fileId)
+	if err != nil {
+		return nil, fmt.Errorf("get log file error: %w", err)
+	}
+
+	file, err := os.Open(logFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("open log file error: %w", err)
+	}
+
+	_, err = file.Seek(r.Start, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("seek log file error: %w", err)
+	}
+
+	return &LogFile{
+		FileId:    fileId,
+		Size:      r.Length,
+		FileSteam: &rangeReader{Reader: io.LimitReader(file, r.Length), Closer: file},
+	}, nil
+}
+
+func (a *RemoteApi) GetLogRange(fileId string, r *ByteRange) (*LogFile, error) {
+	path := a.joinPath(fileId)
+	if a.deleter.isPending(path) {
+		return nil, fmt.Errorf("%w, object %s is deleted", ErrLogNotFound, path)
+	}
+
+	result, err := a.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(a.config.Bucket),
+		Key:    aws.String(path),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", r.Start, r.End())),
+	})
+	if isS3NotFound(err) {
+		return nil, fmt.Errorf("%w, object %s", ErrLogNotFound, path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &LogFile{
+		FileId:    fileId,
+		Size:      aws.Int64Value(result.ContentLength),
+		FileSteam: result.Body,
+	}, nil
+}
+
+func (t *TieredApi) GetLogRange(fileId string, r *ByteRange) (*LogFile, error) {
+	exist, err := t.hot.ExistLog(fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	if exist {
+		logFile, err := t.hot.GetLogRange(fileId, r)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return logFile, err
+		}
+		// 读取前刚好被迁移到 S3，继续从 S3 读取
+	}
+
+	cold, ok := t.cold.(RangeGetter)
+	if !ok {
+		return nil, fmt.Errorf("storage does not support reading range of files")
+	}
+
+	return cold.GetLogRange(fileId, r)
+}
+
+// GetLogRange 未压缩且底层存储支持时直接读取对应的范围，否则解压或解密后跳过范围之前的内容
+func (c *CompressApi) GetLogRange(fileId string, r *ByteRange) (*LogFile, error) {
+	encoding, exist, err := c.locate(fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exist {
+		return nil, fmt.Errorf("%w, file id %s", ErrLogNotFound, fileId)
+	}
+
+	if rangeGetter, ok := c.StorageApi.(RangeGetter); ok && encoding == EncodingIdentity {
+		return rangeGetter.GetLogRange(fileId, r)
+	}
+
+	logFile, err := c.StorageApi.GetLog(encodedFileId(fileId, encoding))
+	if err != nil {
+		return nil, err
+	}
+
+	logFile.Encoding = encoding
+	err = logFile.Decode()
+	if err != nil {
+		logFile.FileSteam.Close()
+		return nil, err
+	}
+
+	_, err = io.CopyN(io.Discard, logFile.FileSteam, r.Start)
+	if err != nil {
+		logFile.FileSteam.Close()
+		return nil, fmt.Errorf("skip log file error: %w", err)
+	}
+
+	return &LogFile{
+		FileId:    fileId,
+		Size:      r.Length,
+		FileSteam: &rangeReader{Reader: io.LimitReader(logFile.FileSteam, r.Length), Closer: logFile.FileSteam},
+	}, nil
+}
@@ -1,9 +1,9 @@
 package storage
 
 import (
-	"bytes"
 	"fmt"
 	"io"
+	"mime"
 	"path"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -11,19 +11,19 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/warjiang/page-spy-api/config"
 )
 
+// RemoteApi 所有请求共用一个 S3 客户端，大文件使用分片并发上传，删除在后台批量执行
 type RemoteApi struct {
-	config *config.StorageConfig
+	config   *config.StorageConfig
+	svc      *s3.S3
+	uploader *s3manager.Uploader
+	deleter  *s3Deleter
 }
 
-func (a *RemoteApi) joinPath(id string) string {
-	return path.Join(a.config.BaseDir, a.config.GetLogDir(), id)
-}
-
-func (a *RemoteApi) newSession() (*session.Session, error) {
-	config := a.config
+func newRemoteApi(config *config.StorageConfig) (*RemoteApi, error) {
 	session, err := session.NewSession(&aws.Config{
 		Region:           aws.String(config.Region),
 		Credentials:      credentials.NewStaticCredentials(config.KeyId, config.Secret, ""),
@@ -31,19 +31,33 @@ func (a *RemoteApi) newSession() (*session.Session, error) {
 		S3ForcePathStyle: aws.Bool(config.S3ForcePathStyle),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create sessionion: %w", err)
+		return nil, fmt.Errorf("failed to create session: %w", err)
 	}
-	return session, nil
-}
 
-func (a *RemoteApi) Save(path string, data io.ReadSeeker) error {
-	session, err := a.newSession()
-	if err != nil {
-		return err
-	}
 	svc := s3.New(session)
+	uploader := s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+		u.PartSize = config.GetUploadPartSizeOfMB() * 1024 * 1024
+		u.Concurrency = config.GetUploadConcurrency()
+	})
+
+	return &RemoteApi{
+		config:   config,
+		svc:      svc,
+		uploader: uploader,
+		deleter:  newS3Deleter(svc, config.Bucket),
+	}, nil
+}
+
+func (a *RemoteApi) joinPath(id string) string {
+	return path.Join(a.config.BaseDir, a.config.GetLogDir(), id)
+}
+
+// Save 小于分片大小的内容使用一次 PutObject 上传，更大的内容自动分片上传
+func (a *RemoteApi) Save(path string, data io.Reader) error {
+	// 重新写入等待删除的对象时取消删除
+	a.deleter.cancel(path)
 
-	_, err = svc.PutObject(&s3.PutObjectInput{
+	_, err := a.uploader.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(a.config.Bucket),
 		Key:    aws.String(path),
 		Body:   data,
@@ -51,61 +65,65 @@ func (a *RemoteApi) Save(path string, data io.ReadSeeker) error {
 	})
 
 	if err != nil {
-		return fmt.Errorf("failed to put object: %w", err)
+		return fmt.Errorf("failed to upload object: %w", err)
 	}
 	return nil
 }
 
 func (a *RemoteApi) SaveLog(log *LogFile) error {
-	err := a.Save(a.joinPath(log.FileId), bytes.NewReader(log.UpdateFile))
+	return a.Save(a.joinPath(log.FileId), log.FileSteam)
+}
 
-	if err != nil {
-		return fmt.Errorf("failed to put object: %w", err)
-	}
-	return nil
+// ReplaceLog 上传会直接覆盖同名对象
+func (a *RemoteApi) ReplaceLog(log *LogFile) error {
+	return a.SaveLog(log)
 }
 
 func (a *RemoteApi) Exist(path string) (bool, error) {
-	session, err := a.newSession()
-	if err != nil {
-		return false, err
+	if a.deleter.isPending(path) {
+		return false, nil
 	}
-	svc := s3.New(session)
 
-	_, err = svc.HeadObject(&s3.HeadObjectInput{
+	_, err := a.svc.HeadObject(&s3.HeadObjectInput{
 		Bucket: aws.String(a.config.Bucket),
 		Key:    aws.String(path),
 	})
 
-	if err != nil {
-		s3Error, ok := err.(awsErr.Error)
-		if ok && (s3Error.Code() == s3.ErrCodeNoSuchKey || s3Error.Code() == "NotFound") {
-			return false, nil
-		}
+	if isS3NotFound(err) {
+		return false, nil
+	}
 
+	if err != nil {
 		return false, err
 	}
 
 	return true, nil
 }
 
+func isS3NotFound(err error) bool {
+	s3Error, ok := err.(awsErr.Error)
+	return ok && (s3Error.Code() == s3.ErrCodeNoSuchKey || s3Error.Code() == "NotFound")
+}
+
 func (a *RemoteApi) Get(path string) (io.ReadCloser, int64, error) {
-	session, err := a.newSession()
-	if err != nil {
-		return nil, 0, err
+	if a.deleter.isPending(path) {
+		return nil, 0, fmt.Errorf("%w, object %s is deleted", ErrLogNotFound, path)
 	}
-	svc := s3.New(session)
 
-	result, err := svc.GetObject(&s3.GetObjectInput{
+	result, err := a.svc.GetObject(&s3.GetObjectInput{
 		Bucket: aws.String(a.config.Bucket),
 		Key:    aws.String(path),
 	})
 
+	if isS3NotFound(err) {
+		return nil, 0, fmt.Errorf("%w, object %s", ErrLogNotFound, path)
+	}
+
 	if err != nil {
 		return nil, 0, err
 	}
 
-	return result.Body, *result.ContentLength, nil
+	return result.Body, aws.Int64Value(result.ContentLength), nil
 }
 
 func (a *RemoteApi) ExistLog(fileId string) (bool, error) {
@@ -125,29 +143,68 @@ func (a *RemoteApi) GetLog(fileId string) (*LogFile, error) {
 	}, nil
 }
 
+// RemoveLog 只把对象加入删除队列，之后读取时视为不存在
 func (a *RemoteApi) RemoveLog(fileId string) error {
-	session, err := a.newSession()
-	if err != nil {
-		return err
+	a.deleter.remove(a.joinPath(fileId))
+	return nil
+}
+
+// Close 删除队列中剩余的对象，包括等待重试的对象
+func (a *RemoteApi) Close() error {
+	return a.deleter.flush(deleteFlushTimeout)
+}
+
+// PresignLog 生成预签名的下载地址，下载时的文件名和压缩编码通过响应头覆盖参数指定
+func (a *RemoteApi) PresignLog(req *PresignRequest) (string, error) {
+	path := a.joinPath(req.FileId)
+	if a.deleter.isPending(path) {
+		return "", fmt.Errorf("%w, object %s is deleted", ErrLogNotFound, path)
 	}
-	svc := s3.New(session)
 
-	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(a.config.Bucket),
-		Key:    aws.String(a.joinPath(fileId)),
-	})
+	name := req.Name
+	if name == "" {
+		name = req.FileId
+	}
+
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": name})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket:                     aws.String(a.config.Bucket),
+		Key:                        aws.String(path),
+		ResponseContentDisposition: aws.String(disposition),
+		ResponseContentType:        aws.String("application/octet-stream"),
+	}
+	if req.Encoding != EncodingIdentity {
+		input.ResponseContentEncoding = aws.String(req.Encoding)
+	}
+
+	request, _ := a.svc.GetObjectRequest(input)
+	url, err := request.Presign(req.Expire)
 	if err != nil {
-		return fmt.Errorf("failed to delete object: %w", err)
+		return "", fmt.Errorf("failed to presign object: %w", err)
 	}
 
-	err = svc.WaitUntilObjectNotExists(&s3.HeadObjectInput{
-		Bucket: aws.String(a.config.Bucket),
-		Key:    aws.String(a.joinPath(fileId)),
-	})
+	return url, nil
+}
 
+// PresignSaveLog 生成预签名的上传地址，签名包含文件大小，上传的内容大小不一致时 S3 会拒绝
+func (a *RemoteApi) PresignSaveLog(req *PresignRequest) (string, error) {
+	path := a.joinPath(req.FileId)
+	a.deleter.cancel(path)
+
+	request, _ := a.svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:        aws.String(a.config.Bucket),
+		Key:           aws.String(path),
+		ContentLength: aws.Int64(req.Size),
+		ACL:           aws.String("private"),
+	})
+	url, err := request.Presign(req.Expire)
 	if err != nil {
-		return fmt.Errorf("error occurred while waiting for object to be deleted: %w", err)
+		return "", fmt.Errorf("failed to presign object: %w", err)
 	}
 
-	return nil
+	return url, nil
 }
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DeleteObjects 单次最多删除 1000 个对象
+const maxDeleteBatch = 1000
+
+// 等待一小段时间，把同一时间删除的对象合并成一次请求，比如删除整个日志组
+const deleteBatchWait = 200 * time.Millisecond
+
+// 删除失败后第一次重试的等待时间，之后每次翻倍
+const deleteRetryWait = time.Second
+
+// 超过重试次数后放弃，对象留在 S3 中，由存储检查任务作为没有记录引用的文件删除
+const maxDeleteAttempts = 5
+
+// 进程退出前等待删除完成的最长时间
+const deleteFlushTimeout = 30 * time.Second
+
+// s3Deleter 在后台批量删除对象，等待删除的对象可以被重新写入时取消
+// 删除失败的对象按退避时间重新加入队列，进程退出前调用 flush 删除剩余的对象
+type s3Deleter struct {
+	svc    *s3.S3
+	bucket string
+	lock   sync.Mutex
+	cond   *sync.Cond
+	// 对象和已经失败的次数
+	pending  map[string]int
+	retrying map[string]int
+	inflight map[string]int
+	notify   chan struct{}
+	// 第一次重试的等待时间
+	retryWait time.Duration
+}
+
+func newS3Deleter(svc *s3.S3, bucket string) *s3Deleter {
+	d := &s3Deleter{
+		svc:       svc,
+		bucket:    bucket,
+		pending:   map[string]int{},
+		retrying:  map[string]int{},
+		inflight:  map[string]int{},
+		notify:    make(chan struct{}, 1),
+		retryWait: deleteRetryWait,
+	}
+	d.cond = sync.NewCond(&d.lock)
+
+	go d.run()
+	return d
+}
+
+func (d *s3Deleter) wake() {
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (d *s3Deleter) remove(key string) {
+	d.lock.Lock()
+	if _, ok := d.retrying[key]; !ok {
+		d.pending[key] = 0
+	}
+	d.lock.Unlock()
+
+	d.wake()
+}
+
+// cancel 取消等待中和等待重试的删除，正在删除时等待删除完成，之后写入的对象不会被删除
+func (d *s3Deleter) cancel(key string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.pending, key)
+	for {
+		if _, ok := d.inflight[key]; !ok {
+			break
+		}
+		d.cond.Wait()
+	}
+
+	// 正在删除的对象失败后会等待重试，同样取消
+	delete(d.retrying, key)
+}
+
+func (d *s3Deleter) isPending(key string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, pending := d.pending[key]
+	_, retrying := d.retrying[key]
+	_, inflight := d.inflight[key]
+	return pending || retrying || inflight
+}
+
+func (d *s3Deleter) take() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	keys := []string{}
+	for key, attempts := range d.pending {
+		if len(keys) >= maxDeleteBatch {
+			break
+		}
+
+		keys = append(keys, key)
+		delete(d.pending, key)
+		d.inflight[key] = attempts
+	}
+
+	return keys
+}
+
+// done 删除失败的对象等待一段时间后重新加入队列，删除期间被取消的对象不再重试
+func (d *s3Deleter) done(keys []string, failed map[string]error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, key := range keys {
+		attempts := d.inflight[key] + 1
+		delete(d.inflight, key)
+
+		err, ok := failed[key]
+		if !ok {
+			continue
+		}
+
+		if attempts >= maxDeleteAttempts {
+			log.Errorf("give up deleting object %s after %d attempts, last error %s", key, attempts, err.Error())
+			continue
+		}
+
+		d.retrying[key] = attempts
+		key := key
+		time.AfterFunc(d.retryWait<<(attempts-1), func() {
+			d.requeue(key, attempts)
+		})
+	}
+	d.cond.Broadcast()
+}
+
+// requeue 等待期间被取消或者已经由 flush 加入队列的对象不再处理
+func (d *s3Deleter) requeue(key string, attempts int) {
+	d.lock.Lock()
+	current, ok := d.retrying[key]
+	if ok && current == attempts {
+		delete(d.retrying, key)
+		d.pending[key] = attempts
+	}
+	d.lock.Unlock()
+
+	d.wake()
+}
+
+func (d *s3Deleter) run() {
+	for range d.notify {
+		time.Sleep(deleteBatchWait)
+		for {
+			keys := d.take()
+			if len(keys) == 0 {
+				break
+			}
+
+			d.done(keys, d.deleteObjects(keys))
+		}
+	}
+}
+
+// flush 不再等待重试的时间，立即删除队列中的所有对象，直到全部完成或者超时
+func (d *s3Deleter) flush(timeout time.Duration) error {
+	timer := time.AfterFunc(timeout, func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		d.cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	deadline := time.Now().Add(timeout)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for {
+		for key, attempts := range d.retrying {
+			delete(d.retrying, key)
+			d.pending[key] = attempts
+		}
+
+		remaining := len(d.pending) + len(d.retrying) + len(d.inflight)
+		if remaining == 0 {
+			return nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%d objects are not deleted before exit", remaining)
+		}
+
+		d.wake()
+		d.cond.Wait()
+	}
+}
+
+// deleteObjects 返回删除失败的对象和原因，请求失败时所有对象都失败
+func (d *s3Deleter) deleteObjects(keys []string) map[string]error {
+	objects := make([]*s3.ObjectIdentifier, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+	}
+
+	failed := map[string]error{}
+	result, err := d.svc.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(d.bucket),
+		Delete: &s3.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	if err != nil {
+		log.Errorf("delete %d objects error %s", len(keys), err.Error())
+		for _, key := range keys {
+			failed[key] = err
+		}
+		return failed
+	}
+
+	for _, e := range result.Errors {
+		err := fmt.Errorf("%s: %s", aws.StringValue(e.Code), aws.StringValue(e.Message))
+		log.Errorf("delete object %s error %s", aws.StringValue(e.Key), err.Error())
+		failed[aws.StringValue(e.Key)] = err
+	}
+
+	log.Debugf("delete %d objects, %d failed", len(keys), len(failed))
+	return failed
+}
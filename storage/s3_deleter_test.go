@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func waitDeleted(t *testing.T, d *s3Deleter, key string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for d.isPending(key) {
+		if time.Now().After(deadline) {
+			t.Fatalf("object %s is still pending", key)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeleterRetriesFailedObjects(t *testing.T) {
+	api, backend := newTestRemoteApi(t)
+	api.deleter.retryWait = 10 * time.Millisecond
+	saveTestLog(t, api, "local.a", []byte("a"))
+	saveTestLog(t, api, "local.b", []byte("b"))
+
+	key := api.joinPath("local.a")
+	backend.failDelete(key, 2)
+	api.RemoveLog("local.a")
+	api.RemoveLog("local.b")
+	waitDeleted(t, api.deleter, key)
+
+	if objectExists(t, backend, key) {
+		t.Fatal("expect failed object to be deleted by retries")
+	}
+
+	if objectExists(t, backend, api.joinPath("local.b")) {
+		t.Fatal("expect object in the same batch to be deleted")
+	}
+
+	if calls := backend.getDeleteCalls(); calls != 3 {
+		t.Fatalf("expect 1 request and 2 retries, got %d requests", calls)
+	}
+}
+
+func TestDeleterGivesUpAfterMaxAttempts(t *testing.T) {
+	api, backend := newTestRemoteApi(t)
+	api.deleter.retryWait = time.Millisecond
+	saveTestLog(t, api, "local.a", []byte("a"))
+
+	key := api.joinPath("local.a")
+	backend.failDelete(key, -1)
+	api.RemoveLog("local.a")
+	waitDeleted(t, api.deleter, key)
+
+	if !objectExists(t, backend, key) {
+		t.Fatal("expect object to be kept when every delete fails")
+	}
+
+	if calls := backend.getDeleteCalls(); calls != maxDeleteAttempts {
+		t.Fatalf("expect %d attempts, got %d", maxDeleteAttempts, calls)
+	}
+}
+
+func TestDeleterFlushSkipsRetryWait(t *testing.T) {
+	api, backend := newTestRemoteApi(t)
+	api.deleter.retryWait = time.Hour
+	saveTestLog(t, api, "local.a", []byte("a"))
+
+	key := api.joinPath("local.a")
+	backend.failDelete(key, 1)
+	api.RemoveLog("local.a")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for backend.getDeleteCalls() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expect first delete request to be sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err := api.deleter.flush(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if objectExists(t, backend, key) {
+		t.Fatal("expect object waiting for retry to be deleted by flush")
+	}
+}
+
+func TestDeleterFlushTimeout(t *testing.T) {
+	api, backend := newTestRemoteApi(t)
+	saveTestLog(t, api, "local.a", []byte("a"))
+
+	backend.failDelete(api.joinPath("local.a"), -1)
+	api.RemoveLog("local.a")
+
+	err := api.deleter.flush(deleteBatchWait / 2)
+	if err == nil {
+		t.Fatal("expect flush to report objects not deleted")
+	}
+}
+
+func TestDeleterCancelWaitingRetry(t *testing.T) {
+	api, backend := newTestRemoteApi(t)
+	api.deleter.retryWait = 50 * time.Millisecond
+	saveTestLog(t, api, "local.a", []byte("a"))
+
+	key := api.joinPath("local.a")
+	backend.failDelete(key, 1)
+	api.RemoveLog("local.a")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for backend.getDeleteCalls() == 0 || !api.deleter.isPending(key) {
+		if time.Now().After(deadline) {
+			t.Fatal("expect object to wait for retry")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// 等待重试期间重新写入
+	saveTestLog(t, api, "local.a", []byte("new"))
+	time.Sleep(4 * api.deleter.retryWait)
+	err := api.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !objectExists(t, backend, key) {
+		t.Fatal("expect object written again not to be deleted by retry")
+	}
+
+	if calls := backend.getDeleteCalls(); calls != 1 {
+		t.Fatalf("expect no retry after cancel, got %d requests", calls)
+	}
+}
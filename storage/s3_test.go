@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/warjiang/page-spy-api/config"
+)
+
+const testBucket = "bucket"
+
+// faultyBackend 在内存 S3 之上模拟删除失败，记录批量删除的请求次数
+type faultyBackend struct {
+	gofakes3.Backend
+	lock sync.Mutex
+	// 对象还要失败的次数，小于 0 表示一直失败
+	failures    map[string]int
+	deleteCalls int
+}
+
+func (b *faultyBackend) failDelete(key string, times int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures[key] = times
+}
+
+func (b *faultyBackend) getDeleteCalls() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.deleteCalls
+}
+
+func (b *faultyBackend) DeleteMulti(bucketName string, objects ...string) (gofakes3.MultiDeleteResult, error) {
+	b.lock.Lock()
+	b.deleteCalls++
+	keys := []string{}
+	failed := []gofakes3.ErrorResult{}
+	for _, key := range objects {
+		times, ok := b.failures[key]
+		if !ok || times == 0 {
+			keys = append(keys, key)
+			continue
+		}
+
+		if times > 0 {
+			b.failures[key] = times - 1
+		}
+		failed = append(failed, gofakes3.ErrorResult{Key: key, Code: gofakes3.ErrInternal, Message: "injected failure"})
+	}
+	b.lock.Unlock()
+
+	result, err := b.Backend.DeleteMulti(bucketName, keys...)
+	result.Error = append(result.Error, failed...)
+	return result, err
+}
+
+func newTestRemoteApi(t *testing.T) (*RemoteApi, *faultyBackend) {
+	t.Helper()
+	// 环境中的 AWS_CA_BUNDLE 会让 SDK 修改共用的 http.DefaultClient
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	backend := &faultyBackend{Backend: s3mem.New(), failures: map[string]int{}}
+	err := backend.CreateBucket(testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(gofakes3.New(backend).Server())
+	t.Cleanup(server.Close)
+
+	api, err := newRemoteApi(&config.StorageConfig{
+		BaseDir:          "base",
+		KeyId:            "key",
+		Secret:           "secret",
+		Region:           "us-east-1",
+		Endpoint:         server.URL,
+		Bucket:           testBucket,
+		S3ForcePathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 关闭服务前删除剩余的对象，避免后台删除影响之后的测试
+	t.Cleanup(func() {
+		backend.lock.Lock()
+		backend.failures = map[string]int{}
+		backend.lock.Unlock()
+		api.Close()
+	})
+
+	return api, backend
+}
+
+func objectExists(t *testing.T, backend *faultyBackend, key string) bool {
+	t.Helper()
+
+	_, err := backend.HeadObject(testBucket, key)
+	if gofakes3.HasErrorCode(err, gofakes3.ErrNoSuchKey) {
+		return false
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return true
+}
+
+func saveTestLog(t *testing.T, api *RemoteApi, fileId string, content []byte) {
+	t.Helper()
+
+	err := api.SaveLog(&LogFile{FileId: fileId, FileSteam: io.NopCloser(bytes.NewReader(content))})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestLog(t *testing.T, logFile *LogFile) []byte {
+	t.Helper()
+
+	defer logFile.FileSteam.Close()
+	content, err := io.ReadAll(logFile.FileSteam)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+func TestRemoteApiSaveAndGetLog(t *testing.T) {
+	api, _ := newTestRemoteApi(t)
+	content := []byte("hello page spy")
+	saveTestLog(t, api, "local.a", content)
+
+	exist, err := api.ExistLog("local.a")
+	if err != nil || !exist {
+		t.Fatalf("expect log to exist, got %t %v", exist, err)
+	}
+
+	exist, err = api.ExistLog("local.b")
+	if err != nil || exist {
+		t.Fatalf("expect log not to exist, got %t %v", exist, err)
+	}
+
+	logFile, err := api.GetLog("local.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if logFile.Size != int64(len(content)) {
+		t.Fatalf("expect size %d, got %d", len(content), logFile.Size)
+	}
+
+	if got := readTestLog(t, logFile); !bytes.Equal(got, content) {
+		t.Fatalf("expect content %q, got %q", content, got)
+	}
+
+	logFile, err = api.GetLogRange("local.a", &ByteRange{Start: 6, Length: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(readTestLog(t, logFile)); got != "page" {
+		t.Fatalf("expect range content page, got %q", got)
+	}
+}
+
+func TestRemoteApiMultipartUpload(t *testing.T) {
+	api, backend := newTestRemoteApi(t)
+
+	// 超过默认 5MB 的分片大小，按分片上传
+	content := make([]byte, 11*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saveTestLog(t, api, "local.large", content)
+	if !objectExists(t, backend, api.joinPath("local.large")) {
+		t.Fatal("expect large object to be uploaded")
+	}
+
+	logFile, err := api.GetLog("local.large")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readTestLog(t, logFile); !bytes.Equal(got, content) {
+		t.Fatal("content of large object mismatch")
+	}
+}
+
+func TestRemoteApiRemoveLogInBatch(t *testing.T) {
+	api, backend := newTestRemoteApi(t)
+	fileIds := []string{"local.a", "local.b", "local.c"}
+	for _, fileId := range fileIds {
+		saveTestLog(t, api, fileId, []byte(fileId))
+	}
+
+	for _, fileId := range fileIds {
+		err := api.RemoveLog(fileId)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 还没有真正删除时已经视为不存在
+		exist, err := api.ExistLog(fileId)
+		if err != nil || exist {
+			t.Fatalf("expect removed log %s not to exist, got %t %v", fileId, exist, err)
+		}
+
+		_, err = api.GetLog(fileId)
+		if err == nil || !strings.Contains(err.Error(), "is deleted") {
+			t.Fatalf("expect reading removed log %s to fail, got %v", fileId, err)
+		}
+	}
+
+	err := api.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fileId := range fileIds {
+		if objectExists(t, backend, api.joinPath(fileId)) {
+			t.Fatalf("expect object of %s to be deleted", fileId)
+		}
+	}
+
+	if calls := backend.getDeleteCalls(); calls != 1 {
+		t.Fatalf("expect objects to be deleted in one request, got %d requests", calls)
+	}
+}
+
+func TestRemoteApiSaveCancelsPendingDelete(t *testing.T) {
+	api, backend := newTestRemoteApi(t)
+	saveTestLog(t, api, "local.a", []byte("old"))
+
+	err := api.RemoveLog("local.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saveTestLog(t, api, "local.a", []byte("new"))
+	err = api.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !objectExists(t, backend, api.joinPath("local.a")) {
+		t.Fatal("expect object written again not to be deleted")
+	}
+
+	logFile, err := api.GetLog("local.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(readTestLog(t, logFile)); got != "new" {
+		t.Fatalf("expect content new, got %q", got)
+	}
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrFileTooLarge 上传的文件超过大小限制
+var ErrFileTooLarge = errors.New("upload file is too large")
+
+// SpoolFile 上传内容先写入临时文件，写入的同时计算 MD5，避免把整个文件读入内存
+type SpoolFile struct {
+	file *os.File
+	MD5  string
+	Size int64
+}
+
+// NewSpoolFile maxSize 小于等于 0 时不限制大小，返回的文件已经回到开头，用完需要 Close
+func NewSpoolFile(reader io.Reader, maxSize int64) (*SpoolFile, error) {
+	file, err := os.CreateTemp("", "page-spy-upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("create upload temp file error: %w", err)
+	}
+
+	spool := &SpoolFile{file: file}
+	src := reader
+	if maxSize > 0 {
+		src = io.LimitReader(reader, maxSize+1)
+	}
+
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), src)
+	if err != nil {
+		spool.Close()
+		return nil, fmt.Errorf("read upload file error: %w", err)
+	}
+
+	if maxSize > 0 && size > maxSize {
+		spool.Close()
+		return nil, fmt.Errorf("%w, max size is %d bytes", ErrFileTooLarge, maxSize)
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		spool.Close()
+		return nil, fmt.Errorf("seek upload temp file error: %w", err)
+	}
+
+	spool.MD5 = hex.EncodeToString(hash.Sum(nil))
+	spool.Size = size
+	return spool, nil
+}
+
+func (s *SpoolFile) Read(p []byte) (int, error) {
+	return s.file.Read(p)
+}
+
+func (s *SpoolFile) Seek(offset int64, whence int) (int64, error) {
+	return s.file.Seek(offset, whence)
+}
+
+// Close 关闭并删除临时文件
+func (s *SpoolFile) Close() error {
+	err := s.file.Close()
+	removeErr := os.Remove(s.file.Name())
+	if err != nil {
+		return err
+	}
+
+	if removeErr != nil && !os.IsNotExist(removeErr) {
+		return removeErr
+	}
+
+	return nil
+}
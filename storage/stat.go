@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Stater 只读取文件的大小，不读取文件内容
+type Stater interface {
+	// StatLog 返回的 LogFile 没有 FileSteam，文件不存在时返回的错误与 GetLog 相同
+	StatLog(fileId string) (*LogFile, error)
+}
+
+// StatLog 存储没有实现 Stater 时打开文件后直接关闭
+func StatLog(s StorageApi, fileId string) (*LogFile, error) {
+	stater, ok := s.(Stater)
+	if ok {
+		return stater.StatLog(fileId)
+	}
+
+	logFile, err := s.GetLog(fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	logFile.FileSteam.Close()
+	logFile.FileSteam = nil
+	return logFile, nil
+}
+
+func (f *FileApi) StatLog(fileId string) (*LogFile, error) {
+	logFilePath, err := f.logPath(fileId)
+	if err != nil {
+		return nil, fmt.Errorf("stat log file error: %w", err)
+	}
+
+	fileInfo, err := os.Stat(logFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("get file size error: %w", err)
+	}
+
+	return &LogFile{
+		FileId:  fileId,
+		Size:    fileInfo.Size(),
+		ModTime: fileInfo.ModTime(),
+	}, nil
+}
+
+// StatLog 使用 HeadObject，不下载对象内容
+func (a *RemoteApi) StatLog(fileId string) (*LogFile, error) {
+	path := a.joinPath(fileId)
+	if a.deleter.isPending(path) {
+		return nil, fmt.Errorf("%w, object %s is deleted", ErrLogNotFound, path)
+	}
+
+	result, err := a.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(a.config.Bucket),
+		Key:    aws.String(path),
+	})
+
+	if isS3NotFound(err) {
+		return nil, fmt.Errorf("%w, object %s", ErrLogNotFound, path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &LogFile{
+		FileId:  fileId,
+		Size:    aws.Int64Value(result.ContentLength),
+		ModTime: aws.TimeValue(result.LastModified),
+	}, nil
+}
+
+func (t *TieredApi) StatLog(fileId string) (*LogFile, error) {
+	logFile, err := t.hot.StatLog(fileId)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return logFile, err
+	}
+
+	return StatLog(t.cold, fileId)
+}
+
+// StatLog 压缩保存的文件只知道压缩后的大小，与 GetLog 一样 Size 为 0
+func (c *CompressApi) StatLog(fileId string) (*LogFile, error) {
+	encoding, exist, err := c.locate(fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exist {
+		return nil, fmt.Errorf("%w, file id %s", ErrLogNotFound, fileId)
+	}
+
+	logFile, err := StatLog(c.StorageApi, encodedFileId(fileId, encoding))
+	if err != nil {
+		return nil, err
+	}
+
+	logFile.FileId = fileId
+	if encoding != EncodingIdentity {
+		logFile.Encoding = encoding
+		logFile.EncodedSize = logFile.Size
+		logFile.Size = 0
+	}
+
+	return logFile, nil
+}
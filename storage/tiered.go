@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/warjiang/page-spy-api/config"
+)
+
+// TieredApi 新文件写入本地磁盘，超过一定时间或本地磁盘超过阈值后迁移到 S3，读取时依次查找两层存储
+// 按路径保存的文件（比如数据库同步文件）只保存在 S3
+type TieredApi struct {
+	hot     *FileApi
+	cold    StorageApi
+	maxAge  time.Duration
+	maxSize int64
+	// 按文件 ID 分段加锁，避免迁移和删除同一个文件时互相覆盖
+	locks [64]sync.Mutex
+}
+
+func NewTieredApi(hot *FileApi, cold StorageApi, c *config.TieredStorageConfig) *TieredApi {
+	return &TieredApi{
+		hot:     hot,
+		cold:    cold,
+		maxAge:  c.GetMigrateAfter(),
+		maxSize: c.GetMaxLocalSizeOfMB() * 1024 * 1024,
+	}
+}
+
+func (t *TieredApi) lock(fileId string) func() {
+	hash := fnv.New32a()
+	hash.Write([]byte(fileId))
+	mutex := &t.locks[hash.Sum32()%uint32(len(t.locks))]
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+func (t *TieredApi) Close() error {
+	return errors.Join(Close(t.hot), Close(t.cold))
+}
+
+// SaveLog 已经迁移到 S3 的文件不再写入本地
+func (t *TieredApi) SaveLog(log *LogFile) error {
+	if log.Overwrite {
+		return t.hot.SaveLog(log)
+	}
+
+	exist, err := t.ExistLog(log.FileId)
+	if err != nil {
+		return err
+	}
+
+	if exist {
+		return nil
+	}
+
+	return t.hot.SaveLog(log)
+}
+
+func (t *TieredApi) GetLog(fileId string) (*LogFile, error) {
+	exist, err := t.hot.ExistLog(fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	if exist {
+		logFile, err := t.hot.GetLog(fileId)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return logFile, err
+		}
+		// 读取前刚好被迁移到 S3，继续从 S3 读取
+	}
+
+	return t.cold.GetLog(fileId)
+}
+
+func (t *TieredApi) ExistLog(fileId string) (bool, error) {
+	exist, err := t.hot.ExistLog(fileId)
+	if err != nil || exist {
+		return exist, err
+	}
+
+	return t.cold.ExistLog(fileId)
+}
+
+func (t *TieredApi) RemoveLog(fileId string) error {
+	unlock := t.lock(fileId)
+	defer unlock()
+
+	err := t.hot.RemoveLog(fileId)
+	if err != nil {
+		return err
+	}
+
+	exist, err := t.cold.ExistLog(fileId)
+	if err != nil || !exist {
+		return err
+	}
+
+	return t.cold.RemoveLog(fileId)
+}
+
+// ReplaceLog 覆盖文件当前所在的那一层
+func (t *TieredApi) ReplaceLog(log *LogFile) error {
+	unlock := t.lock(log.FileId)
+	defer unlock()
+
+	exist, err := t.hot.ExistLog(log.FileId)
+	if err != nil {
+		return err
+	}
+
+	if exist {
+		return t.hot.ReplaceLog(log)
+	}
+
+	cold, ok := t.cold.(replacer)
+	if !ok {
+		return fmt.Errorf("storage does not support replacing files")
+	}
+
+	return cold.ReplaceLog(log)
+}
+
+func (t *TieredApi) Save(path string, data io.Reader) error {
+	return t.cold.Save(path, data)
+}
+
+func (t *TieredApi) Exist(path string) (bool, error) {
+	return t.cold.Exist(path)
+}
+
+func (t *TieredApi) Get(path string) (io.ReadCloser, int64, error) {
+	return t.cold.Get(path)
+}
+
+// Migrate 把本地超过保留时间的文件迁移到 S3，本地总大小超过阈值时从最旧的文件开始继续迁移
+func (t *TieredApi) Migrate() error {
+	files := []*LogInfo{}
+	total := int64(0)
+	err := t.hot.ListLogs(func(info *LogInfo) error {
+		files = append(files, info)
+		total += info.Size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime.Before(files[j].ModTime)
+	})
+
+	before := time.Now().Add(-t.maxAge)
+	moved, movedSize := 0, int64(0)
+	for _, file := range files {
+		overSize := t.maxSize > 0 && total > t.maxSize
+		if !overSize && !file.ModTime.Before(before) {
+			break
+		}
+
+		err := t.migrateFile(file.FileId)
+		if err != nil {
+			log.Errorf("migrate file %s to remote storage error %s", file.FileId, err.Error())
+			continue
+		}
+
+		moved++
+		movedSize += file.Size
+		total -= file.Size
+	}
+
+	if moved > 0 {
+		log.Infof("migrate %d files %dmb to remote storage, local size %dmb", moved, movedSize/(1024*1024), total/(1024*1024))
+	}
+
+	return nil
+}
+
+// migrateFile 上传到 S3 并确认存在后才删除本地文件
+func (t *TieredApi) migrateFile(fileId string) error {
+	unlock := t.lock(fileId)
+	defer unlock()
+
+	logFile, err := t.hot.GetLog(fileId)
+	if err != nil {
+		// 迁移之前已经被删除
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer logFile.FileSteam.Close()
+
+	err = t.cold.SaveLog(logFile)
+	if err != nil {
+		return err
+	}
+
+	exist, err := t.cold.ExistLog(fileId)
+	if err != nil {
+		return err
+	}
+
+	if !exist {
+		return fmt.Errorf("file %s not found in remote storage after upload", fileId)
+	}
+
+	return t.hot.RemoveLog(fileId)
+}
@@ -2,13 +2,35 @@ package task
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
+type Scope string
+
+const (
+	// ScopeEveryNode 每个节点都执行，适合只处理本机数据的任务
+	ScopeEveryNode Scope = "everyNode"
+	// ScopeLeaderOnly 只在主节点执行，适合处理集群共享数据的任务
+	ScopeLeaderOnly Scope = "leaderOnly"
+)
+
+// LeaderChecker 判断当前节点是否为主节点
+type LeaderChecker interface {
+	IsLeader() bool
+}
+
+// LeaderStarter 选主在注册了只在主节点执行的任务后才开始，没有这类任务时不需要选主
+type LeaderStarter interface {
+	StartElection()
+}
+
 type Task struct {
 	name     string
 	interval time.Duration
 	function func() error
+	scope    Scope
+	isLeader func() bool
 	ticker   *time.Ticker
 	done     chan struct{}
 }
@@ -20,6 +42,11 @@ func (t *Task) run() {
 		}
 	}()
 
+	if t.scope == ScopeLeaderOnly && t.isLeader != nil && !t.isLeader() {
+		log.Debugf("task %s skipped, current node is not leader", t.name)
+		return
+	}
+
 	err := t.function()
 	if err != nil {
 		log.Infof("task %s error %s", t.name, err.Error())
@@ -33,13 +60,14 @@ func (t *Task) Close() {
 func (t *Task) Star() {
 	tinker := time.NewTicker(t.interval)
 	t.ticker = tinker
-	log.Infof("task %s start", t.name)
+	log.Infof("task %s start on %s", t.name, t.scope)
 	go func() {
 		for {
 			select {
 			case <-tinker.C:
 				t.run()
 			case <-t.done:
+				tinker.Stop()
 				return
 			}
 		}
@@ -47,10 +75,21 @@ func (t *Task) Star() {
 }
 
 func NewTask(name string, interval time.Duration, f func() error) *Task {
+	return NewScopeTask(name, interval, ScopeEveryNode, f)
+}
+
+// NewLeaderTask 创建只在主节点执行的任务
+func NewLeaderTask(name string, interval time.Duration, f func() error) *Task {
+	return NewScopeTask(name, interval, ScopeLeaderOnly, f)
+}
+
+func NewScopeTask(name string, interval time.Duration, scope Scope, f func() error) *Task {
 	return &Task{
 		name:     name,
 		interval: interval,
 		function: f,
+		scope:    scope,
+		done:     make(chan struct{}),
 	}
 }
 
@@ -61,21 +100,61 @@ func NewTaskManager() *TaskManager {
 }
 
 type TaskManager struct {
-	tasks map[string]*Task
+	lock   sync.RWMutex
+	tasks  map[string]*Task
+	leader LeaderChecker
+}
+
+// SetLeaderChecker 设置选主结果，未设置时当前节点视为主节点
+func (t *TaskManager) SetLeaderChecker(leader LeaderChecker) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.leader = leader
+	for _, task := range t.tasks {
+		if task.scope == ScopeLeaderOnly {
+			t.startElection()
+			return
+		}
+	}
+}
+
+func (t *TaskManager) startElection() {
+	starter, ok := t.leader.(LeaderStarter)
+	if ok {
+		starter.StartElection()
+	}
+}
+
+func (t *TaskManager) IsLeader() bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if t.leader == nil {
+		return true
+	}
+
+	return t.leader.IsLeader()
 }
 
 func (t *TaskManager) AddTask(task *Task) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	findTask, ok := t.tasks[task.name]
 	if ok {
 		return fmt.Errorf("task %s already exists", findTask.name)
 	}
 
+	task.isLeader = t.IsLeader
 	t.tasks[task.name] = task
+	if task.scope == ScopeLeaderOnly && t.leader != nil {
+		t.startElection()
+	}
 	task.Star()
 	return nil
 }
 
 func (t *TaskManager) Close() error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
 	for _, task := range t.tasks {
 		task.Close()
 	}
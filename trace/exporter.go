@@ -0,0 +1,109 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/warjiang/page-spy-api/config"
+)
+
+const (
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// Exporter span 导出器，可以替换为其它实现，比如发送到 OpenTelemetry collector
+type Exporter interface {
+	Export(span *Span) error
+	Close() error
+}
+
+var exporterLock sync.RWMutex
+var exporter Exporter
+
+func SetExporter(e Exporter) {
+	exporterLock.Lock()
+	defer exporterLock.Unlock()
+	exporter = e
+}
+
+func getExporter() Exporter {
+	exporterLock.RLock()
+	defer exporterLock.RUnlock()
+	return exporter
+}
+
+// writerExporter 每个 span 输出一行 JSON
+type writerExporter struct {
+	lock    sync.Mutex
+	service string
+	writer  io.Writer
+	closer  io.Closer
+}
+
+func NewWriterExporter(service string, writer io.Writer, closer io.Closer) Exporter {
+	return &writerExporter{
+		service: service,
+		writer:  writer,
+		closer:  closer,
+	}
+}
+
+func (e *writerExporter) Export(span *Span) error {
+	span.Service = e.service
+	bs, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err = e.writer.Write(append(bs, '\n'))
+	return err
+}
+
+func (e *writerExporter) Close() error {
+	if e.closer == nil {
+		return nil
+	}
+
+	return e.closer.Close()
+}
+
+type noopExporter struct{}
+
+func (noopExporter) Export(_ *Span) error {
+	return nil
+}
+
+func (noopExporter) Close() error {
+	return nil
+}
+
+// NewExporter 根据配置创建导出器并设置为全局导出器，未配置时不导出 span
+func NewExporter(c *config.Config) (Exporter, error) {
+	traceConfig := c.TraceConfig
+	var e Exporter
+	switch traceConfig.GetExporter() {
+	case "":
+		SetExporter(nil)
+		return noopExporter{}, nil
+	case ExporterStdout:
+		e = NewWriterExporter(traceConfig.GetServiceName(), os.Stdout, nil)
+	case ExporterFile:
+		file, err := os.OpenFile(traceConfig.GetFilePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open trace file %s error %w", traceConfig.GetFilePath(), err)
+		}
+		e = NewWriterExporter(traceConfig.GetServiceName(), file, file)
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter %s", traceConfig.GetExporter())
+	}
+
+	log.Infof("trace exporter %s enabled", traceConfig.GetExporter())
+	SetExporter(e)
+	return e, nil
+}
@@ -0,0 +1,84 @@
+package trace
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	KindServer   = "server"
+	KindClient   = "client"
+	KindInternal = "internal"
+)
+
+const (
+	StatusOk    = "ok"
+	StatusError = "error"
+)
+
+// Span 字段与 OpenTelemetry 的 span 保持一致，便于导入到其它追踪系统
+type Span struct {
+	Service      string            `json:"service"`
+	TraceId      string            `json:"traceId"`
+	SpanId       string            `json:"spanId"`
+	ParentSpanId string            `json:"parentSpanId,omitempty"`
+	RequestId    string            `json:"requestId"`
+	Name         string            `json:"name"`
+	Kind         string            `json:"kind"`
+	StartTime    time.Time         `json:"startTime"`
+	EndTime      time.Time         `json:"endTime"`
+	DurationOfMs float64           `json:"durationOfMs"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Status       string            `json:"status"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// Start 创建子 span，context 中没有请求 ID 时生成一个新的
+func Start(ctx context.Context, name string, kind string) (context.Context, *Span) {
+	parent := fromContext(ctx)
+	if parent == nil {
+		ctx = WithRequestId(ctx, NewRequestId())
+		parent = fromContext(ctx)
+	}
+
+	span := &Span{
+		TraceId:      parent.TraceId,
+		SpanId:       newSpanId(),
+		ParentSpanId: parent.SpanId,
+		RequestId:    parent.RequestId,
+		Name:         name,
+		Kind:         kind,
+		StartTime:    time.Now(),
+		Attributes:   map[string]string{},
+	}
+
+	return withSpanContext(ctx, &spanContext{
+		RequestId: parent.RequestId,
+		TraceId:   parent.TraceId,
+		SpanId:    span.SpanId,
+	}), span
+}
+
+func (s *Span) SetAttribute(key string, value string) {
+	s.Attributes[key] = value
+}
+
+// End 结束 span 并交给导出器，未配置导出器时直接丢弃
+func (s *Span) End(err error) {
+	s.EndTime = time.Now()
+	s.DurationOfMs = float64(s.EndTime.Sub(s.StartTime).Microseconds()) / 1000
+	s.Status = StatusOk
+	if err != nil {
+		s.Status = StatusError
+		s.Error = err.Error()
+	}
+
+	exporter := getExporter()
+	if exporter == nil {
+		return
+	}
+
+	if e := exporter.Export(s); e != nil {
+		log.Errorf("export span %s error %s", s.Name, e.Error())
+	}
+}
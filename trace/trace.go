@@ -0,0 +1,131 @@
+package trace
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	HeaderRequestId   = "X-Request-Id"
+	HeaderTraceParent = "Traceparent"
+)
+
+type contextKey struct{}
+
+// spanContext 在 context 中传递的追踪信息，SpanId 为当前 span，子 span 以它为父节点
+type spanContext struct {
+	RequestId string
+	TraceId   string
+	SpanId    string
+}
+
+func NewRequestId() string {
+	return uuid.New().String()
+}
+
+// traceIdOf 由请求 ID 推导出 32 位十六进制的 trace ID，同一个请求在所有节点上得到相同的 trace ID
+func traceIdOf(requestId string) string {
+	id := strings.ReplaceAll(requestId, "-", "")
+	if len(id) == 32 {
+		if _, err := hex.DecodeString(id); err == nil {
+			return strings.ToLower(id)
+		}
+	}
+
+	sum := md5.Sum([]byte(requestId))
+	return hex.EncodeToString(sum[:])
+}
+
+func newSpanId() string {
+	id := uuid.New()
+	return hex.EncodeToString(id[:8])
+}
+
+func fromContext(ctx context.Context) *spanContext {
+	if ctx == nil {
+		return nil
+	}
+
+	sc, _ := ctx.Value(contextKey{}).(*spanContext)
+	return sc
+}
+
+func withSpanContext(ctx context.Context, sc *spanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// WithRequestId 把请求 ID 放入 context，已有相同请求 ID 时保留当前 span
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	if requestId == "" {
+		return ctx
+	}
+
+	sc := fromContext(ctx)
+	if sc != nil && sc.RequestId == requestId {
+		return ctx
+	}
+
+	return withSpanContext(ctx, &spanContext{
+		RequestId: requestId,
+		TraceId:   traceIdOf(requestId),
+	})
+}
+
+func RequestId(ctx context.Context) string {
+	sc := fromContext(ctx)
+	if sc == nil {
+		return ""
+	}
+
+	return sc.RequestId
+}
+
+// Entry 为日志加上请求 ID 字段，方便跨节点关联同一个请求的日志
+func Entry(ctx context.Context, entry *logrus.Entry) *logrus.Entry {
+	requestId := RequestId(ctx)
+	if requestId == "" {
+		return entry
+	}
+
+	return entry.WithField("_request_id", requestId)
+}
+
+// Inject 把请求 ID 和 W3C traceparent 写入请求头
+func Inject(ctx context.Context, header http.Header) {
+	sc := fromContext(ctx)
+	if sc == nil {
+		return
+	}
+
+	header.Set(HeaderRequestId, sc.RequestId)
+	if sc.SpanId != "" {
+		header.Set(HeaderTraceParent, fmt.Sprintf("00-%s-%s-01", sc.TraceId, sc.SpanId))
+	}
+}
+
+// Extract 从请求头恢复追踪信息，没有请求 ID 时返回原 context
+func Extract(ctx context.Context, header http.Header) context.Context {
+	requestId := header.Get(HeaderRequestId)
+	if requestId == "" {
+		return ctx
+	}
+
+	sc := &spanContext{
+		RequestId: requestId,
+		TraceId:   traceIdOf(requestId),
+	}
+
+	parts := strings.Split(header.Get(HeaderTraceParent), "-")
+	if len(parts) == 4 && parts[1] == sc.TraceId {
+		sc.SpanId = parts[2]
+	}
+
+	return withSpanContext(ctx, sc)
+}
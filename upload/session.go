@@ -0,0 +1,366 @@
+package upload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/warjiang/page-spy-api/storage"
+)
+
+var (
+	ErrSessionNotFound = errors.New("upload session not found")
+	ErrOffsetMismatch  = errors.New("upload offset mismatch")
+	ErrIncomplete      = errors.New("upload session is not complete")
+)
+
+// Session 断点续传的上传会话，已上传的内容保存在本机磁盘，Offset 以数据文件的实际大小为准
+type Session struct {
+	Id        string         `json:"uploadId"`
+	Name      string         `json:"name"`
+	GroupId   string         `json:"groupId,omitempty"`
+	Tags      []*storage.Tag `json:"tags"`
+	Size      int64          `json:"size"`
+	Offset    int64          `json:"offset"`
+	CreatedAt time.Time      `json:"createdAt"`
+	ExpiredAt time.Time      `json:"expiredAt"`
+}
+
+func (s *Session) IsComplete() bool {
+	return s.Offset >= s.Size
+}
+
+type SessionManager struct {
+	dir    string
+	expire time.Duration
+	locks  sync.Map
+}
+
+func NewSessionManager(dir string, expire time.Duration) (*SessionManager, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("init upload dir error: %w", err)
+	}
+
+	return &SessionManager{
+		dir:    dir,
+		expire: expire,
+	}, nil
+}
+
+func (m *SessionManager) lock(id string) func() {
+	l, _ := m.locks.LoadOrStore(id, &sync.Mutex{})
+	mutex := l.(*sync.Mutex)
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// checkId 会话 ID 会拼接到文件路径中，只允许字母、数字、点和横线
+func checkId(id string) error {
+	if id == "" || strings.Trim(id, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.-") != "" || strings.Contains(id, "..") {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+func (m *SessionManager) dataPath(id string) string {
+	return filepath.Join(m.dir, id+".part")
+}
+
+func (m *SessionManager) metaPath(id string) string {
+	return filepath.Join(m.dir, id+".json")
+}
+
+func (m *SessionManager) donePath(id string) string {
+	return filepath.Join(m.dir, id+".done")
+}
+
+// finished 已完成的会话保存创建的结果直到会话过期，重复完成时返回同样的结果
+type finished struct {
+	ExpiredAt time.Time       `json:"expiredAt"`
+	Result    json.RawMessage `json:"result"`
+}
+
+func (m *SessionManager) getFinished(id string) (*finished, error) {
+	bs, err := os.ReadFile(m.donePath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("read finished upload session error: %w", err)
+	}
+
+	done := &finished{}
+	err = json.Unmarshal(bs, done)
+	if err != nil {
+		return nil, fmt.Errorf("decode finished upload session error: %w", err)
+	}
+
+	return done, nil
+}
+
+func (m *SessionManager) Create(session *Session) error {
+	if err := checkId(session.Id); err != nil {
+		return err
+	}
+
+	session.Offset = 0
+	session.CreatedAt = time.Now()
+	session.ExpiredAt = session.CreatedAt.Add(m.expire)
+	bs, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(m.dataPath(session.Id), nil, 0644)
+	if err != nil {
+		return fmt.Errorf("create upload session error: %w", err)
+	}
+
+	err = os.WriteFile(m.metaPath(session.Id), bs, 0644)
+	if err != nil {
+		os.Remove(m.dataPath(session.Id))
+		return fmt.Errorf("create upload session error: %w", err)
+	}
+
+	return nil
+}
+
+func (m *SessionManager) get(id string) (*Session, error) {
+	if err := checkId(id); err != nil {
+		return nil, err
+	}
+
+	bs, err := os.ReadFile(m.metaPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrSessionNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("read upload session error: %w", err)
+	}
+
+	session := &Session{}
+	err = json.Unmarshal(bs, session)
+	if err != nil {
+		return nil, fmt.Errorf("decode upload session error: %w", err)
+	}
+
+	info, err := os.Stat(m.dataPath(id))
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+
+	session.Offset = info.Size()
+	return session, nil
+}
+
+func (m *SessionManager) Get(id string) (*Session, error) {
+	unlock := m.lock(id)
+	defer unlock()
+	return m.get(id)
+}
+
+// Append 从 offset 开始写入分片，offset 必须等于已上传的大小；连接中断时已收到的部分同样保留
+func (m *SessionManager) Append(id string, offset int64, body io.Reader) (*Session, error) {
+	unlock := m.lock(id)
+	defer unlock()
+
+	session, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset != session.Offset {
+		return session, fmt.Errorf("%w, expect offset %d but got %d", ErrOffsetMismatch, session.Offset, offset)
+	}
+
+	file, err := os.OpenFile(m.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open upload session error: %w", err)
+	}
+	defer file.Close()
+
+	remain := session.Size - session.Offset
+	written, err := io.Copy(file, io.LimitReader(body, remain+1))
+	if written > remain {
+		// 分片超出声明的大小说明内容有误，整个分片作废
+		if truncateErr := file.Truncate(session.Offset); truncateErr != nil {
+			return nil, fmt.Errorf("rollback upload chunk error: %w", truncateErr)
+		}
+		written = 0
+		err = fmt.Errorf("%w, upload session size is %d bytes", storage.ErrFileTooLarge, session.Size)
+	}
+
+	if syncErr := file.Sync(); syncErr != nil && err == nil {
+		err = syncErr
+	}
+
+	session.Offset = session.Offset + written
+	if err != nil {
+		return session, err
+	}
+
+	return session, nil
+}
+
+// Finalize 上传完成后用 create 处理内容并删除会话，整个过程持有会话锁
+// 同时或重复完成同一个会话时只执行一次 create，之后返回保存的结果
+func (m *SessionManager) Finalize(id string, create func(session *Session, file io.Reader) (interface{}, error)) (json.RawMessage, error) {
+	if err := checkId(id); err != nil {
+		return nil, err
+	}
+
+	unlock := m.lock(id)
+	defer unlock()
+
+	done, err := m.getFinished(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if done != nil {
+		return done.Result, nil
+	}
+
+	session, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !session.IsComplete() {
+		return nil, fmt.Errorf("%w, uploaded %d of %d bytes", ErrIncomplete, session.Offset, session.Size)
+	}
+
+	file, err := os.Open(m.dataPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("open upload session error: %w", err)
+	}
+
+	res, err := create(session, file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+
+	// 先保存结果再删除会话，删除失败时会话也不会被再次完成
+	bs, err := json.Marshal(&finished{ExpiredAt: session.ExpiredAt, Result: result})
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(m.donePath(id), bs, 0644)
+	if err != nil {
+		log.Errorf("save finished upload session %s error %s", id, err.Error())
+	}
+
+	for _, path := range []string{m.metaPath(id), m.dataPath(id)} {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("remove finished upload session %s error %s", id, err.Error())
+		}
+	}
+
+	return result, nil
+}
+
+func (m *SessionManager) Remove(id string) error {
+	if err := checkId(id); err != nil {
+		return err
+	}
+
+	unlock := m.lock(id)
+	defer func() {
+		unlock()
+		m.locks.Delete(id)
+	}()
+
+	err := os.Remove(m.metaPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove upload session error: %w", err)
+	}
+
+	err = os.Remove(m.dataPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove upload session error: %w", err)
+	}
+
+	err = os.Remove(m.donePath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove upload session error: %w", err)
+	}
+
+	return nil
+}
+
+// CleanExpired 删除已过期的会话
+func (m *SessionManager) CleanExpired() error {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), ".done"); ok {
+			m.cleanFinished(id, now)
+			continue
+		}
+
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		session, err := m.Get(id)
+		if err != nil && !errors.Is(err, ErrSessionNotFound) {
+			log.Errorf("read upload session %s error %s", id, err.Error())
+			continue
+		}
+
+		// 数据文件丢失的会话同样清理掉
+		if session != nil && now.Before(session.ExpiredAt) {
+			continue
+		}
+
+		err = m.Remove(id)
+		if err != nil {
+			log.Errorf("remove expired upload session %s error %s", id, err.Error())
+			continue
+		}
+
+		log.Infof("remove expired upload session %s", id)
+	}
+
+	return nil
+}
+
+func (m *SessionManager) cleanFinished(id string, now time.Time) {
+	unlock := m.lock(id)
+	done, err := m.getFinished(id)
+	unlock()
+	if err != nil {
+		log.Errorf("read finished upload session %s error %s", id, err.Error())
+	}
+
+	if done != nil && now.Before(done.ExpiredAt) {
+		return
+	}
+
+	err = m.Remove(id)
+	if err != nil {
+		log.Errorf("remove finished upload session %s error %s", id, err.Error())
+	}
+}
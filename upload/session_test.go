@@ -0,0 +1,136 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestSession(t *testing.T, m *SessionManager, content []byte) string {
+	t.Helper()
+
+	session := &Session{Id: "local.abc", Name: "a.log", Size: int64(len(content))}
+	err := m.Create(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Append(session.Id, 0, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return session.Id
+}
+
+func TestFinalizeConcurrently(t *testing.T) {
+	m, err := NewSessionManager(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("hello page spy")
+	id := newTestSession(t, m, content)
+
+	var created atomic.Int32
+	create := func(session *Session, file io.Reader) (interface{}, error) {
+		created.Add(1)
+		bs, err := io.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(bs, content) {
+			t.Errorf("expect content %q, got %q", content, bs)
+		}
+
+		// 放大并发完成的时间窗口
+		time.Sleep(50 * time.Millisecond)
+		return map[string]string{"fileId": "local.file", "name": session.Name}, nil
+	}
+
+	results := make([]json.RawMessage, 10)
+	errs := make([]error, len(results))
+	wg := sync.WaitGroup{}
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = m.Finalize(id, create)
+		}(i)
+	}
+	wg.Wait()
+
+	if n := created.Load(); n != 1 {
+		t.Fatalf("expect log to be created once, got %d", n)
+	}
+
+	for i := range results {
+		if errs[i] != nil {
+			t.Fatalf("finalize %d error %s", i, errs[i].Error())
+		}
+
+		if !bytes.Equal(results[i], results[0]) {
+			t.Fatalf("expect same result, got %s and %s", results[i], results[0])
+		}
+	}
+
+	_, err = m.Get(id)
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expect finished session to be removed, got %v", err)
+	}
+}
+
+func TestFinalizeIncomplete(t *testing.T) {
+	m, err := NewSessionManager(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := &Session{Id: "local.abc", Name: "a.log", Size: 10}
+	err = m.Create(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Finalize(session.Id, func(*Session, io.Reader) (interface{}, error) {
+		t.Fatal("expect incomplete session not to be created")
+		return nil, nil
+	})
+	if !errors.Is(err, ErrIncomplete) {
+		t.Fatalf("expect ErrIncomplete, got %v", err)
+	}
+}
+
+func TestCleanExpiredFinished(t *testing.T) {
+	m, err := NewSessionManager(t.TempDir(), -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := newTestSession(t, m, []byte("a"))
+	_, err = m.Finalize(id, func(*Session, io.Reader) (interface{}, error) {
+		return "created", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.CleanExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 结果已经清理，再次完成时会话不存在
+	_, err = m.Finalize(id, func(*Session, io.Reader) (interface{}, error) {
+		return "created again", nil
+	})
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expect ErrSessionNotFound after clean, got %v", err)
+	}
+}